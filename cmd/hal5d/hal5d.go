@@ -19,6 +19,8 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -32,10 +34,13 @@ import (
 	"go.uber.org/zap"
 	"gopkg.in/alecthomas/kingpin.v2"
 	client "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/planetlabs/hal5d/internal/cert"
 	"github.com/planetlabs/hal5d/internal/event"
+	"github.com/planetlabs/hal5d/internal/haproxy"
 	"github.com/planetlabs/hal5d/internal/kubernetes"
+	"github.com/planetlabs/hal5d/internal/ocsp"
 	"github.com/planetlabs/hal5d/internal/webhook"
 	"github.com/planetlabs/hal5d/internal/webhook/subscriber"
 	"github.com/planetlabs/hal5d/internal/webhook/validator"
@@ -50,6 +55,11 @@ const (
 const (
 	prometheusNamespace = "hal5d"
 	syncEventBuffer     = 128
+
+	// The controller name hal5d claims in IngressClass resources.
+	defaultIngressController = "planetlabs.com/hal5d"
+
+	defaultOCSPTimeout = 10 * time.Second
 )
 
 func main() {
@@ -58,11 +68,41 @@ func main() {
 		debug               = app.Flag("debug", "Run with debug logging.").Short('d').Bool()
 		dir                 = app.Flag("tls-dir", "Directory in which TLS certificates are managed.").Default("/tls").String()
 		forceHTTPSHostsFile = app.Flag("force-https-hosts-file", "File in which the forced https host list is managed.").Default("").String()
+		redirectHostsFile   = app.Flag("https-redirect-hosts-file", "File in which an haproxy map of hosts whose http traffic is redirected to https, to the redirect code, is managed.").Default("").String()
+		hstsHostsFile       = app.Flag("hsts-hosts-file", "File in which an haproxy map of hosts to the value of their Strict-Transport-Security header is managed.").Default("").String()
+		sourceAllowlistFile = app.Flag("source-allowlist-file", "File in which an haproxy map of restricted hosts to the comma separated CIDRs allowed to access them is managed.").Default("").String()
+		backendHostsFile    = app.Flag("backend-hosts-file", "File in which an haproxy map of hosts to the backend serving their ingress' backend protocol is managed.").Default("").String()
+		passthroughFile     = app.Flag("passthrough-hosts-file", "File in which an haproxy map of the SNI hosts of TLS passthrough ingresses to the backend their connections are passed to is managed.").Default("").String()
+		annotationMaps      = app.Flag("annotation-maps-config", "YAML or JSON file configuring haproxy map files to maintain from ingress annotations.").Default("").String()
+		crtListFile         = app.Flag("crt-list-file", "File in which an haproxy crt-list of the managed certificates is maintained. Must not be in the TLS directory.").Default("").String()
+		clientCADir         = app.Flag("client-ca-dir", "Directory in which client CA bundles and CRLs of ingresses that verify client certificates are managed. Requires --crt-list-file.").Default("").String()
 		kubecfg             = app.Flag("kubeconfig", "Path to kubeconfig file. Leave unset to use in-cluster config.").String()
 		apiserver           = app.Flag("master", "Address of Kubernetes API server. Leave unset to use in-cluster config.").String()
 		vURL                = app.Flag("validate-url", "Webhook URL used to validate haproxy configuration.").Default(defaultWebhookURLValidate).String()
 		rURL                = app.Flag("reload-url", "Webhook URL used to reload haproxy configuration.").Default(defaultWebhookURLReload).String()
+		reloadDebounce      = app.Flag("reload-debounce", "Coalesce all changes that occur within this window into a single haproxy reload.").Default(subscriber.DefaultDebounce.String()).Duration()
+		reloadMinInterval   = app.Flag("reload-min-interval", "Minimum time between haproxy reloads.").Default(subscriber.DefaultMinInterval.String()).Duration()
+		runtimeSocket       = app.Flag("runtime-socket", "haproxy stats socket (at admin level) via which to update certificates without reloading. Leave unset to always reload.").Default("").String()
+		runtimeTimeout      = app.Flag("runtime-timeout", "Timeout for haproxy runtime API commands.").Default(haproxy.DefaultTimeout.String()).Duration()
 		listen              = app.Flag("listen", "Address at which to expose /metrics and /healthz.").Default(":10002").String()
+		adminListen         = app.Flag("admin-listen", "Address at which to expose unauthenticated administrative endpoints, such as /deletions/override. Must only be reachable by trusted clients. Leave unset to disable them.").Default("").String()
+		ingressClasses      = app.Flag("ingress-class", "Only manage ingresses of this class. May be specified multiple times. Leave unset to manage all ingresses.").Strings()
+		namespaces          = app.Flag("namespace", "Only watch ingresses and secrets in this namespace. May be specified multiple times. Leave unset to watch all namespaces.").Strings()
+		clusterClasses      = app.Flag("cluster-ingress-classes", "Watch the cluster scoped IngressClasses when --namespace is set, in order to manage ingresses whose class is handled by --ingress-controller. Requires a ClusterRole. IngressClasses are always watched when --namespace is unset.").Bool()
+		excludeNamespaces   = app.Flag("exclude-namespace", "Never watch ingresses and secrets in this namespace. May be specified multiple times.").Strings()
+		checkValidity       = app.Flag("check-validity-period", "Reject TLS certificates that have expired or are not yet valid, removing their certificate pairs unless --keep-last-known-good is set. Expired certificates are served by default.").Bool()
+		expiryInterval      = app.Flag("expiry-check-interval", "How often to check for expiring TLS certificates.").Default(cert.DefaultExpiryCheckInterval.String()).Duration()
+		expiryThresholds    = app.Flag("expiry-warning-threshold", "Warn when a TLS certificate will expire within this duration. May be specified multiple times.").Default(defaultExpiryThresholds()...).DurationList()
+		ocspStapling        = app.Flag("ocsp-stapling", "Fetch OCSP responses for TLS certificates and write them next to each certificate pair for haproxy to staple.").Bool()
+		ocspInterval        = app.Flag("ocsp-refresh-interval", "How often to check for OCSP responses that need refreshing.").Default(cert.DefaultOCSPRefreshInterval.String()).Duration()
+		ocspTimeout         = app.Flag("ocsp-timeout", "Timeout for requests to OCSP servers.").Default(defaultOCSPTimeout.String()).Duration()
+		lastKnownGood       = app.Flag("keep-last-known-good", "Keep serving the existing certificate pair when its TLS secret becomes invalid, until the secret is fixed or deleted.").Bool()
+		deletionGrace       = app.Flag("deletion-grace-period", "Defer removing the certificate pairs of deleted ingresses and secrets for this long, in case they reappear. Leave unset to remove them immediately.").Default("0s").Duration()
+		maxDeletedFraction  = app.Flag("max-deleted-fraction", "Hold ingress and secret deletions that would remove more than this fraction of the managed certificate pairs within --deletion-window, until the condition clears or they are overridden by POSTing to /deletions/override at --admin-listen. Leave unset to allow any fraction.").Default("0").Float64()
+		maxDeletedPairs     = app.Flag("max-deleted-pairs", "Hold ingress and secret deletions that would remove more than this many certificate pairs within --deletion-window, until the condition clears or they are overridden by POSTing to /deletions/override at --admin-listen. Leave unset to allow any number.").Default("0").Int()
+		deletionWindow      = app.Flag("deletion-window", "Window within which certificate pairs removed by deletions are counted against --max-deleted-fraction and --max-deleted-pairs.").Default(cert.DefaultDeletionWindow.String()).Duration()
+		strictHosts         = app.Flag("strict-host-coverage", "Reject TLS certificates that do not cover all of the hosts they are expected to serve.").Bool()
+		ingressController   = app.Flag("ingress-controller", "Also manage ingresses referencing an IngressClass with this controller name when --ingress-class is set.").Default(defaultIngressController).String()
 	)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	glogWorkaround()
@@ -100,8 +140,72 @@ func main() {
 			},
 			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName},
 		)
+		notBefore = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "certpair_not_before_seconds",
+				Help:      "Time before which the leaf certificate of a certificate pair is not valid, in seconds since the Unix epoch.",
+			},
+			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName},
+		)
+		notAfter = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "certpair_not_after_seconds",
+				Help:      "Time after which the leaf certificate of a certificate pair is not valid, in seconds since the Unix epoch.",
+			},
+			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName},
+		)
+		info = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "certpair_info",
+				Help:      "Identity of the leaf certificate of a certificate pair. Always 1.",
+			},
+			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName, cert.LabelSubject, cert.LabelIssuer, cert.LabelSerial, cert.LabelFingerprint},
+		)
+		uncovered = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "certpair_uncovered_hosts",
+				Help:      "Number of hosts a certificate pair is expected to serve that are not covered by its leaf certificate.",
+			},
+			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName},
+		)
+		ocspFailures = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: prometheusNamespace,
+				Name:      "ocsp_failures_total",
+				Help:      "Total failures to fetch a valid OCSP response for the leaf certificate of a certificate pair.",
+			},
+			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName},
+		)
+		lastKnownGoodPairs = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "certpair_last_known_good",
+				Help:      "Certificate pairs that are still served while their TLS secret is invalid. Always 1.",
+			},
+			[]string{cert.LabelNamespace, cert.LabelIngressName, cert.LabelSecretName},
+		)
+		heldDeletions = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "held_deletions",
+				Help:      "Ingress and secret deletions, and stale certificate pair removals, held because they would remove too many certificate pairs.",
+			},
+			[]string{cert.LabelContext},
+		)
+		pendingTombstones = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "pending_tombstones",
+				Help:      "Deleted resources whose removal is deferred until their grace period elapses.",
+			},
+			[]string{kubernetes.LabelKind},
+		)
 	)
-	prometheus.MustRegister(writes, deletes, errors, invalids)
+	prometheus.MustRegister(writes, deletes, errors, invalids, notBefore, notAfter, info, uncovered, ocspFailures, lastKnownGoodPairs, heldDeletions, pendingTombstones)
 
 	log, err := zap.NewProduction()
 	if *debug {
@@ -110,7 +214,20 @@ func main() {
 	kingpin.FatalIfError(err, "cannot create log")
 	defer log.Sync()
 
-	mx := cert.Metrics{Writes: writes, Deletes: deletes, Errors: errors, Invalids: invalids}
+	mx := cert.Metrics{
+		Writes:    writes,
+		Deletes:   deletes,
+		Errors:    errors,
+		Invalids:  invalids,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+		Info:      info,
+
+		UncoveredHosts: uncovered,
+		OCSPFailures:   ocspFailures,
+		LastKnownGood:  lastKnownGoodPairs,
+		HeldDeletions:  heldDeletions,
+	}
 
 	c, err := kubernetes.BuildConfigFromFlags(*apiserver, *kubecfg)
 	kingpin.FatalIfError(err, "cannot create Kubernetes client configuration")
@@ -118,13 +235,14 @@ func main() {
 	cs, err := client.NewForConfig(c)
 	kingpin.FatalIfError(err, "cannot create Kubernetes client")
 
-	ingresses := kubernetes.NewIngressWatch(cs)
-	secrets := kubernetes.NewSecretWatch(cs)
+	scope := kubernetes.Scope{Namespaces: *namespaces, ExcludeNamespaces: *excludeNamespaces}
+	ingresses, err := kubernetes.NewIngressWatch(cs, scope)
+	kingpin.FatalIfError(err, "cannot watch ingresses")
+
+	secrets := kubernetes.NewSecretWatch(cs, scope)
 	e := kubernetes.NewEventRecorder(cs)
 
 	v := validator.New(webhook.New(*vURL))
-	s, err := subscriber.New(webhook.New(*rURL), subscriber.WithLogger(log))
-	kingpin.FatalIfError(err, "cannot create reload webhook")
 
 	// Check for the https-only host list. If this file does not exist, and haproxy
 	// is configured to use it, it will report configuration errors given the example
@@ -136,6 +254,83 @@ func main() {
 			kingpin.FatalIfError(err, "cannot open force-https-hosts file")
 		}
 	}
+	if *redirectHostsFile != "" {
+		if _, err = os.Stat(*redirectHostsFile); err != nil {
+			kingpin.FatalIfError(err, "cannot open https-redirect-hosts file")
+		}
+	}
+	if *hstsHostsFile != "" {
+		if _, err = os.Stat(*hstsHostsFile); err != nil {
+			kingpin.FatalIfError(err, "cannot open hsts-hosts file")
+		}
+	}
+	if *sourceAllowlistFile != "" {
+		if _, err = os.Stat(*sourceAllowlistFile); err != nil {
+			kingpin.FatalIfError(err, "cannot open source-allowlist file")
+		}
+	}
+	if *backendHostsFile != "" {
+		if _, err = os.Stat(*backendHostsFile); err != nil {
+			kingpin.FatalIfError(err, "cannot open backend-hosts file")
+		}
+	}
+	if *passthroughFile != "" {
+		if _, err = os.Stat(*passthroughFile); err != nil {
+			kingpin.FatalIfError(err, "cannot open passthrough-hosts file")
+		}
+	}
+
+	// haproxy will fail to validate a configuration that references a crt-list
+	// that does not exist. We create an empty crt-list if necessary so that
+	// the configuration may be validated before any certificates are written.
+	if *crtListFile != "" {
+		f, err := os.OpenFile(*crtListFile, os.O_CREATE|os.O_RDONLY, 0600)
+		kingpin.FatalIfError(err, "cannot create crt-list file")
+		f.Close() // nolint:gas,gosec
+	}
+
+	// Like the crt-list, haproxy will fail to validate a configuration that
+	// references a map file that does not exist.
+	var maps []cert.AnnotationMap
+	if *annotationMaps != "" {
+		b, err := ioutil.ReadFile(*annotationMaps)
+		kingpin.FatalIfError(err, "cannot read annotation maps config")
+		maps, err = cert.ParseAnnotationMaps(b)
+		kingpin.FatalIfError(err, "cannot parse annotation maps config")
+		for _, am := range maps {
+			f, err := os.OpenFile(am.File, os.O_CREATE|os.O_RDONLY, 0600)
+			kingpin.FatalIfError(err, "cannot create annotation map file")
+			f.Close() // nolint:gas,gosec
+		}
+	}
+
+	if *clientCADir != "" {
+		if *crtListFile == "" {
+			kingpin.Fatalf("--client-ca-dir requires --crt-list-file")
+		}
+		kingpin.FatalIfError(os.MkdirAll(*clientCADir, 0700), "cannot create client CA directory")
+	}
+
+	var reload webhook.Hook = webhook.New(*rURL)
+	if *runtimeSocket != "" {
+		// Changes to any file haproxy reads other than the cert pairs and
+		// crt-list require a reload.
+		config := []string{*forceHTTPSHostsFile, *redirectHostsFile, *hstsHostsFile, *sourceAllowlistFile, *backendHostsFile, *passthroughFile, *clientCADir}
+		for _, am := range maps {
+			config = append(config, am.File)
+		}
+		reload, err = haproxy.New(haproxy.NewClient("unix", *runtimeSocket, *runtimeTimeout), *dir, reload,
+			haproxy.WithLogger(log),
+			haproxy.WithCrtListFile(*crtListFile),
+			haproxy.WithStagedFilePrefix(cert.StagedCertPairPrefix),
+			haproxy.WithConfigFiles(config...))
+		kingpin.FatalIfError(err, "cannot create runtime API hook")
+	}
+	s, err := subscriber.New(reload,
+		subscriber.WithLogger(log),
+		subscriber.WithDebounce(*reloadDebounce),
+		subscriber.WithMinInterval(*reloadMinInterval))
+	kingpin.FatalIfError(err, "cannot create reload webhook")
 
 	// This works around the race when a pod running both haproxy and hal5d
 	// starts. If hal5d starts first and writes out some TLS certificates fast
@@ -147,7 +342,12 @@ func main() {
 		time.Sleep(2 * time.Second)
 	}
 
-	m, err := cert.NewManager(*dir, secrets,
+	h := &httpRunner{l: *listen, h: map[string]http.Handler{
+		"/metrics": promhttp.Handler(),
+		"/healthz": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { r.Body.Close() }), // nolint:gas,gosec
+	}}
+
+	mo := []cert.ManagerOption{
 		cert.WithLogger(log),
 		cert.WithMetrics(mx),
 		cert.WithEventRecorder(event.NewKubernetesRecorder(e, ingresses)),
@@ -155,19 +355,124 @@ func main() {
 		cert.WithValidator(v),
 		cert.WithSubscriber(s),
 		cert.WithForceHTTPSHostsFile(*forceHTTPSHostsFile),
-	)
+		cert.WithHTTPSRedirectHostsFile(*redirectHostsFile),
+		cert.WithHSTSHostsFile(*hstsHostsFile),
+		cert.WithSourceAllowlistFile(*sourceAllowlistFile),
+		cert.WithBackendHostsFile(*backendHostsFile),
+		cert.WithPassthroughHostsFile(*passthroughFile),
+		cert.WithCrtListFile(*crtListFile),
+		cert.WithClientCADir(*clientCADir),
+		cert.WithAnnotationMaps(maps...),
+		cert.WithIngressClasses(*ingressClasses...),
+		cert.WithValidityPeriodCheck(*checkValidity),
+		cert.WithStrictHostCoverage(*strictHosts),
+		cert.WithLastKnownGood(*lastKnownGood),
+	}
+
+	// IngressClasses are only consulted when filtering by class. Older API
+	// servers do not serve them, in which case we filter by class name alone.
+	// IngressClasses are cluster scoped, so they are not watched by default
+	// when hal5d is limited to namespaces and may only have namespaced RBAC.
+	rs := []runner{h, s, ingresses, secrets}
+	synced := []cache.InformerSynced{}
+	switch {
+	case len(*ingressClasses) == 0:
+	case len(*namespaces) > 0 && !*clusterClasses:
+		log.Info("not watching cluster scoped IngressClasses - filtering by ingress class name only")
+	default:
+		classes, err := kubernetes.NewIngressClassWatch(cs)
+		switch {
+		case kubernetes.IsNotServed(err):
+			log.Info("API server does not serve IngressClasses - filtering by ingress class name only")
+		case err != nil:
+			kingpin.FatalIfError(err, "cannot watch ingress classes")
+		default:
+			rs = append(rs, classes)
+			synced = append(synced, classes.HasSynced)
+			mo = append(mo, cert.WithIngressClassController(classes, *ingressController))
+		}
+	}
+
+	if *ocspStapling {
+		st, err := cert.NewOCSPStapler(ocsp.New(*ocspTimeout), *ocspInterval)
+		kingpin.FatalIfError(err, "cannot create OCSP stapler")
+		rs = append(rs, st)
+		mo = append(mo, cert.WithOCSPStapler(st))
+	}
+
+	// Deletions are optionally tombstoned for a grace period before they reach
+	// the manager, which consults tombstoned secrets until they expire.
+	var store kubernetes.SecretStore = secrets
+	var tombstones *kubernetes.TombstoningResourceEventHandler
+	if *deletionGrace > 0 {
+		tombstones, err = kubernetes.NewTombstoningResourceEventHandler(secrets, *deletionGrace,
+			kubernetes.WithTombstoneLogger(log),
+			kubernetes.WithPendingTombstones(pendingTombstones))
+		kingpin.FatalIfError(err, "cannot create deletion grace period handler")
+		store = tombstones
+	}
+
+	m, err := cert.NewManager(*dir, store, mo...)
 	kingpin.FatalIfError(err, "cannot create certificate manager")
 
+	expiry, err := cert.NewExpiryChecker(m, *expiryInterval, *expiryThresholds...)
+	kingpin.FatalIfError(err, "cannot create certificate expiry checker")
+	rs = append(rs, expiry)
+
 	sync := kubernetes.NewSynchronousResourceEventHandler(m, syncEventBuffer)
-	ingresses.AddEventHandler(sync)
-	secrets.AddEventHandler(sync)
+	var watched cache.ResourceEventHandler = sync
 
-	h := &httpRunner{l: *listen, h: map[string]http.Handler{
-		"/metrics": promhttp.Handler(),
-		"/healthz": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { r.Body.Close() }), // nolint:gas,gosec
-	}}
+	// Deletions that outlive their grace period must pass the deletion
+	// breaker, if any, before they reach the manager.
+	if *maxDeletedFraction > 0 || *maxDeletedPairs > 0 {
+		bo := []cert.BreakerOption{cert.WithDeletionWindow(*deletionWindow)}
+		if *maxDeletedFraction > 0 {
+			bo = append(bo, cert.WithMaxDeletedFraction(*maxDeletedFraction))
+		}
+		if *maxDeletedPairs > 0 {
+			bo = append(bo, cert.WithMaxDeletedPairs(*maxDeletedPairs))
+		}
+		b, err := cert.NewDeletionBreaker(m, bo...)
+		kingpin.FatalIfError(err, "cannot create deletion breaker")
+		b.AddEventHandler(watched)
+		watched = b
+
+		// Overriding the breaker applies deletions en masse, so it is only
+		// exposed on the admin listener.
+		if *adminListen != "" {
+			rs = append(rs, &httpRunner{l: *adminListen, p: map[string]http.Handler{"/deletions/override": overrideHandler(b)}})
+		}
+	}
+	if tombstones != nil {
+		tombstones.AddEventHandler(watched)
+		watched = tombstones
+	}
+	ingresses.AddEventHandler(watched)
+	secrets.AddEventHandler(watched)
+
+	// Ingress and secret events are not handled until the caches the manager
+	// consults to process them have synced, any cert pairs written by older
+	// versions of hal5d have been migrated, and the TLS directory has been
+	// reconciled with the ingresses that exist. Reconciliation writes all cert
+	// pairs as a single batch, avoiding validating each one in turn.
+	rs = append(rs, &syncedRunner{
+		r:      sync,
+		synced: append(synced, ingresses.HasSynced, secrets.HasSynced),
+		setup: func() {
+			m.Migrate(ingresses.List())
+			m.Reconcile(ingresses.List())
+		},
+	})
 
-	kingpin.FatalIfError(await(h, sync, ingresses, secrets), "error watching Kubernetes")
+	kingpin.FatalIfError(await(rs...), "error watching Kubernetes")
+}
+
+func defaultExpiryThresholds() []string {
+	d := make([]string, 0, len(cert.DefaultExpiryThresholds))
+	for _, t := range cert.DefaultExpiryThresholds {
+		d = append(d, t.String())
+	}
+	return d
 }
 
 type runner interface {
@@ -184,9 +489,28 @@ func await(rs ...runner) error {
 	return g.Run()
 }
 
+// A syncedRunner runs the wrapped runner once the supplied caches have synced
+// and the optional setup function has returned.
+type syncedRunner struct {
+	r      runner
+	synced []cache.InformerSynced
+	setup  func()
+}
+
+func (r *syncedRunner) Run(stop <-chan struct{}) {
+	if !cache.WaitForCacheSync(stop, r.synced...) {
+		return
+	}
+	if r.setup != nil {
+		r.setup()
+	}
+	r.r.Run(stop)
+}
+
 type httpRunner struct {
 	l string
 	h map[string]http.Handler
+	p map[string]http.Handler
 }
 
 func (r *httpRunner) Run(stop <-chan struct{}) {
@@ -194,6 +518,9 @@ func (r *httpRunner) Run(stop <-chan struct{}) {
 	for path, handler := range r.h {
 		rt.Handler("GET", path, handler)
 	}
+	for path, handler := range r.p {
+		rt.Handler("POST", path, handler)
+	}
 
 	s := &http.Server{Addr: r.l, Handler: rt}
 	ctx, cancel := context.WithTimeout(context.Background(), 0*time.Second)
@@ -206,6 +533,15 @@ func (r *httpRunner) Run(stop <-chan struct{}) {
 	return
 }
 
+// overrideHandler overrides the supplied deletion breaker, applying any
+// deletions it holds.
+func overrideHandler(b *cert.DeletionBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body.Close()                                              // nolint:gas,gosec
+		fmt.Fprintf(w, "applied %d held deletions\n", b.Override()) // nolint:gas,gosec
+	})
+}
+
 // Many Kubernetes client things depend on glog. glog gets sad when flag.Parse()
 // is not called before it tries to emit a log line. flag.Parse() fights with
 // kingpin.
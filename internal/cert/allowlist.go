@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// A comma separated list of the CIDRs allowed to access the ingress'
+	// hosts. Hosts may be accessed from any source when unset.
+	annoWhitelistSourceRange = "hal5d.planetlabs.com/whitelist-source-range"
+
+	sourceAllowlistTempFilePrefix = "source-allowlist-tempfile"
+)
+
+// sourceRanges returns the canonical, sorted, and deduplicated CIDRs allowed to
+// access the supplied ingress' hosts, and whether the ingress restricts access
+// at all. Bare IP addresses are treated as single address CIDRs. An error is
+// returned if any CIDR is malformed.
+func sourceRanges(i *kubernetes.Ingress) ([]string, bool, error) {
+	v, ok := i.GetAnnotations()[annoWhitelistSourceRange]
+	if !ok {
+		return nil, false, nil
+	}
+	seen := make(map[string]bool)
+	ranges := []string{}
+	for _, r := range strings.Split(v, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, true, errors.Errorf("malformed IP address %q", r)
+			}
+			if ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, true, errors.Errorf("malformed CIDR %q", r)
+		}
+		if c := n.String(); !seen[c] {
+			seen[c] = true
+			ranges = append(ranges, c)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, true, errors.New("no CIDRs specified")
+	}
+	sort.Strings(ranges)
+	return ranges, true, nil
+}
+
+// newSourceAllowlist returns a host map of restricted hostnames to the comma
+// separated CIDRs allowed to access them.
+func newSourceAllowlist() *hostMap {
+	return &hostMap{
+		hostMapTable:   hostMapTable{},
+		Name:           "source allowlist",
+		Annotation:     annoWhitelistSourceRange,
+		tempFilePrefix: sourceAllowlistTempFilePrefix,
+		entries: func(i *kubernetes.Ingress) (map[string]string, error) {
+			ranges, _, err := sourceRanges(i)
+			if err != nil {
+				return nil, err
+			}
+			return hostEntries(collectHosts(i), strings.Join(ranges, ",")), nil
+		},
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSourceRanges(t *testing.T) {
+	cases := []struct {
+		name           string
+		annotations    map[string]string
+		want           []string
+		wantRestricted bool
+		wantErr        bool
+	}{
+		{
+			name: "Unset",
+		},
+		{
+			name:           "CanonicalSortedAndDeduplicated",
+			annotations:    map[string]string{annoWhitelistSourceRange: "192.168.1.1/16, 10.0.0.0/8,192.168.0.0/16"},
+			want:           []string{"10.0.0.0/8", "192.168.0.0/16"},
+			wantRestricted: true,
+		},
+		{
+			name:           "BareAddresses",
+			annotations:    map[string]string{annoWhitelistSourceRange: "10.1.2.3,2001:db8::1"},
+			want:           []string{"10.1.2.3/32", "2001:db8::1/128"},
+			wantRestricted: true,
+		},
+		{
+			name:           "MalformedCIDR",
+			annotations:    map[string]string{annoWhitelistSourceRange: "10.0.0.0/8,10.0.0.0/33"},
+			wantRestricted: true,
+			wantErr:        true,
+		},
+		{
+			name:           "Empty",
+			annotations:    map[string]string{annoWhitelistSourceRange: " , "},
+			wantRestricted: true,
+			wantErr:        true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}}
+			got, restricted, err := sourceRanges(i)
+			if restricted != tc.wantRestricted {
+				t.Errorf("sourceRanges(...): want restricted %v, got %v", tc.wantRestricted, restricted)
+			}
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("sourceRanges(...): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("sourceRanges(...): want error, got nil")
+			}
+			if diff := deep.Equal(tc.want, got); diff != nil {
+				t.Errorf("sourceRanges(...): want != got %v", diff)
+			}
+		})
+	}
+}
+
+func TestSourceAllowlist(t *testing.T) {
+	withRanges := func(name, ranges string, hosts ...string) *kubernetes.Ingress {
+		return hostMapIngress(name, map[string]string{annoWhitelistSourceRange: ranges}, hosts...)
+	}
+
+	ht := newHostMapTest(t, WithSourceAllowlistFile)
+	ht.run(t, []hostMapStep{
+		{
+			name:         "AddIngress",
+			fn:           func() { ht.OnAdd(withRanges("b", "10.0.0.0/8", "example.com", "acme.com")) },
+			want:         "acme.com 10.0.0.0/8\nexample.com 10.0.0.0/8",
+			wantNotified: 1,
+		},
+		{
+			name:         "EquivalentRangesUnchanged",
+			fn:           func() { ht.OnUpdate(nil, withRanges("b", "10.1.2.3/8, 10.0.0.0/8", "example.com", "acme.com")) },
+			want:         "acme.com 10.0.0.0/8\nexample.com 10.0.0.0/8",
+			wantNotified: 1,
+		},
+		{
+			// An unrestricted ingress does not lift the restriction another
+			// ingress places on a host they share. Its cert pair is new.
+			name:         "UnrestrictedIngressSharesHost",
+			fn:           func() { ht.OnAdd(hostMapIngress("a", nil, "example.com")) },
+			want:         "acme.com 10.0.0.0/8\nexample.com 10.0.0.0/8",
+			wantNotified: 2,
+		},
+		{
+			name:         "ConflictingRanges",
+			fn:           func() { ht.OnUpdate(nil, withRanges("a", "192.168.0.0/16", "example.com")) },
+			want:         "acme.com 10.0.0.0/8\nexample.com 192.168.0.0/16",
+			wantNotified: 3,
+		},
+		{
+			name:         "DeleteConflictingIngress",
+			fn:           func() { ht.OnDelete(withRanges("a", "192.168.0.0/16", "example.com")) },
+			want:         "acme.com 10.0.0.0/8\nexample.com 10.0.0.0/8",
+			wantNotified: 4,
+		},
+	})
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const annotationMapTempFilePrefix = "annotation-map-tempfile"
+
+// defaultAnnotationMapValue maps each host to the annotation's value.
+const defaultAnnotationMapValue = "{{.Value}}"
+
+// An AnnotationMap configures an haproxy map file that is maintained from an
+// ingress annotation. Every host of each ingress with the annotation is mapped
+// to a value rendered from the annotation's value.
+type AnnotationMap struct {
+	// Annotation is the ingress annotation from which the map is maintained.
+	Annotation string `json:"annotation"`
+
+	// File is the haproxy map file to maintain.
+	File string `json:"file"`
+
+	// Value is an optional text/template from which the value of each host
+	// is rendered. The template may refer to the annotation's .Value, and to
+	// the .Host, .Namespace, and .Name of the ingress. Hosts for which the
+	// template renders an empty value are not mapped. Defaults to the
+	// annotation's value.
+	Value string `json:"value,omitempty"`
+}
+
+type annotationMapConfig struct {
+	Maps []AnnotationMap `json:"maps"`
+}
+
+// ParseAnnotationMaps parses a YAML or JSON annotation map configuration, e.g.
+//
+//	maps:
+//	- annotation: example.org/maintenance
+//	  file: /hal5d-shared/maintenance.map
+//	  value: "{{.Value}}"
+func ParseAnnotationMaps(b []byte) ([]AnnotationMap, error) {
+	c := &annotationMapConfig{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, errors.Wrap(err, "cannot parse annotation map configuration")
+	}
+	return c.Maps, nil
+}
+
+// annotationMapData is supplied to the value template of an annotation map.
+type annotationMapData struct {
+	Value     string
+	Host      string
+	Namespace string
+	Name      string
+}
+
+// newAnnotationMap returns a host map maintained from the supplied annotation
+// map configuration.
+func newAnnotationMap(a AnnotationMap) (*hostMap, error) {
+	if a.Annotation == "" {
+		return nil, errors.New("annotation map must specify an annotation")
+	}
+	if a.File == "" {
+		return nil, errors.Errorf("annotation map for %v must specify a file", a.Annotation)
+	}
+	v := a.Value
+	if v == "" {
+		v = defaultAnnotationMapValue
+	}
+	tmpl, err := template.New(a.Annotation).Option("missingkey=error").Parse(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse value template of annotation map for %v", a.Annotation)
+	}
+	return &hostMap{
+		hostMapTable:   hostMapTable{},
+		Name:           "annotation map " + a.Annotation,
+		File:           a.File,
+		Annotation:     a.Annotation,
+		tempFilePrefix: annotationMapTempFilePrefix,
+		entries: func(i *kubernetes.Ingress) (map[string]string, error) {
+			return annotationMapEntries(tmpl, a.Annotation, i)
+		},
+	}, nil
+}
+
+// annotationMapEntries renders the value of each of the supplied ingress'
+// hosts from the supplied template. It returns no entries if the ingress does
+// not have the supplied annotation.
+func annotationMapEntries(tmpl *template.Template, annotation string, i *kubernetes.Ingress) (map[string]string, error) {
+	v, ok := i.GetAnnotations()[annotation]
+	if !ok {
+		return nil, nil
+	}
+	entries := make(map[string]string)
+	for _, h := range collectHosts(i) {
+		b := &bytes.Buffer{}
+		d := annotationMapData{Value: v, Host: h, Namespace: i.GetNamespace(), Name: i.GetName()}
+		if err := tmpl.Execute(b, d); err != nil {
+			return nil, errors.Wrapf(err, "cannot render value for host %v", h)
+		}
+		value := strings.TrimSpace(b.String())
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.Errorf("value for host %v spans multiple lines", h)
+		}
+		if value != "" {
+			entries[h] = value
+		}
+	}
+	return entries, nil
+}
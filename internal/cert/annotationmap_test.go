@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseAnnotationMaps(t *testing.T) {
+	cases := []struct {
+		name    string
+		b       string
+		want    []AnnotationMap
+		wantErr bool
+	}{
+		{
+			name: "YAML",
+			b: `
+maps:
+- annotation: example.org/maintenance
+  file: /shared/maintenance.map
+- annotation: example.org/rate-limit
+  file: /shared/rate-limit.map
+  value: "{{.Namespace}}/{{.Value}}"
+`,
+			want: []AnnotationMap{
+				{Annotation: "example.org/maintenance", File: "/shared/maintenance.map"},
+				{Annotation: "example.org/rate-limit", File: "/shared/rate-limit.map", Value: "{{.Namespace}}/{{.Value}}"},
+			},
+		},
+		{
+			name: "JSON",
+			b:    `{"maps": [{"annotation": "example.org/maintenance", "file": "/shared/maintenance.map"}]}`,
+			want: []AnnotationMap{{Annotation: "example.org/maintenance", File: "/shared/maintenance.map"}},
+		},
+		{
+			name:    "UnknownField",
+			b:       `{"maps": [{"annotation": "example.org/maintenance", "path": "/shared/maintenance.map"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseAnnotationMaps([]byte(tc.b))
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("ParseAnnotationMaps(...): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("ParseAnnotationMaps(...): want error, got nil")
+			}
+			if diff := deep.Equal(tc.want, got); diff != nil {
+				t.Errorf("ParseAnnotationMaps(...): want != got %v", diff)
+			}
+		})
+	}
+}
+
+func TestInvalidAnnotationMaps(t *testing.T) {
+	cases := []struct {
+		name string
+		maps []AnnotationMap
+	}{
+		{name: "NoAnnotation", maps: []AnnotationMap{{File: "/shared/a.map"}}},
+		{name: "NoFile", maps: []AnnotationMap{{Annotation: "example.org/a"}}},
+		{name: "InvalidTemplate", maps: []AnnotationMap{{Annotation: "example.org/a", File: "/shared/a.map", Value: "{{.Value"}}},
+		{name: "FileInTLSDir", maps: []AnnotationMap{{Annotation: "example.org/a", File: "/tls/a.map"}}},
+		{
+			name: "DuplicateFile",
+			maps: []AnnotationMap{
+				{Annotation: "example.org/a", File: "/shared/a.map"},
+				{Annotation: "example.org/b", File: "/shared/./a.map"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewManager("/tls", mapSecretStore{}, WithAnnotationMaps(tc.maps...)); err == nil {
+				t.Errorf("NewManager(...): want error, got nil")
+			}
+		})
+	}
+}
+
+func TestAnnotationMaps(t *testing.T) {
+	const (
+		annoMaintenance = "example.org/maintenance"
+		annoRateLimit   = "example.org/rate-limit"
+	)
+	withAnnotations := func(name string, annotations map[string]string, hosts ...string) *kubernetes.Ingress {
+		i := &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, Annotations: annotations}}
+		for _, h := range hosts {
+			i.Spec.Rules = append(i.Spec.Rules, kubernetes.IngressRule{Host: h})
+		}
+		return i
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	shared := populate(t, fs, map[string][]byte{"maintenance.map": nil, "rate-limit.map": nil})
+	maintenance := filepath.Join(shared, "maintenance.map")
+	rateLimit := filepath.Join(shared, "rate-limit.map")
+
+	r := &hostMapRecorder{}
+	sub := &testSubscriber{}
+	m, err := NewManager(dir, mapSecretStore{},
+		WithFilesystem(fs),
+		WithEventRecorder(r),
+		WithSubscriber(sub),
+		WithValidator(&contentValidator{fs: fs, dir: shared, invalid: []byte("invalid")}),
+		WithAnnotationMaps(
+			AnnotationMap{Annotation: annoMaintenance, File: maintenance},
+			AnnotationMap{Annotation: annoRateLimit, File: rateLimit, Value: `{{if ne .Value "0"}}{{.Namespace}}/{{.Name}}:{{.Value}}{{end}}`},
+		))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	steps := []struct {
+		name            string
+		fn              func()
+		wantMaintenance string
+		wantRateLimit   string
+		wantEvents      []string
+		wantNotified    int
+	}{
+		{
+			name: "AddIngress",
+			fn: func() {
+				m.OnAdd(withAnnotations("a", map[string]string{annoMaintenance: "true"}, "b.example.com", "a.example.com"))
+			},
+			wantMaintenance: "a.example.com true\nb.example.com true",
+			wantNotified:    1,
+		},
+		{
+			name: "AddConflictingIngress",
+			fn: func() {
+				m.OnAdd(withAnnotations("b", map[string]string{annoMaintenance: "false", annoRateLimit: "10"}, "a.example.com", "c.example.com"))
+			},
+			wantMaintenance: "a.example.com true\nb.example.com true\nc.example.com false",
+			wantRateLimit:   "a.example.com ns/b:10\nc.example.com ns/b:10",
+			wantNotified:    2,
+		},
+		{
+			name: "EmptyValuesAreNotMapped",
+			fn: func() {
+				m.OnUpdate(nil, withAnnotations("b", map[string]string{annoMaintenance: "false", annoRateLimit: "0"}, "a.example.com", "c.example.com"))
+			},
+			wantMaintenance: "a.example.com true\nb.example.com true\nc.example.com false",
+			wantNotified:    3,
+		},
+		{
+			name: "InvalidConfigurationRestored",
+			fn: func() {
+				m.OnUpdate(nil, withAnnotations("b", map[string]string{annoMaintenance: "invalid"}, "a.example.com", "c.example.com"))
+			},
+			wantMaintenance: "a.example.com true\nb.example.com true\nc.example.com false",
+			wantEvents:      []string{"InvalidAnnotation ns/b " + annoMaintenance},
+			wantNotified:    3,
+		},
+		{
+			name: "MultiLineValue",
+			fn: func() {
+				m.OnUpdate(nil, withAnnotations("a", map[string]string{annoMaintenance: "tr\nue"}, "b.example.com", "a.example.com"))
+			},
+			wantMaintenance: "a.example.com true\nb.example.com true\nc.example.com false",
+			wantEvents:      []string{"InvalidAnnotation ns/a " + annoMaintenance},
+			wantNotified:    3,
+		},
+		{
+			name:            "DeleteIngress",
+			fn:              func() { m.OnDelete(withAnnotations("a", nil, "b.example.com", "a.example.com")) },
+			wantMaintenance: "a.example.com false\nc.example.com false",
+			wantNotified:    4,
+		},
+	}
+
+	for _, s := range steps {
+		r.events = nil
+		s.fn()
+		validate(t, fs, shared, map[string][]byte{
+			"maintenance.map": []byte(s.wantMaintenance),
+			"rate-limit.map":  []byte(s.wantRateLimit),
+		})
+		if diff := deep.Equal(s.wantEvents, r.events); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+		if sub.notified != s.wantNotified {
+			t.Errorf("%v: want %v notifications, got %v", s.name, s.wantNotified, sub.notified)
+		}
+	}
+}
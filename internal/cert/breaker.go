@@ -0,0 +1,563 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"sync"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Defaults used by new deletion breakers.
+const (
+	DefaultDeletionWindow = 1 * time.Minute
+)
+
+// A staleCertPair is a notification of a cert pair found to be stale while
+// reconciling, whose removal was held by a deletion breaker. Certificate
+// managers remove stale cert pairs when notified of their deletion.
+type staleCertPair certPair
+
+// A heldDeletion is a notification of a deleted ingress or secret, or of a
+// stale cert pair, that a deletion breaker has not yet forwarded. Its context
+// identifies whether the deleted resource is an ingress, a secret, or a cert
+// pair found to be stale while reconciling. The name of a stale cert pair is
+// its filename.
+type heldDeletion struct {
+	context   string
+	namespace string
+	name      string
+	obj       interface{}
+}
+
+// A DeletionBreaker protects the cert pairs managed by a certificate manager
+// from being removed en masse, for example because the API server briefly
+// presents an empty view of its ingresses or secrets, or because many
+// ingresses change to a class the manager does not manage. It forwards
+// notifications to the registered handlers, but holds deletions once those
+// forwarded within a window would remove more than a threshold of the cert
+// pairs. Held deletions of resources that reappear are dropped. The remaining
+// held deletions are forwarded once they no longer exceed the threshold, for
+// example because the window expired, or when the breaker is overridden.
+//
+// The handlers a breaker forwards to may not apply deletions immediately, so
+// the breaker remembers which cert pairs the deletions it forwarded within the
+// current window remove, rather than relying upon their absence from the TLS
+// directory.
+type DeletionBreaker struct {
+	m           *Manager
+	maxFraction float64
+	maxPairs    int
+	window      time.Duration
+	now         func() time.Time
+
+	// fwd serialises notifications forwarded to the registered handlers,
+	// which may block until the certificate manager handles them. mu guards
+	// the breaker's state, and is never held while forwarding, such that the
+	// manager may consult the breaker while reconciling.
+	fwd     sync.Mutex
+	h       []cache.ResourceEventHandler
+	mu      sync.Mutex
+	start   time.Time
+	deleted map[string]bool
+	held    []heldDeletion
+	expiry  *time.Timer
+	managed map[metadata]bool
+}
+
+// A BreakerOption can be used to configure new deletion breakers.
+type BreakerOption func(*DeletionBreaker) error
+
+// WithMaxDeletedFraction configures the fraction of cert pairs a deletion
+// breaker allows to be deleted within a window.
+func WithMaxDeletedFraction(f float64) BreakerOption {
+	return func(b *DeletionBreaker) error {
+		if f <= 0 || f > 1 {
+			return errors.Errorf("maximum fraction of deleted cert pairs %v must be greater than 0 and at most 1", f)
+		}
+		b.maxFraction = f
+		return nil
+	}
+}
+
+// WithMaxDeletedPairs configures the number of cert pairs a deletion breaker
+// allows to be deleted within a window.
+func WithMaxDeletedPairs(n int) BreakerOption {
+	return func(b *DeletionBreaker) error {
+		if n <= 0 {
+			return errors.Errorf("maximum number of deleted cert pairs %v must be positive", n)
+		}
+		b.maxPairs = n
+		return nil
+	}
+}
+
+// WithDeletionWindow configures the window within which a deletion breaker
+// counts deleted cert pairs.
+func WithDeletionWindow(d time.Duration) BreakerOption {
+	return func(b *DeletionBreaker) error {
+		if d <= 0 {
+			return errors.Errorf("deletion window %v must be positive", d)
+		}
+		b.window = d
+		return nil
+	}
+}
+
+// NewDeletionBreaker returns a new ResourceEventHandler that holds deletions
+// which would remove too many of the cert pairs managed by the supplied
+// certificate manager. The breaker also holds the removal of stale cert pairs
+// when the manager reconciles its TLS directory, if removing them would
+// exceed its threshold. At least one of WithMaxDeletedFraction and
+// WithMaxDeletedPairs must be supplied.
+func NewDeletionBreaker(m *Manager, o ...BreakerOption) (*DeletionBreaker, error) {
+	b := &DeletionBreaker{
+		m:       m,
+		window:  DefaultDeletionWindow,
+		now:     time.Now,
+		deleted: make(map[string]bool),
+		managed: make(map[metadata]bool),
+	}
+	for _, bo := range o {
+		if err := bo(b); err != nil {
+			return nil, errors.Wrap(err, "cannot apply deletion breaker option")
+		}
+	}
+	if b.maxFraction == 0 && b.maxPairs == 0 {
+		return nil, errors.New("deletion breaker requires a maximum fraction or number of deleted cert pairs")
+	}
+	m.breaker = b
+	return b, nil
+}
+
+// AddEventHandler registers a handler to be notified of the resources that
+// pass through the breaker.
+func (b *DeletionBreaker) AddEventHandler(h cache.ResourceEventHandler) {
+	b.fwd.Lock()
+	defer b.fwd.Unlock()
+	b.h = append(b.h, h)
+}
+
+// OnAdd forwards notifications of new resources, dropping any held deletion
+// of the resource. Ingresses that are no longer managed by the certificate
+// manager are handled as deletions.
+func (b *DeletionBreaker) OnAdd(obj interface{}) {
+	b.fwd.Lock()
+	defer b.fwd.Unlock()
+	if b.unmanaged(obj) && b.hold(obj) {
+		return
+	}
+	for _, h := range b.h {
+		h.OnAdd(obj)
+	}
+	b.forward(b.reappear(obj)...)
+}
+
+// OnUpdate forwards notifications of updated resources, dropping any held
+// deletion of the resource. Ingresses that are no longer managed by the
+// certificate manager are handled as deletions.
+func (b *DeletionBreaker) OnUpdate(oldObj, newObj interface{}) {
+	b.fwd.Lock()
+	defer b.fwd.Unlock()
+	if b.unmanaged(newObj) && b.hold(newObj) {
+		return
+	}
+	for _, h := range b.h {
+		h.OnUpdate(oldObj, newObj)
+	}
+	b.forward(b.reappear(newObj)...)
+}
+
+// unmanaged returns true if the supplied resource is an ingress that was
+// previously managed by the certificate manager, but no longer is. The manager
+// removes the cert pairs of such ingresses as if they were deleted. Ingresses
+// are considered managed until their deletion is forwarded.
+func (b *DeletionBreaker) unmanaged(obj interface{}) bool {
+	i, ok := obj.(*kubernetes.Ingress)
+	if !ok {
+		return false
+	}
+	md := metadata{Namespace: i.GetNamespace(), Name: i.GetName()}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.m.manages(i) {
+		b.managed[md] = true
+		return false
+	}
+	return b.managed[md]
+}
+
+// OnDelete forwards notifications of deleted resources, unless the cert pairs
+// they and the deletions already forwarded within the current window would
+// remove exceed the breaker's threshold. Once the breaker holds a deletion it
+// holds all deletions that would remove a cert pair, until the condition
+// clears or the breaker is overridden.
+func (b *DeletionBreaker) OnDelete(obj interface{}) {
+	b.fwd.Lock()
+	defer b.fwd.Unlock()
+	if b.hold(obj) {
+		return
+	}
+	b.forward(obj)
+}
+
+// hold returns true if the breaker holds the supplied deletion, including if
+// it already holds a deletion of the same resource.
+func (b *DeletionBreaker) hold(obj interface{}) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := newHeldDeletion(obj)
+	if !ok {
+		return false
+	}
+	for _, h := range b.held {
+		if h.context == d.context && h.namespace == d.namespace && h.name == d.name {
+			return true
+		}
+	}
+	existing, err := b.existing()
+	if err != nil {
+		b.m.log.Error("cannot list TLS cert pairs - not checking deletion against breaker threshold", zap.Error(err))
+		b.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextMassDeletion}).Inc()
+		return false
+	}
+	log := b.m.log.With(
+		zap.String(LabelContext, d.context),
+		zap.String(LabelNamespace, d.namespace),
+		zap.String("name", d.name))
+	if !b.admit(log, existing, d) {
+		return true
+	}
+	if d.context == ContextDeleteIngress {
+		delete(b.managed, metadata{Namespace: d.namespace, Name: d.name})
+	}
+	return false
+}
+
+// holdStale holds the removal of the supplied cert pairs, found to be stale
+// while reconciling, if removing them would exceed the breaker's threshold.
+// It returns the filenames of the held cert pairs. Held cert pairs are
+// removed via the registered handlers once the condition clears or the
+// breaker is overridden.
+func (b *DeletionBreaker) holdStale(stale []certPair) map[string]bool {
+	if len(stale) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existing, err := b.existing()
+	if err != nil {
+		b.m.log.Error("cannot list TLS cert pairs - not checking stale cert pairs against breaker threshold", zap.Error(err))
+		b.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextMassDeletion}).Inc()
+		return nil
+	}
+	ds := make([]heldDeletion, 0, len(stale))
+	for _, cp := range stale {
+		ds = append(ds, heldDeletion{context: ContextReconcile, namespace: cp.Namespace, name: cp.Filename(), obj: staleCertPair(cp)})
+	}
+	if b.admit(b.m.log.With(zap.String(LabelContext, ContextReconcile)), existing, ds...) {
+		return nil
+	}
+	held := make(map[string]bool, len(ds))
+	for _, d := range ds {
+		held[d.name] = true
+	}
+	return held
+}
+
+// admit returns true if the supplied deletions may be forwarded, recording
+// the cert pairs they remove within the current window. Deletions that would
+// exceed the breaker's threshold, or that would remove a cert pair while the
+// breaker holds other deletions, are held instead. The caller must hold b.mu.
+func (b *DeletionBreaker) admit(log *zap.Logger, existing []certPair, ds ...heldDeletion) bool {
+	affected := b.affected(existing, ds...)
+	if len(affected) == 0 {
+		return true
+	}
+
+	if now := b.now(); len(b.held) == 0 && now.Sub(b.start) >= b.window {
+		b.start, b.deleted = now, make(map[string]bool)
+	}
+	total := b.total(existing)
+	if len(b.held) == 0 && !b.exceeds(len(b.deleted)+len(affected), total) {
+		b.delete(affected)
+		return true
+	}
+
+	if len(b.held) == 0 {
+		log.Warn("mass deletion detected - holding deletions until the condition clears or the breaker is overridden",
+			zap.Int("deletedPairs", len(b.deleted)),
+			zap.Int("heldPairs", len(affected)),
+			zap.Int("pairs", total))
+		b.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextMassDeletion}).Inc()
+		b.expiry = time.AfterFunc(b.start.Add(b.window).Sub(b.now()), b.expire)
+	}
+	log.Debug("holding deletion")
+	b.held = append(b.held, ds...)
+	b.observe()
+	return false
+}
+
+// Override forwards all held deletions, regardless of the breaker's threshold,
+// and starts a new window. It returns the number of deletions forwarded.
+func (b *DeletionBreaker) Override() int {
+	b.fwd.Lock()
+	defer b.fwd.Unlock()
+	b.mu.Lock()
+	n := len(b.held)
+	if n > 0 {
+		b.m.log.Warn("deletion breaker overridden - applying held deletions", zap.Int("deletions", n))
+	}
+	released := b.release()
+	b.start, b.deleted = time.Time{}, make(map[string]bool)
+	b.mu.Unlock()
+	b.forward(released...)
+	return n
+}
+
+// expire starts a new window once the current window has expired, and
+// forwards the held deletions if they do not exceed the breaker's threshold
+// within it.
+func (b *DeletionBreaker) expire() {
+	b.fwd.Lock()
+	defer b.fwd.Unlock()
+	b.forward(b.expired()...)
+}
+
+// expired returns the held deletions to forward once the current window has
+// expired, scheduling another check if any remain held.
+func (b *DeletionBreaker) expired() []interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.held) == 0 {
+		return nil
+	}
+	now := b.now()
+	if remaining := b.start.Add(b.window).Sub(now); remaining > 0 {
+		b.expiry = time.AfterFunc(remaining, b.expire)
+		return nil
+	}
+	b.start, b.deleted = now, make(map[string]bool)
+	released := b.clear()
+	if len(b.held) > 0 {
+		b.expiry = time.AfterFunc(b.window, b.expire)
+	}
+	return released
+}
+
+// reappear drops any held deletion of the supplied resource, returning the
+// remaining held deletions to forward if they no longer exceed the breaker's
+// threshold.
+func (b *DeletionBreaker) reappear(obj interface{}) []interface{} {
+	r, ok := newHeldDeletion(obj)
+	if !ok {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.held) == 0 {
+		return nil
+	}
+	held := b.held[:0]
+	for _, d := range b.held {
+		if d.reappears(r) {
+			b.m.log.Info("deleted resource reappeared - dropped held deletion",
+				zap.String(LabelContext, d.context),
+				zap.String(LabelNamespace, d.namespace),
+				zap.String("name", d.name))
+			continue
+		}
+		held = append(held, d)
+	}
+	b.held = held
+	b.observe()
+	return b.clear()
+}
+
+// clear releases the held deletions if they no longer exceed the breaker's
+// threshold, returning those to forward. The caller must hold b.mu.
+func (b *DeletionBreaker) clear() []interface{} {
+	existing, err := b.existing()
+	if err != nil {
+		b.m.log.Error("cannot list TLS cert pairs - not checking held deletions against breaker threshold", zap.Error(err))
+		b.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextMassDeletion}).Inc()
+		return nil
+	}
+	affected := b.affected(existing, b.held...)
+	if b.exceeds(len(b.deleted)+len(affected), b.total(existing)) {
+		return nil
+	}
+	if len(b.held) > 0 {
+		b.m.log.Info("mass deletion cleared - applying held deletions", zap.Int("deletions", len(b.held)))
+	}
+	b.delete(affected)
+	return b.release()
+}
+
+// release forgets all held deletions, returning them to forward. The caller
+// must hold b.mu.
+func (b *DeletionBreaker) release() []interface{} {
+	if b.expiry != nil {
+		b.expiry.Stop()
+		b.expiry = nil
+	}
+	released := make([]interface{}, 0, len(b.held))
+	for _, d := range b.held {
+		released = append(released, d.obj)
+	}
+	b.held = nil
+	b.observe()
+	return released
+}
+
+// forward the supplied deletions to the registered handlers. The caller must
+// hold b.fwd.
+func (b *DeletionBreaker) forward(objs ...interface{}) {
+	for _, obj := range objs {
+		for _, h := range b.h {
+			h.OnDelete(obj)
+		}
+	}
+}
+
+// affected returns the filenames of the supplied cert pairs that would be
+// removed by the supplied deletions, excluding those already deleted within
+// the current window. The caller must hold b.mu.
+func (b *DeletionBreaker) affected(existing []certPair, ds ...heldDeletion) map[string]bool {
+	affected := make(map[string]bool)
+	for _, cp := range existing {
+		if b.deleted[cp.Filename()] {
+			continue
+		}
+		for _, d := range ds {
+			if d.affects(cp) {
+				affected[cp.Filename()] = true
+			}
+		}
+	}
+	return affected
+}
+
+// total returns the number of cert pairs at the start of the current window;
+// those that exist plus those deleted within the window that may no longer
+// exist. The caller must hold b.mu.
+func (b *DeletionBreaker) total(existing []certPair) int {
+	total := len(b.deleted)
+	for _, cp := range existing {
+		if !b.deleted[cp.Filename()] {
+			total++
+		}
+	}
+	return total
+}
+
+// delete records that the supplied cert pairs were deleted within the current
+// window. The caller must hold b.mu.
+func (b *DeletionBreaker) delete(affected map[string]bool) {
+	for name := range affected {
+		b.deleted[name] = true
+	}
+}
+
+// exceeds returns true if deleting the supplied number of cert pairs, out of
+// the supplied total, exceeds the breaker's threshold.
+func (b *DeletionBreaker) exceeds(deleted, total int) bool {
+	if b.maxPairs > 0 && deleted > b.maxPairs {
+		return true
+	}
+	return b.maxFraction > 0 && float64(deleted) > b.maxFraction*float64(total)
+}
+
+// observe updates the number of held deletions of each kind of resource. The
+// caller must hold b.mu.
+func (b *DeletionBreaker) observe() {
+	count := map[string]int{ContextDeleteIngress: 0, ContextDeleteSecret: 0, ContextReconcile: 0}
+	for _, d := range b.held {
+		count[d.context]++
+	}
+	for context, n := range count {
+		b.m.metric.HeldDeletions.With(prometheus.Labels{LabelContext: context}).Set(float64(n))
+	}
+}
+
+// existing returns the cert pairs in the certificate manager's TLS directory.
+func (b *DeletionBreaker) existing() ([]certPair, error) {
+	fi, err := afero.ReadDir(b.m.fs, b.m.tlsDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list TLS cert pairs")
+	}
+	cps := make([]certPair, 0, len(fi))
+	for _, f := range fi {
+		if cp, err := newCertPair(f.Name()); err == nil {
+			cps = append(cps, cp)
+		}
+	}
+	return cps, nil
+}
+
+func newHeldDeletion(obj interface{}) (heldDeletion, bool) {
+	o := obj
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		o = d.Obj
+	}
+	switch o := o.(type) {
+	case *kubernetes.Ingress:
+		return heldDeletion{context: ContextDeleteIngress, namespace: o.GetNamespace(), name: o.GetName(), obj: obj}, true
+	case *v1.Secret:
+		return heldDeletion{context: ContextDeleteSecret, namespace: o.GetNamespace(), name: o.GetName(), obj: obj}, true
+	}
+	return heldDeletion{}, false
+}
+
+// affects returns true if the supplied cert pair would be removed by this
+// deletion.
+func (d heldDeletion) affects(cp certPair) bool {
+	if cp.Namespace != d.namespace {
+		return false
+	}
+	switch d.context {
+	case ContextDeleteIngress:
+		return cp.IngressName == d.name
+	case ContextDeleteSecret:
+		return cp.SecretName == d.name
+	case ContextReconcile:
+		return cp.Filename() == d.name
+	}
+	return false
+}
+
+// reappears returns true if this deletion is of the supplied reappeared
+// resource. Stale cert pairs reappear along with their ingress.
+func (d heldDeletion) reappears(r heldDeletion) bool {
+	if d.namespace != r.namespace {
+		return false
+	}
+	if cp, ok := d.obj.(staleCertPair); ok {
+		return r.context == ContextDeleteIngress && cp.IngressName == r.name
+	}
+	return d.context == r.context && d.name == r.name
+}
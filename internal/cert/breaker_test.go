@@ -0,0 +1,481 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+	"github.com/planetlabs/hal5d/internal/metrics"
+
+	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type recordingHandler struct {
+	events []string
+}
+
+func (h *recordingHandler) record(e string, obj interface{}) {
+	if d, ok := newHeldDeletion(obj); ok {
+		e += " " + d.namespace + "/" + d.name
+	}
+	h.events = append(h.events, e)
+}
+
+func (h *recordingHandler) OnAdd(obj interface{})               { h.record("add", obj) }
+func (h *recordingHandler) OnUpdate(oldObj, newObj interface{}) { h.record("update", newObj) }
+func (h *recordingHandler) OnDelete(obj interface{})            { h.record("delete", obj) }
+
+type mapCounter struct {
+	metrics.NopCounter
+	v *float64
+}
+
+func (c *mapCounter) Inc() {
+	*c.v++
+}
+
+type mapCounterVec map[string]*float64
+
+func (m mapCounterVec) With(l prometheus.Labels) prometheus.Counter {
+	k := labelKey(l)
+	if _, ok := m[k]; !ok {
+		m[k] = new(float64)
+	}
+	return &mapCounter{v: m[k]}
+}
+
+func TestDeletionBreaker(t *testing.T) {
+	ingress := func(name string) *kubernetes.Ingress {
+		return &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+	}
+	secret := func(name string) *v1.Secret {
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, map[string][]byte{
+		"ns_a_s1.pem": coolPEM,
+		"ns_b_s2.pem": coolPEM,
+		"ns_c_s3.pem": coolPEM,
+		"ns_d_s4.pem": coolPEM,
+		"ns_x_s5.pem": coolPEM,
+		"ns_x_s6.pem": coolPEM,
+	})
+
+	mx := newNopMetrics()
+	errs, held := mapCounterVec{}, mapGaugeVec{}
+	mx.Errors, mx.HeldDeletions = errs, held
+	m, err := NewManager(dir, mapSecretStore{}, WithFilesystem(fs), WithMetrics(mx))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	b, err := NewDeletionBreaker(m, WithMaxDeletedPairs(2))
+	if err != nil {
+		t.Fatalf("NewDeletionBreaker(...): %v", err)
+	}
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	r := &recordingHandler{}
+	b.AddEventHandler(r)
+
+	steps := []struct {
+		name        string
+		fn          func()
+		want        []string
+		wantIngress float64
+		wantSecret  float64
+	}{
+		{
+			name: "DeleteIngress",
+			fn:   func() { b.OnDelete(ingress("a")) },
+			want: []string{"delete ns/a"},
+		},
+		{
+			name:        "DeleteIngressExceedingThreshold",
+			fn:          func() { b.OnDelete(ingress("x")) },
+			wantIngress: 1,
+		},
+		{
+			name:        "DeleteSecretWhileHolding",
+			fn:          func() { b.OnDelete(secret("s2")) },
+			wantIngress: 1,
+			wantSecret:  1,
+		},
+		{
+			name:        "DeleteIngressWithoutCertPairs",
+			fn:          func() { b.OnDelete(ingress("y")) },
+			want:        []string{"delete ns/y"},
+			wantIngress: 1,
+			wantSecret:  1,
+		},
+		{
+			name: "HeldIngressReappears",
+			fn:   func() { b.OnUpdate(nil, ingress("x")) },
+			want: []string{"update ns/x", "delete ns/s2"},
+		},
+		{
+			name:        "DeleteIngressExceedingThresholdAgain",
+			fn:          func() { b.OnDelete(ingress("c")) },
+			wantIngress: 1,
+		},
+		{
+			name: "Override",
+			fn: func() {
+				if got := b.Override(); got != 1 {
+					t.Errorf("b.Override(): want 1 deletion, got %v", got)
+				}
+			},
+			want: []string{"delete ns/c"},
+		},
+		{
+			name: "DeleteIngressAfterOverride",
+			fn:   func() { b.OnDelete(ingress("d")) },
+			want: []string{"delete ns/d"},
+		},
+		{
+			name: "DeleteIngressInNewWindow",
+			fn: func() {
+				now = now.Add(DefaultDeletionWindow)
+				b.OnDelete(ingress("x"))
+				now = now.Add(DefaultDeletionWindow)
+				b.OnDelete(ingress("a"))
+			},
+			want: []string{"delete ns/x", "delete ns/a"},
+		},
+	}
+
+	for _, s := range steps {
+		r.events = nil
+		s.fn()
+		if diff := deep.Equal(s.want, r.events); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+		for context, want := range map[string]float64{ContextDeleteIngress: s.wantIngress, ContextDeleteSecret: s.wantSecret} {
+			got := 0.0
+			if g, ok := held[labelKey(prometheus.Labels{LabelContext: context})]; ok {
+				got = *g
+			}
+			if got != want {
+				t.Errorf("%v: want %v held %v deletions, got %v", s.name, want, context, got)
+			}
+		}
+	}
+
+	if got, ok := errs[labelKey(prometheus.Labels{LabelContext: ContextMassDeletion})]; !ok || *got != 2 {
+		t.Errorf("want 2 mass deletion errors")
+	}
+}
+
+func TestDeletionBreakerUnappliedDeletions(t *testing.T) {
+	ingress := func(name string) *kubernetes.Ingress {
+		return &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+	}
+
+	fs := afero.NewMemMapFs()
+	pairs := map[string][]byte{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		pairs["ns_"+name+"_s.pem"] = coolPEM
+	}
+	m, err := NewManager(populate(t, fs, pairs), mapSecretStore{}, WithFilesystem(fs))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	b, err := NewDeletionBreaker(m, WithMaxDeletedFraction(0.5))
+	if err != nil {
+		t.Fatalf("NewDeletionBreaker(...): %v", err)
+	}
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+
+	// The recording handler never applies the deletions it is forwarded, as
+	// if they were queued.
+	r := &recordingHandler{}
+	b.AddEventHandler(r)
+
+	steps := []struct {
+		name string
+		fn   func()
+		want []string
+	}{
+		{
+			name: "DeleteAllIngresses",
+			fn: func() {
+				for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+					b.OnDelete(ingress(name))
+				}
+			},
+			want: []string{"delete ns/a", "delete ns/b", "delete ns/c", "delete ns/d", "delete ns/e"},
+		},
+		{
+			name: "WindowNotYetExpired",
+			fn: func() {
+				now = now.Add(DefaultDeletionWindow / 2)
+				b.expire()
+			},
+		},
+		{
+			name: "WindowExpired",
+			fn: func() {
+				now = now.Add(DefaultDeletionWindow / 2)
+				b.expire()
+			},
+			want: []string{"delete ns/f", "delete ns/g", "delete ns/h", "delete ns/i", "delete ns/j"},
+		},
+	}
+
+	for _, s := range steps {
+		r.events = nil
+		s.fn()
+		if diff := deep.Equal(s.want, r.events); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+	}
+}
+
+func TestDeletionBreakerReconcile(t *testing.T) {
+	cases := []struct {
+		name     string
+		maxPairs int
+		want     []string
+		wantHeld float64
+	}{
+		{
+			name:     "WithinThreshold",
+			maxPairs: 3,
+		},
+		{
+			name:     "ExceedingThreshold",
+			maxPairs: 2,
+			want:     []string{"ns_a_s1.pem", "ns_a_s1.pem.ocsp", "ns_b_s2.pem", "ns_c_s3.pem"},
+			wantHeld: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, map[string][]byte{
+				"ns_a_s1.pem":      coolPEM,
+				"ns_a_s1.pem.ocsp": []byte("ocsp"),
+				"ns_b_s2.pem":      coolPEM,
+				"ns_c_s3.pem":      coolPEM,
+			})
+			mx := newNopMetrics()
+			held := mapGaugeVec{}
+			mx.HeldDeletions = held
+			m, err := NewManager(dir, mapSecretStore{}, WithFilesystem(fs), WithMetrics(mx))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+			b, err := NewDeletionBreaker(m, WithMaxDeletedPairs(tc.maxPairs))
+			if err != nil {
+				t.Fatalf("NewDeletionBreaker(...): %v", err)
+			}
+			b.AddEventHandler(m)
+
+			files := func() []string {
+				fi, err := afero.ReadDir(fs, dir)
+				if err != nil {
+					t.Fatalf("cannot read TLS dir: %v", err)
+				}
+				var got []string
+				for _, f := range fi {
+					got = append(got, f.Name())
+				}
+				return got
+			}
+
+			m.Reconcile(nil)
+			if diff := deep.Equal(tc.want, files()); diff != nil {
+				t.Errorf("m.Reconcile(nil): want != got files %v", diff)
+			}
+			got := 0.0
+			if g, ok := held[labelKey(prometheus.Labels{LabelContext: ContextReconcile})]; ok {
+				got = *g
+			}
+			if got != tc.wantHeld {
+				t.Errorf("m.Reconcile(nil): want %v held stale cert pairs, got %v", tc.wantHeld, got)
+			}
+
+			b.Override()
+			if diff := deep.Equal([]string(nil), files()); diff != nil {
+				t.Errorf("b.Override(): want != got files %v", diff)
+			}
+		})
+	}
+}
+
+func TestDeletionBreakerIngressClassChanged(t *testing.T) {
+	ingress := func(name, class string) *kubernetes.Ingress {
+		return &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        name,
+			Annotations: map[string]string{annoIngressClass: class},
+		}}
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, map[string][]byte{
+		"ns_a_s1.pem": coolPEM,
+		"ns_b_s2.pem": coolPEM,
+		"ns_c_s3.pem": coolPEM,
+	})
+	m, err := NewManager(dir, mapSecretStore{}, WithFilesystem(fs), WithIngressClasses("haproxy"))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	b, err := NewDeletionBreaker(m, WithMaxDeletedPairs(1))
+	if err != nil {
+		t.Fatalf("NewDeletionBreaker(...): %v", err)
+	}
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	r := &recordingHandler{}
+	b.AddEventHandler(r)
+
+	steps := []struct {
+		name string
+		fn   func()
+		want []string
+	}{
+		{
+			name: "AddIngresses",
+			fn: func() {
+				b.OnAdd(ingress("a", "haproxy"))
+				b.OnAdd(ingress("b", "haproxy"))
+				b.OnAdd(ingress("c", "nginx"))
+			},
+			want: []string{"add ns/a", "add ns/b", "add ns/c"},
+		},
+		{
+			name: "ClassChanged",
+			fn:   func() { b.OnUpdate(nil, ingress("a", "nginx")) },
+			want: []string{"update ns/a"},
+		},
+		{
+			name: "ClassChangedExceedingThreshold",
+			fn:   func() { b.OnUpdate(nil, ingress("b", "nginx")) },
+		},
+		{
+			name: "ResyncWhileHolding",
+			fn: func() {
+				b.OnUpdate(nil, ingress("b", "nginx"))
+				b.OnUpdate(nil, ingress("c", "nginx"))
+			},
+			want: []string{"update ns/c"},
+		},
+		{
+			name: "Override",
+			fn:   func() { b.Override() },
+			want: []string{"delete ns/b"},
+		},
+	}
+
+	for _, s := range steps {
+		r.events = nil
+		s.fn()
+		if diff := deep.Equal(s.want, r.events); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+	}
+}
+
+// A blockingHandler blocks notifications until it is unblocked, as if the
+// queue between a deletion breaker and its certificate manager were full.
+type blockingHandler struct {
+	recordingHandler
+	blocked chan struct{}
+	unblock chan struct{}
+}
+
+func (h *blockingHandler) OnAdd(obj interface{}) {
+	close(h.blocked)
+	<-h.unblock
+	h.recordingHandler.OnAdd(obj)
+}
+
+func TestDeletionBreakerReconcileWhileForwarding(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	m, err := NewManager(populate(t, fs, map[string][]byte{"ns_a_s1.pem": coolPEM}), mapSecretStore{}, WithFilesystem(fs))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	b, err := NewDeletionBreaker(m, WithMaxDeletedPairs(1))
+	if err != nil {
+		t.Fatalf("NewDeletionBreaker(...): %v", err)
+	}
+	h := &blockingHandler{blocked: make(chan struct{}), unblock: make(chan struct{})}
+	b.AddEventHandler(h)
+
+	added := make(chan struct{})
+	go func() {
+		b.OnAdd(&kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "b"}})
+		close(added)
+	}()
+	<-h.blocked
+
+	reconciled := make(chan struct{})
+	go func() {
+		m.Reconcile(nil)
+		close(reconciled)
+	}()
+	select {
+	case <-reconciled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("m.Reconcile(nil) blocked while the breaker was forwarding a notification")
+	}
+
+	close(h.unblock)
+	<-added
+}
+
+func TestNewDeletionBreaker(t *testing.T) {
+	m, err := NewManager(populate(t, afero.NewMemMapFs(), nil), mapSecretStore{})
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		o       []BreakerOption
+		wantErr bool
+	}{
+		{name: "MaxDeletedFraction", o: []BreakerOption{WithMaxDeletedFraction(0.5)}},
+		{name: "MaxDeletedPairs", o: []BreakerOption{WithMaxDeletedPairs(10), WithDeletionWindow(time.Second)}},
+		{name: "NoThreshold", wantErr: true},
+		{name: "FractionTooLarge", o: []BreakerOption{WithMaxDeletedFraction(1.5)}, wantErr: true},
+		{name: "NoPairs", o: []BreakerOption{WithMaxDeletedPairs(0)}, wantErr: true},
+		{name: "NoWindow", o: []BreakerOption{WithMaxDeletedPairs(10), WithDeletionWindow(0)}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewDeletionBreaker(m, tc.o...)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewDeletionBreaker(...): want error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/x509"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+)
+
+// Key types used to suffix the halves of haproxy multi-cert bundles.
+const (
+	keyTypeRSA   = "rsa"
+	keyTypeECDSA = "ecdsa"
+)
+
+// bundleSeparator separates the names of the secrets containing each half of
+// a multi-cert bundle in the bundle's filename.
+const bundleSeparator = "+"
+
+// tlsGroups returns the names of the TLS secrets referenced by the supplied
+// ingress, grouped by the hosts they serve. Secrets are only grouped with
+// others that list exactly the same hosts.
+func tlsGroups(i *kubernetes.Ingress) [][]string {
+	groups := [][]string{}
+	index := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, tls := range i.Spec.TLS {
+		if seen[tls.SecretName] {
+			continue
+		}
+		seen[tls.SecretName] = true
+
+		hosts := sniFilters(tls.Hosts)
+		if len(hosts) == 0 {
+			groups = append(groups, []string{tls.SecretName})
+			continue
+		}
+		key := strings.Join(hosts, ",")
+		if n, ok := index[key]; ok {
+			groups[n] = append(groups[n], tls.SecretName)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []string{tls.SecretName})
+	}
+	return groups
+}
+
+// bundle returns the supplied cert pairs, which serve the same hosts, as the
+// halves of an haproxy multi-cert bundle if there are exactly two of them and
+// one has an RSA key while the other has an ECDSA key. haproxy serves the
+// ECDSA certificate to clients that support it, and the RSA certificate to
+// those that do not. Any other cert pairs are returned unchanged.
+func bundle(cds []certData) []certData {
+	if len(cds) != 2 {
+		return cds
+	}
+	a, b := keyType(cds[0]), keyType(cds[1])
+	if a == "" || b == "" || a == b {
+		return cds
+	}
+	bundled := []certData{cds[0], cds[1]}
+	bundled[0].KeyType, bundled[0].Peer = a, cds[1].SecretName
+	bundled[1].KeyType, bundled[1].Peer = b, cds[0].SecretName
+	return bundled
+}
+
+// keyType returns the multi-cert bundle key type of the supplied cert pair's
+// leaf certificate, or an empty string if it cannot be bundled.
+func keyType(c certData) string {
+	chain, err := parse(c)
+	if err != nil {
+		return ""
+	}
+	switch chain[0].PublicKeyAlgorithm {
+	case x509.RSA:
+		return keyTypeRSA
+	case x509.ECDSA:
+		return keyTypeECDSA
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestRSACertPair(notBefore, notAfter time.Time, hosts ...string) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "hal5d test"},
+		DNSNames:     hosts,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestTLSGroups(t *testing.T) {
+	cases := []struct {
+		name string
+		tls  []kubernetes.IngressTLS
+		want [][]string
+	}{
+		{
+			name: "NoHosts",
+			tls:  []kubernetes.IngressTLS{{SecretName: "a"}, {SecretName: "b"}},
+			want: [][]string{{"a"}, {"b"}},
+		},
+		{
+			name: "SameHosts",
+			tls: []kubernetes.IngressTLS{
+				{Hosts: []string{"a.example.com", "b.example.com"}, SecretName: "rsa"},
+				{Hosts: []string{"c.example.com"}, SecretName: "other"},
+				{Hosts: []string{"b.example.com", "a.example.com"}, SecretName: "ecdsa"},
+			},
+			want: [][]string{{"rsa", "ecdsa"}, {"other"}},
+		},
+		{
+			name: "DifferentHosts",
+			tls: []kubernetes.IngressTLS{
+				{Hosts: []string{"a.example.com"}, SecretName: "a"},
+				{Hosts: []string{"a.example.com", "b.example.com"}, SecretName: "b"},
+			},
+			want: [][]string{{"a"}, {"b"}},
+		},
+		{
+			name: "DuplicateSecret",
+			tls: []kubernetes.IngressTLS{
+				{Hosts: []string{"a.example.com"}, SecretName: "a"},
+				{Hosts: []string{"a.example.com"}, SecretName: "a"},
+			},
+			want: [][]string{{"a"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &kubernetes.Ingress{Spec: kubernetes.IngressSpec{TLS: tc.tls}}
+			if diff := deep.Equal(tc.want, tlsGroups(i)); diff != nil {
+				t.Errorf("tlsGroups(...): want != got %v", diff)
+			}
+		})
+	}
+}
+
+func TestBundle(t *testing.T) {
+	now := time.Now()
+	hosts := []string{"example.com"}
+	rsaCert, rsaKey := newTestRSACertPair(now.Add(-1*time.Hour), now.Add(1*time.Hour), hosts...)
+	ecdsaCert, ecdsaKey := newTestCertPair(now.Add(-1*time.Hour), now.Add(1*time.Hour), hosts...)
+	otherRSACert, otherRSAKey := newTestRSACertPair(now.Add(-1*time.Hour), now.Add(1*time.Hour), hosts...)
+	pem := func(cert, key []byte) []byte { return bytes.Join([][]byte{cert, key}, []byte("\n")) }
+	secret := func(name string, cert, key []byte) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+		}
+	}
+
+	i := &kubernetes.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress"},
+		Spec: kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{
+			{Hosts: hosts, SecretName: "rsaSecret"},
+			{Hosts: hosts, SecretName: "ecdsaSecret"},
+		}},
+	}
+	st := mapSecretStore{
+		metadata{Namespace: "ns", Name: "rsaSecret"}:   secret("rsaSecret", rsaCert, rsaKey),
+		metadata{Namespace: "ns", Name: "ecdsaSecret"}: secret("ecdsaSecret", ecdsaCert, ecdsaKey),
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	mx := newNopMetrics()
+	notAfter := mapGaugeVec{}
+	mx.NotAfter = notAfter
+	m, err := NewManager(dir, st, WithFilesystem(fs), WithMetrics(mx))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	expiry := func(secrets ...string) []string {
+		want := []string{}
+		for _, s := range secrets {
+			want = append(want, labelKey(prometheus.Labels{LabelNamespace: "ns", LabelIngressName: "coolIngress", LabelSecretName: s}))
+		}
+		sort.Strings(want)
+		return want
+	}
+
+	steps := []struct {
+		name       string
+		update     func()
+		want       map[string][]byte
+		wantExpiry []string
+	}{
+		{
+			name:   "IngressWithRSAAndECDSASecrets",
+			update: func() { m.OnAdd(i) },
+			want: map[string][]byte{
+				"ns_coolIngress_rsaSecret+ecdsaSecret.pem.rsa":   pem(rsaCert, rsaKey),
+				"ns_coolIngress_rsaSecret+ecdsaSecret.pem.ecdsa": pem(ecdsaCert, ecdsaKey),
+			},
+			wantExpiry: expiry("rsaSecret", "ecdsaSecret"),
+		},
+		{
+			name: "ECDSASecretBecomesRSA",
+			update: func() {
+				s := secret("ecdsaSecret", otherRSACert, otherRSAKey)
+				st[metadata{Namespace: "ns", Name: "ecdsaSecret"}] = s
+				m.OnUpdate(nil, s)
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_rsaSecret.pem":   pem(rsaCert, rsaKey),
+				"ns_coolIngress_ecdsaSecret.pem": pem(otherRSACert, otherRSAKey),
+			},
+			wantExpiry: expiry("rsaSecret", "ecdsaSecret"),
+		},
+		{
+			name: "ECDSASecretBecomesECDSA",
+			update: func() {
+				s := secret("ecdsaSecret", ecdsaCert, ecdsaKey)
+				st[metadata{Namespace: "ns", Name: "ecdsaSecret"}] = s
+				m.OnUpdate(nil, s)
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_rsaSecret+ecdsaSecret.pem.rsa":   pem(rsaCert, rsaKey),
+				"ns_coolIngress_rsaSecret+ecdsaSecret.pem.ecdsa": pem(ecdsaCert, ecdsaKey),
+			},
+			wantExpiry: expiry("rsaSecret", "ecdsaSecret"),
+		},
+		{
+			name: "RSASecretDeleted",
+			update: func() {
+				s := st[metadata{Namespace: "ns", Name: "rsaSecret"}]
+				delete(st, metadata{Namespace: "ns", Name: "rsaSecret"})
+				m.OnDelete(s)
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_ecdsaSecret.pem": pem(ecdsaCert, ecdsaKey),
+			},
+			wantExpiry: expiry("ecdsaSecret"),
+		},
+	}
+
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			s.update()
+			validate(t, fs, dir, s.want)
+			got := []string{}
+			for k := range notAfter {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if diff := deep.Equal(s.wantExpiry, got); diff != nil {
+				t.Errorf("want != got NotAfter series %v", diff)
+			}
+		})
+	}
+}
+
+func TestReconcileBundle(t *testing.T) {
+	now := time.Now()
+	hosts := []string{"example.com"}
+	rsaCert, rsaKey := newTestRSACertPair(now.Add(-1*time.Hour), now.Add(1*time.Hour), hosts...)
+	ecdsaCert, ecdsaKey := newTestCertPair(now.Add(-1*time.Hour), now.Add(1*time.Hour), hosts...)
+	pem := func(cert, key []byte) []byte { return bytes.Join([][]byte{cert, key}, []byte("\n")) }
+
+	i := &kubernetes.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress"},
+		Spec: kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{
+			{Hosts: hosts, SecretName: "rsaSecret"},
+			{Hosts: hosts, SecretName: "ecdsaSecret"},
+		}},
+	}
+	st := mapSecretStore{
+		metadata{Namespace: "ns", Name: "rsaSecret"}: &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "rsaSecret"},
+			Data:       map[string][]byte{v1.TLSCertKey: rsaCert, v1.TLSPrivateKeyKey: rsaKey},
+		},
+	}
+
+	// The ECDSA secret cannot be read, so its half of the bundle is kept for
+	// the manager to report, while the RSA secret is written standalone.
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, map[string][]byte{
+		"ns_coolIngress_rsaSecret+ecdsaSecret.pem.rsa":   pem(rsaCert, rsaKey),
+		"ns_coolIngress_rsaSecret+ecdsaSecret.pem.ecdsa": pem(ecdsaCert, ecdsaKey),
+	})
+	m, err := NewManager(dir, st, WithFilesystem(fs))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	m.Reconcile([]*kubernetes.Ingress{i})
+	validate(t, fs, dir, map[string][]byte{
+		"ns_coolIngress_rsaSecret.pem":                   pem(rsaCert, rsaKey),
+		"ns_coolIngress_rsaSecret+ecdsaSecret.pem.ecdsa": pem(ecdsaCert, ecdsaKey),
+	})
+}
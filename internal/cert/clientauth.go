@@ -0,0 +1,443 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Names a secret in the ingress' namespace containing the CA bundle used
+	// to verify client certificates presented to the ingress' hosts.
+	annoClientCASecret = "hal5d.planetlabs.com/client-ca-secret"
+
+	// Determines whether clients of the ingress' hosts must present a
+	// certificate. One of none, optional, or required. Defaults to required.
+	annoClientVerify = "hal5d.planetlabs.com/client-verify"
+)
+
+// Keys of a client CA secret.
+const (
+	// ClientCAKey is the key of the PEM encoded CA bundle in a client CA
+	// secret.
+	ClientCAKey = "ca.crt"
+
+	// ClientCRLKey is the key of the optional PEM encoded certificate
+	// revocation list in a client CA secret.
+	ClientCRLKey = "ca.crl"
+)
+
+// Client certificate verify modes, as understood by haproxy.
+const (
+	verifyNone     = "none"
+	verifyOptional = "optional"
+	verifyRequired = "required"
+)
+
+const (
+	clientCASuffix  = ".ca.pem"
+	clientCRLSuffix = ".crl.pem"
+
+	clientCATempFilePrefix = ".client-ca-tempfile"
+)
+
+// clientAuth describes how the hosts of an ingress verify client
+// certificates.
+type clientAuth struct {
+	// SecretName is the name of the secret containing the client CA.
+	SecretName string
+
+	// Verify is the haproxy verify mode.
+	Verify string
+
+	// CAFile and CRLFile are the paths to the client CA bundle and CRL. They
+	// are empty until they have been written.
+	CAFile  string
+	CRLFile string
+}
+
+// Options returns the haproxy bind options that enforce this client auth.
+func (a clientAuth) Options() []string {
+	o := []string{"ca-file", a.CAFile, "verify", a.Verify}
+	if a.CRLFile != "" {
+		o = append(o, "crl-file", a.CRLFile)
+	}
+	return o
+}
+
+func clientVerify(i *kubernetes.Ingress) (string, error) {
+	v, ok := i.GetAnnotations()[annoClientVerify]
+	if !ok {
+		return verifyRequired, nil
+	}
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case verifyNone, verifyOptional, verifyRequired:
+		return v, nil
+	default:
+		return verifyRequired, errors.Errorf("unknown client verify mode %q", v)
+	}
+}
+
+// clientCAFilename returns the filename of the client CA bundle contained in
+// the supplied secret for the supplied ingress.
+func clientCAFilename(md metadata, secretName string) string {
+	return strings.TrimSuffix(certPair{Namespace: md.Namespace, IngressName: md.Name, SecretName: secretName}.Filename(), certPairSuffix) + clientCASuffix
+}
+
+// clientCRLFilename returns the filename of the certificate revocation list
+// contained in the supplied secret for the supplied ingress.
+func clientCRLFilename(md metadata, secretName string) string {
+	return strings.TrimSuffix(certPair{Namespace: md.Namespace, IngressName: md.Name, SecretName: secretName}.Filename(), certPairSuffix) + clientCRLSuffix
+}
+
+// upsertClientAuth configures client certificate verification for the hosts
+// of the supplied ingress, per its annotations. It returns true if any client
+// CA bundles or CRLs changed.
+func (m *Manager) upsertClientAuth(i *kubernetes.Ingress, context string) bool {
+	if m.clientCADir == "" {
+		return false
+	}
+	log := m.log.With(
+		zap.String(LabelNamespace, i.GetNamespace()),
+		zap.String(LabelIngressName, i.GetName()))
+
+	md := metadata{Namespace: i.GetNamespace(), Name: i.GetName()}
+	secretName := i.GetAnnotations()[annoClientCASecret]
+	changed := false
+	existing, ok := m.clientAuth[md]
+	if ok && existing.SecretName != secretName {
+		changed = m.deleteClientAuth(md)
+		ok = false
+	}
+	if secretName == "" {
+		return changed
+	}
+
+	verify, err := clientVerify(i)
+	if err != nil {
+		log.Info("invalid client verify annotation - requiring client certificates", zap.Error(err))
+	}
+	a := clientAuth{SecretName: secretName, Verify: verify}
+	if ok {
+		a.CAFile, a.CRLFile = existing.CAFile, existing.CRLFile
+	}
+	m.clientAuth[md] = a
+	m.caRefs.Add(i.GetNamespace(), i.GetName(), secretName)
+
+	log = log.With(zap.String(LabelSecretName, secretName))
+	s, err := m.secretStore.Get(i.GetNamespace(), secretName)
+	if err != nil {
+		log.Info("cannot get client CA secret", zap.Error(err))
+		m.reportInvalid(certPair{Namespace: i.GetNamespace(), IngressName: i.GetName(), SecretName: secretName}, err)
+		return changed
+	}
+	return m.writeClientCA(log, md, s, context) || changed
+}
+
+// writeClientCA writes the client CA bundle and CRL contained in the supplied
+// secret for the supplied ingress, then validates them along with the crt-list
+// lines that reference them. Invalid secrets are reported, and leave any
+// previously written CA bundle and CRL in place. writeClientCA returns true if
+// the CA bundle or CRL changed.
+func (m *Manager) writeClientCA(log *zap.Logger, md metadata, s *v1.Secret, context string) bool {
+	a, ok := m.clientAuth[md]
+	if !ok || a.SecretName != s.GetName() {
+		return false
+	}
+
+	ca, crl, err := parseClientCA(s)
+	if err != nil {
+		log.Info("invalid client CA secret", zap.Error(err))
+		m.reportInvalidClientCA(md, s.GetName(), err)
+		return false
+	}
+
+	caFile := filepath.Join(m.clientCADir, clientCAFilename(md, s.GetName()))
+	crlFile := ""
+	if crl != nil {
+		crlFile = filepath.Join(m.clientCADir, clientCRLFilename(md, s.GetName()))
+	}
+
+	// The previous content of each file we write, or nil if it did not exist.
+	previous := make(map[string][]byte)
+	restore := func() {
+		for path, data := range previous {
+			if data == nil {
+				m.fs.Remove(path) // nolint:gas,gosec
+				continue
+			}
+			if err := m.writeAtomically(path, clientCATempFilePrefix, data); err != nil {
+				log.Error("cannot restore previous client CA", zap.String("filename", path), zap.Error(err))
+			}
+		}
+	}
+
+	// The CRL is written first, such that a CA bundle is never used without
+	// the CRL that accompanies it.
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{{crlFile, crl}, {caFile, ca}} {
+		if f.path == "" {
+			continue
+		}
+		existing, err := afero.ReadFile(m.fs, f.path)
+		if err == nil && bytes.Equal(existing, f.data) {
+			continue
+		}
+		if err != nil {
+			existing = nil
+		}
+		previous[f.path] = existing
+		if err := m.writeAtomically(f.path, clientCATempFilePrefix, f.data); err != nil {
+			restore()
+			log.Error("cannot write client CA", zap.String("filename", f.path), zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+			return false
+		}
+	}
+
+	// Files that are unchanged were validated when they were written. Changed
+	// files are only used by haproxy once a crt-list line references them, so
+	// they must be validated along with the crt-list.
+	written := a
+	written.CAFile, written.CRLFile = caFile, crlFile
+	m.clientAuth[md] = written
+	if len(previous) > 0 {
+		if err := m.validateListed(); err != nil {
+			m.clientAuth[md] = a
+			restore()
+			if IsInvalid(err) {
+				log.Info("invalid client CA secret", zap.Error(err))
+				m.reportInvalidClientCA(md, s.GetName(), err)
+				return false
+			}
+			log.Error("cannot list client CA", zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+			return false
+		}
+	}
+
+	changed := len(previous) > 0
+	if a.CRLFile != "" && crlFile == "" {
+		m.removeClientCAFile(a.CRLFile)
+		changed = true
+	}
+	log.Debug("wrote client CA")
+	return changed
+}
+
+// reportInvalidClientCA reports that the supplied client CA secret of the
+// supplied ingress is invalid.
+func (m *Manager) reportInvalidClientCA(md metadata, secretName string, err error) {
+	m.recorder.NewInvalidClientCA(md.Namespace, md.Name, secretName, err.Error())
+	m.metric.Invalids.With(prometheus.Labels{
+		LabelNamespace:   md.Namespace,
+		LabelIngressName: md.Name,
+		LabelSecretName:  secretName,
+	}).Inc()
+}
+
+// parseClientCA returns the PEM encoded client CA bundle and optional CRL
+// contained in the supplied secret. It returns an error that fulfils IsInvalid
+// if either cannot be parsed.
+func parseClientCA(s *v1.Secret) ([]byte, []byte, error) {
+	ca, ok := s.Data[ClientCAKey]
+	if !ok {
+		return nil, nil, ErrInvalid(errors.Errorf("secret has no %s key", ClientCAKey))
+	}
+	if _, err := parseCertificates(ca); err != nil {
+		return nil, nil, ErrInvalid(errors.Wrap(err, "cannot parse client CA bundle"))
+	}
+	crl, ok := s.Data[ClientCRLKey]
+	if !ok {
+		return ca, nil, nil
+	}
+	b, _ := pem.Decode(crl)
+	if b == nil || b.Type != "X509 CRL" {
+		return nil, nil, ErrInvalid(errors.New("cannot parse client CRL: no PEM encoded certificate revocation list"))
+	}
+	if _, err := x509.ParseRevocationList(b.Bytes); err != nil {
+		return nil, nil, ErrInvalid(errors.Wrap(err, "cannot parse client CRL"))
+	}
+	return ca, crl, nil
+}
+
+// writeValidated atomically replaces the supplied file with the supplied data,
+// then validates the resulting configuration. The file's previous content is
+// restored if the configuration is invalid, in which case an error that
+// fulfils IsInvalid is returned. writeValidated returns true if the file
+// changed.
+func (m *Manager) writeValidated(path, tempFilePrefix string, data []byte) (bool, error) {
+	existing, err := afero.ReadFile(m.fs, path)
+	exists := err == nil
+	if exists && bytes.Equal(existing, data) {
+		return false, nil
+	}
+	if err := m.writeAtomically(path, tempFilePrefix, data); err != nil {
+		return false, err
+	}
+	verr := m.v.Validate()
+	if verr == nil {
+		return true, nil
+	}
+	if exists {
+		err = m.writeAtomically(path, tempFilePrefix, existing)
+	} else {
+		err = m.fs.Remove(path)
+	}
+	if err != nil {
+		m.log.Error("cannot restore previous file", zap.String("filename", path), zap.Error(err))
+	}
+	return false, ErrInvalid(errors.Wrapf(verr, "writing %v would result in invalid configuration", filepath.Base(path)))
+}
+
+// deleteClientAuth removes the client CA bundle and CRL written for the
+// supplied ingress, and stops verifying client certificates for its hosts.
+// It returns true if any files were removed.
+func (m *Manager) deleteClientAuth(md metadata) bool {
+	a, ok := m.clientAuth[md]
+	if !ok {
+		return false
+	}
+	delete(m.clientAuth, md)
+	m.caRefs.Delete(md.Namespace, md.Name, a.SecretName)
+	changed := false
+	for _, f := range []string{a.CAFile, a.CRLFile} {
+		if f != "" && m.removeClientCAFile(f) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// upsertClientCASecret rewrites the client CA bundles and CRLs contained in
+// the supplied secret, returning true if any changed.
+func (m *Manager) upsertClientCASecret(s *v1.Secret) bool {
+	changed := false
+	for ingressName := range m.caRefs.Get(s.GetNamespace(), s.GetName()) {
+		log := m.log.With(
+			zap.String(LabelNamespace, s.GetNamespace()),
+			zap.String(LabelIngressName, ingressName),
+			zap.String(LabelSecretName, s.GetName()))
+		if m.writeClientCA(log, metadata{Namespace: s.GetNamespace(), Name: ingressName}, s, ContextUpsertSecret) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// deleteClientCASecret removes the client CA bundles and CRLs contained in
+// the supplied secret. Hosts that verify client certificates using a removed
+// CA bundle are not served until it is restored. deleteClientCASecret returns
+// true if any files were removed.
+func (m *Manager) deleteClientCASecret(s *v1.Secret) bool {
+	changed := false
+	for ingressName := range m.caRefs.Get(s.GetNamespace(), s.GetName()) {
+		md := metadata{Namespace: s.GetNamespace(), Name: ingressName}
+		a, ok := m.clientAuth[md]
+		if !ok {
+			continue
+		}
+		for _, f := range []string{a.CAFile, a.CRLFile} {
+			if f != "" && m.removeClientCAFile(f) {
+				changed = true
+			}
+		}
+		a.CAFile, a.CRLFile = "", ""
+		m.clientAuth[md] = a
+		m.log.Info("client CA secret deleted - not serving hosts until it is restored",
+			zap.String(LabelNamespace, s.GetNamespace()),
+			zap.String(LabelIngressName, ingressName),
+			zap.String(LabelSecretName, s.GetName()))
+	}
+	return changed
+}
+
+func (m *Manager) removeClientCAFile(path string) bool {
+	if err := m.fs.Remove(path); err != nil {
+		if !os.IsNotExist(err) {
+			m.log.Error("cannot remove client CA", zap.String("filename", path), zap.Error(err))
+		}
+		return false
+	}
+	return true
+}
+
+// removeUndesiredClientCAs removes all files that are not in use from the
+// client CA directory, returning true if any were removed.
+func (m *Manager) removeUndesiredClientCAs() bool {
+	if m.clientCADir == "" {
+		return false
+	}
+	fi, err := afero.ReadDir(m.fs, m.clientCADir)
+	if err != nil {
+		m.log.Error("cannot list client CAs - stale files will not be removed", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		return false
+	}
+	desired := make(map[string]bool)
+	for _, a := range m.clientAuth {
+		desired[a.CAFile] = true
+		desired[a.CRLFile] = true
+	}
+	changed := false
+	for _, f := range fi {
+		path := filepath.Join(m.clientCADir, f.Name())
+		if f.IsDir() || desired[path] {
+			continue
+		}
+		if err := m.fs.Remove(path); err != nil {
+			m.log.Error("cannot remove stale client CA", zap.String("filename", f.Name()), zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+			continue
+		}
+		m.log.Info("removed stale client CA", zap.String("filename", f.Name()))
+		changed = true
+	}
+	return changed
+}
+
+// clientAuthOptions returns the crt-list options of each ingress that verifies
+// client certificates, and whether the cert pairs of each such ingress may be
+// listed. Cert pairs of ingresses whose client CA has not been written must
+// not be listed, lest their hosts be served without verifying clients.
+func (m *Manager) clientAuthOptions() (map[metadata][]string, map[metadata]bool) {
+	options := make(map[metadata][]string)
+	withheld := make(map[metadata]bool)
+	for md, a := range m.clientAuth {
+		if a.CAFile == "" {
+			withheld[md] = true
+			continue
+		}
+		options[md] = a.Options()
+	}
+	return options, withheld
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/event"
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type invalidRecorder struct {
+	event.NopRecorder
+	events []string
+}
+
+func (r *invalidRecorder) NewInvalidSecret(namespace, ingressName, secretName, reason string) {
+	r.events = append(r.events, "InvalidSecret "+namespace+"/"+ingressName+"/"+secretName)
+}
+
+func (r *invalidRecorder) NewInvalidClientCA(namespace, ingressName, secretName, reason string) {
+	r.events = append(r.events, "InvalidClientCA "+namespace+"/"+ingressName+"/"+secretName)
+}
+
+// A caFileValidator fails validation if any client CA bundle referenced by its
+// crt-list contains rejected content. Client CA bundles that are not
+// referenced are not validated.
+type caFileValidator struct {
+	fs       afero.Fs
+	crtList  string
+	rejected []byte
+}
+
+func (v *caFileValidator) Validate() error {
+	list, err := afero.ReadFile(v.fs, v.crtList)
+	if err != nil {
+		return nil
+	}
+	fields := strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(string(list)))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "ca-file" {
+			continue
+		}
+		b, err := afero.ReadFile(v.fs, fields[i+1])
+		if err != nil {
+			return errors.Wrapf(err, "cannot read client CA %v", fields[i+1])
+		}
+		if bytes.Equal(b, v.rejected) {
+			return errors.Errorf("client CA %v is rejected", fields[i+1])
+		}
+	}
+	return nil
+}
+
+func TestClientAuth(t *testing.T) {
+	now := time.Now()
+	_, _, ca, caKey := newTestChain(now.Add(-1*time.Hour), now.Add(24*time.Hour))
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	crlDER, err := ca.CreateCRL(rand.Reader, caKey, nil, now, now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("ca.CreateCRL(...): %v", err)
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+
+	caSecret := func(data map[string][]byte) *v1.Secret {
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "caSecret"}, Data: data}
+	}
+	withVerify := func(verify string) *kubernetes.Ingress {
+		i := &kubernetes.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "ns",
+				Name:        "coolIngress",
+				Annotations: map[string]string{annoClientCASecret: "caSecret"},
+			},
+			Spec: kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{
+				{Hosts: []string{"a.example.com"}, SecretName: coolSecret.GetName()},
+			}},
+		}
+		if verify != "" {
+			i.Annotations[annoClientVerify] = verify
+		}
+		return i
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	shared := populate(t, fs, nil)
+	caDir := populate(t, fs, nil)
+	crtList := filepath.Join(shared, "crt-list")
+	crt := filepath.Join(dir, "ns_coolIngress_coolSecret.pem")
+	caFile := filepath.Join(caDir, "ns_coolIngress_caSecret.ca.pem")
+	crlFile := filepath.Join(caDir, "ns_coolIngress_caSecret.crl.pem")
+
+	store := mapSecretStore{
+		metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret,
+		metadata{Namespace: "ns", Name: "caSecret"}:                                caSecret(map[string][]byte{ClientCAKey: caPEM}),
+	}
+	r := &invalidRecorder{}
+	sub := &testSubscriber{}
+	m, err := NewManager(dir, store,
+		WithFilesystem(fs),
+		WithEventRecorder(r),
+		WithSubscriber(sub),
+		WithCrtListFile(crtList),
+		WithClientCADir(caDir))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	steps := []struct {
+		name         string
+		fn           func()
+		want         string
+		wantFiles    []string
+		wantEvents   []string
+		wantNotified int
+	}{
+		{
+			name:         "AddIngress",
+			fn:           func() { m.OnAdd(withVerify("")) },
+			want:         crt + " [ca-file " + caFile + " verify required] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem"},
+			wantNotified: 1,
+		},
+		{
+			name:         "VerifyOptional",
+			fn:           func() { m.OnUpdate(nil, withVerify("optional")) },
+			want:         crt + " [ca-file " + caFile + " verify optional] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem"},
+			wantNotified: 2,
+		},
+		{
+			name:         "InvalidVerifyRequiresCertificates",
+			fn:           func() { m.OnUpdate(nil, withVerify("sometimes")) },
+			want:         crt + " [ca-file " + caFile + " verify required] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem"},
+			wantNotified: 3,
+		},
+		{
+			name:         "AddCRL",
+			fn:           func() { m.OnUpdate(nil, caSecret(map[string][]byte{ClientCAKey: caPEM, ClientCRLKey: crlPEM})) },
+			want:         crt + " [ca-file " + caFile + " verify required crl-file " + crlFile + "] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem", "ns_coolIngress_caSecret.crl.pem"},
+			wantNotified: 4,
+		},
+		{
+			name:         "InvalidCA",
+			fn:           func() { m.OnUpdate(nil, caSecret(map[string][]byte{ClientCAKey: []byte("cool")})) },
+			want:         crt + " [ca-file " + caFile + " verify required crl-file " + crlFile + "] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem", "ns_coolIngress_caSecret.crl.pem"},
+			wantEvents:   []string{"InvalidClientCA ns/coolIngress/caSecret"},
+			wantNotified: 4,
+		},
+		{
+			name:         "RemoveCRL",
+			fn:           func() { m.OnUpdate(nil, caSecret(map[string][]byte{ClientCAKey: caPEM})) },
+			want:         crt + " [ca-file " + caFile + " verify required] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem"},
+			wantNotified: 5,
+		},
+		{
+			name:         "DeleteCASecret",
+			fn:           func() { m.OnDelete(caSecret(nil)) },
+			want:         "",
+			wantNotified: 6,
+		},
+		{
+			name:         "RestoreCASecret",
+			fn:           func() { m.OnAdd(caSecret(map[string][]byte{ClientCAKey: caPEM})) },
+			want:         crt + " [ca-file " + caFile + " verify required] a.example.com",
+			wantFiles:    []string{"ns_coolIngress_caSecret.ca.pem"},
+			wantNotified: 7,
+		},
+		{
+			name:         "DeleteIngress",
+			fn:           func() { m.OnDelete(withVerify("")) },
+			want:         "",
+			wantNotified: 8,
+		},
+	}
+
+	for _, s := range steps {
+		r.events = nil
+		s.fn()
+		got, err := afero.ReadFile(fs, crtList)
+		if err != nil {
+			t.Fatalf("%v: cannot read crt-list: %v", s.name, err)
+		}
+		if string(got) != s.want {
+			t.Errorf("%v: want crt-list %q, got %q", s.name, s.want, got)
+		}
+		fi, err := afero.ReadDir(fs, caDir)
+		if err != nil {
+			t.Fatalf("%v: cannot list client CA dir: %v", s.name, err)
+		}
+		var files []string
+		for _, f := range fi {
+			files = append(files, f.Name())
+		}
+		if diff := deep.Equal(s.wantFiles, files); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+		if diff := deep.Equal(s.wantEvents, r.events); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+		if sub.notified != s.wantNotified {
+			t.Errorf("%v: want %v notifications, got %v", s.name, s.wantNotified, sub.notified)
+		}
+	}
+}
+
+func TestClientCADirRequiresCrtList(t *testing.T) {
+	if _, err := NewManager("/tls", mapSecretStore{}, WithClientCADir("/ca")); err == nil {
+		t.Errorf("NewManager(...): want error for client CA dir without crt-list file, got nil")
+	}
+	if _, err := NewManager("/tls", mapSecretStore{}, WithCrtListFile("/shared/crt-list"), WithClientCADir("/tls")); err == nil {
+		t.Errorf("NewManager(...): want error for client CA dir in TLS dir, got nil")
+	}
+}
+
+func TestClientAuthRejectedCA(t *testing.T) {
+	now := time.Now()
+	_, _, ca, _ := newTestChain(now.Add(-1*time.Hour), now.Add(24*time.Hour))
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	_, _, rejected, _ := newTestChain(now.Add(-1*time.Hour), now.Add(24*time.Hour))
+	rejectedPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rejected.Raw})
+
+	caSecret := func(ca []byte) *v1.Secret {
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "caSecret"}, Data: map[string][]byte{ClientCAKey: ca}}
+	}
+	i := &kubernetes.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        "coolIngress",
+			Annotations: map[string]string{annoClientCASecret: "caSecret"},
+		},
+		Spec: kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{
+			{Hosts: []string{"a.example.com"}, SecretName: coolSecret.GetName()},
+		}},
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	shared := populate(t, fs, nil)
+	caDir := populate(t, fs, nil)
+	crtList := filepath.Join(shared, "crt-list")
+	crt := filepath.Join(dir, "ns_coolIngress_coolSecret.pem")
+	caFile := filepath.Join(caDir, "ns_coolIngress_caSecret.ca.pem")
+
+	store := mapSecretStore{
+		metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret,
+		metadata{Namespace: "ns", Name: "caSecret"}:                                caSecret(rejectedPEM),
+	}
+	r := &invalidRecorder{}
+	m, err := NewManager(dir, store,
+		WithFilesystem(fs),
+		WithEventRecorder(r),
+		WithValidator(&caFileValidator{fs: fs, crtList: crtList, rejected: rejectedPEM}),
+		WithCrtListFile(crtList),
+		WithClientCADir(caDir))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	steps := []struct {
+		name       string
+		fn         func()
+		want       string
+		wantCA     []byte
+		wantEvents []string
+	}{
+		{
+			// The rejected CA bundle is not yet referenced by any crt-list
+			// line when it is written, so the ingress' hosts are withheld.
+			name:       "AddIngressWithRejectedCA",
+			fn:         func() { m.OnAdd(i) },
+			want:       "",
+			wantEvents: []string{"InvalidClientCA ns/coolIngress/caSecret"},
+		},
+		{
+			name:   "AcceptedCA",
+			fn:     func() { m.OnUpdate(nil, caSecret(caPEM)) },
+			want:   crt + " [ca-file " + caFile + " verify required] a.example.com",
+			wantCA: caPEM,
+		},
+		{
+			name:       "RejectedCAKeepsPrevious",
+			fn:         func() { m.OnUpdate(nil, caSecret(rejectedPEM)) },
+			want:       crt + " [ca-file " + caFile + " verify required] a.example.com",
+			wantCA:     caPEM,
+			wantEvents: []string{"InvalidClientCA ns/coolIngress/caSecret"},
+		},
+	}
+
+	for _, s := range steps {
+		r.events = nil
+		s.fn()
+		got, _ := afero.ReadFile(fs, crtList) // nolint:gas,gosec
+		if string(got) != s.want {
+			t.Errorf("%v: want crt-list %q, got %q", s.name, s.want, got)
+		}
+		gotCA, _ := afero.ReadFile(fs, caFile) // nolint:gas,gosec
+		if !bytes.Equal(gotCA, s.wantCA) {
+			t.Errorf("%v: want client CA %q, got %q", s.name, s.wantCA, gotCA)
+		}
+		if diff := deep.Equal(s.wantEvents, r.events); diff != nil {
+			t.Errorf("%v: want != got %v", s.name, diff)
+		}
+	}
+}
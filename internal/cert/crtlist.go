@@ -0,0 +1,311 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+const (
+	crtListTempFilePrefix  = "crt-list-tempfile"
+	certPairTempFilePrefix = ".certpair-tempfile"
+)
+
+// A crtListTable tracks the cert pairs on disk, and the SNI filters with which
+// haproxy should select each of them.
+type crtListTable map[certPair][]string
+
+// Bytes returns an haproxy crt-list listing every cert pair in the supplied
+// TLS directory. Both halves of a multi-cert bundle are listed as one, by
+// their shared name. Cert pairs are sorted by filename, and their SNI filters
+// sorted and deduplicated, such that the encoding is deterministic. Cert
+// pairs without SNI filters are selected by their certificate's names. Cert
+// pairs belonging to an ingress with options are listed with those bind
+// options.
+func (t crtListTable) Bytes(tlsDir string, options map[metadata][]string) []byte {
+	lines := t.lines(tlsDir, options)
+	filenames := make([]string, 0, len(lines))
+	for f := range lines {
+		filenames = append(filenames, f)
+	}
+	sort.Strings(filenames)
+
+	sorted := make([]string, 0, len(filenames))
+	for _, f := range filenames {
+		sorted = append(sorted, lines[f])
+	}
+	return []byte(strings.Join(sorted, "\n"))
+}
+
+// lines returns the crt-list line of each listed cert pair, keyed by the name
+// by which haproxy refers to it.
+func (t crtListTable) lines(tlsDir string, options map[metadata][]string) map[string]string {
+	hosts := make(map[string][]string)
+	opts := make(map[string][]string)
+	for cp, h := range t {
+		hosts[cp.bundleFilename()] = append(hosts[cp.bundleFilename()], h...)
+		if o := options[metadata{Namespace: cp.Namespace, Name: cp.IngressName}]; len(o) > 0 {
+			opts[cp.bundleFilename()] = o
+		}
+	}
+	lines := make(map[string]string, len(hosts))
+	for f, h := range hosts {
+		line := []string{filepath.Join(tlsDir, f)}
+		if o := opts[f]; len(o) > 0 {
+			line = append(line, "["+strings.Join(o, " ")+"]")
+		}
+		lines[f] = strings.Join(append(line, sniFilters(h)...), " ")
+	}
+	return lines
+}
+
+func sniFilters(hosts []string) []string {
+	seen := make(map[string]bool)
+	filters := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		filters = append(filters, h)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// listed returns the cert pairs that should be listed in the crt-list, with
+// the supplied additional cert pairs, and the bind options of each ingress.
+// Cert pairs of ingresses whose client CA is withheld are not listed.
+func (m *Manager) listed(extra ...certPair) (crtListTable, map[metadata][]string) {
+	options, withheld := m.clientAuthOptions()
+	listed := make(crtListTable, len(m.crtList)+len(extra))
+	for cp, hosts := range m.crtList {
+		if withheld[metadata{Namespace: cp.Namespace, Name: cp.IngressName}] {
+			continue
+		}
+		listed[cp] = hosts
+	}
+	for _, cp := range extra {
+		if withheld[metadata{Namespace: cp.Namespace, Name: cp.IngressName}] {
+			continue
+		}
+		listed[cp] = m.sniHosts[cp.unbundled()]
+	}
+	return listed, options
+}
+
+// syncCrtList rewrites the crt-list file if it does not reflect the crt-list
+// table, then validates the new configuration. The previous crt-list is
+// restored if the new configuration is invalid. Cert pairs whose lines changed
+// are then reported as invalid and listed as they were before, while cert
+// pairs that were not listed before are removed, such that they cannot prevent
+// the crt-list from reflecting later changes. syncCrtList returns true if the
+// crt-list file changed.
+func (m *Manager) syncCrtList(context string) bool {
+	if m.crtListFile == "" {
+		return false
+	}
+	log := m.log.With(zap.String("crtListFile", m.crtListFile))
+
+	listed, options := m.listed()
+	proposed := listed.Bytes(m.tlsDir, options)
+	existing, err := afero.ReadFile(m.fs, m.crtListFile)
+	if err == nil && bytes.Equal(existing, proposed) {
+		return false
+	}
+	if err := m.writeAtomically(m.crtListFile, crtListTempFilePrefix, proposed); err != nil {
+		log.Error("cannot write crt-list", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+		return false
+	}
+	err = m.v.Validate()
+	if err == nil {
+		log.Debug("wrote crt-list")
+		return true
+	}
+
+	log.Error("crt-list would result in invalid configuration - restoring previous crt-list", zap.Error(err))
+	m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+	if err := m.writeAtomically(m.crtListFile, crtListTempFilePrefix, existing); err != nil {
+		log.Error("cannot restore previous crt-list", zap.Error(err))
+		return false
+	}
+
+	previous := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		previous[line] = true
+	}
+	hosts := listedHosts(existing)
+	lines := listed.lines(m.tlsDir, options)
+	invalid := ErrInvalid(errors.Wrap(err, "listing certificate pair would result in invalid configuration"))
+	dropped := false
+	for cp := range listed {
+		if previous[lines[cp.bundleFilename()]] {
+			continue
+		}
+		if h, ok := hosts[filepath.Join(m.tlsDir, cp.bundleFilename())]; ok {
+			m.crtList[cp] = h
+			m.reportInvalid(cp, invalid)
+			log.Info("restored previous crt-list line of cert pair",
+				zap.String(LabelNamespace, cp.Namespace),
+				zap.String(LabelIngressName, cp.IngressName),
+				zap.String(LabelSecretName, cp.SecretName))
+			continue
+		}
+		m.dropListed(cp, invalid, context)
+		dropped = true
+	}
+
+	// Each attempt removes at least one cert pair, so this terminates.
+	if !dropped {
+		return false
+	}
+	return m.syncCrtList(context)
+}
+
+// listedHosts returns the SNI filters of each cert pair listed in the supplied
+// crt-list, keyed by path.
+func listedHosts(crtList []byte) map[string][]string {
+	hosts := make(map[string][]string)
+	for _, line := range strings.Split(string(crtList), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		filters := fields[1:]
+		if len(filters) > 0 && strings.HasPrefix(filters[0], "[") {
+			for n, f := range filters {
+				if strings.HasSuffix(f, "]") {
+					filters = filters[n+1:]
+					break
+				}
+			}
+		}
+		hosts[fields[0]] = filters
+	}
+	return hosts
+}
+
+// dropListed removes and forgets the supplied cert pair, which could not be
+// listed in the crt-list, and reports it as invalid.
+func (m *Manager) dropListed(cp certPair, err error, context string) {
+	log := m.log.With(
+		zap.String(LabelNamespace, cp.Namespace),
+		zap.String(LabelIngressName, cp.IngressName),
+		zap.String(LabelSecretName, cp.SecretName))
+	if err := m.fs.Remove(filepath.Join(m.tlsDir, cp.Filename())); err != nil && !os.IsNotExist(err) {
+		log.Error("cannot remove cert pair that could not be listed", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+	}
+	m.forget(cp)
+	m.reportInvalid(cp, err)
+	log.Info("removed cert pair that could not be listed", zap.Error(err))
+}
+
+// commitListed moves the supplied staged cert pairs into place and lists them
+// in the crt-list, then validates the resulting configuration. haproxy only
+// loads the cert pairs its crt-list refers to, so cert pairs cannot be
+// validated until they are listed. The previous cert pairs and crt-list are
+// restored if the configuration is invalid, in which case the returned error
+// satisfies IsInvalid. Staged cert pairs are never left behind.
+func (m *Manager) commitListed(staged []stagedCertPair) error {
+	previous := make(map[string][]byte)
+	restore := func() {
+		for _, sp := range staged {
+			m.fs.Remove(sp.path) // nolint:gas,gosec
+		}
+		for path, data := range previous {
+			if data == nil {
+				m.fs.Remove(path) // nolint:gas,gosec
+				continue
+			}
+			if err := m.writeAtomically(path, certPairTempFilePrefix, data); err != nil {
+				m.log.Error("cannot restore previous cert pair", zap.String("filename", path), zap.Error(err))
+			}
+		}
+	}
+
+	cps := make([]certPair, 0, len(staged))
+	for _, sp := range staged {
+		path := filepath.Join(m.tlsDir, sp.Filename())
+		data, err := afero.ReadFile(m.fs, path)
+		if err != nil {
+			data = nil
+		}
+		previous[path] = data
+		if err := m.fs.Rename(sp.path, path); err != nil {
+			restore()
+			return errors.Wrapf(err, "cannot move %v to %v", sp.path, path)
+		}
+		cps = append(cps, sp.certPair)
+	}
+
+	if err := m.validateListed(cps...); err != nil {
+		restore()
+		return errors.Wrap(err, "cannot list certificate pair")
+	}
+	return nil
+}
+
+// validateListed writes a crt-list that lists the supplied cert pairs in
+// addition to those already listed, then validates the resulting
+// configuration. The previous crt-list is restored if the configuration is
+// invalid, in which case an error that fulfils IsInvalid is returned.
+func (m *Manager) validateListed(extra ...certPair) error {
+	existing, _ := afero.ReadFile(m.fs, m.crtListFile) // nolint:gas,gosec
+	listed, options := m.listed(extra...)
+	if err := m.writeAtomically(m.crtListFile, crtListTempFilePrefix, listed.Bytes(m.tlsDir, options)); err != nil {
+		return errors.Wrap(err, "cannot write crt-list")
+	}
+	if err := m.v.Validate(); err != nil {
+		if err := m.writeAtomically(m.crtListFile, crtListTempFilePrefix, existing); err != nil {
+			m.log.Error("cannot restore previous crt-list", zap.String("crtListFile", m.crtListFile), zap.Error(err))
+		}
+		return ErrInvalid(errors.Wrap(err, "crt-list would result in invalid configuration"))
+	}
+	return nil
+}
+
+// writeAtomically writes the supplied data to a temporary file in the same
+// directory as the supplied path, then moves it into place.
+func (m *Manager) writeAtomically(path, tempFilePrefix string, data []byte) error {
+	f, err := afero.TempFile(m.fs, filepath.Dir(path), tempFilePrefix)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create temp file in %v", filepath.Dir(path))
+	}
+	defer f.Close()
+	defer m.fs.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrapf(err, "cannot write %v", f.Name())
+	}
+
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "cannot fsync %v", f.Name())
+	}
+
+	return errors.Wrapf(m.fs.Rename(f.Name(), path), "cannot move %v to %v", f.Name(), path)
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCrtListTableBytes(t *testing.T) {
+	cases := []struct {
+		name    string
+		t       crtListTable
+		options map[metadata][]string
+		want    string
+	}{
+		{
+			name: "Empty",
+			t:    crtListTable{},
+			want: "",
+		},
+		{
+			name: "SortedByFilename",
+			t: crtListTable{
+				certPair{Namespace: "b", IngressName: "i", SecretName: "s"}: []string{"b.example.com"},
+				certPair{Namespace: "a", IngressName: "i", SecretName: "s"}: []string{"a.example.com"},
+			},
+			want: "/tls/a_i_s.pem a.example.com\n/tls/b_i_s.pem b.example.com",
+		},
+		{
+			name: "FiltersSortedAndDeduplicated",
+			t: crtListTable{
+				certPair{Namespace: "ns", IngressName: "i", SecretName: "s"}: []string{"z.example.com", "*.example.com", "z.example.com", ""},
+			},
+			want: "/tls/ns_i_s.pem *.example.com z.example.com",
+		},
+		{
+			name: "NoFilters",
+			t: crtListTable{
+				certPair{Namespace: "ns", IngressName: "i", SecretName: "s"}: nil,
+			},
+			want: "/tls/ns_i_s.pem",
+		},
+		{
+			name: "Bundle",
+			t: crtListTable{
+				certPair{Namespace: "ns", IngressName: "i", SecretName: "r", KeyType: "rsa", Peer: "e"}:   []string{"example.com"},
+				certPair{Namespace: "ns", IngressName: "i", SecretName: "e", KeyType: "ecdsa", Peer: "r"}: []string{"example.com"},
+			},
+			want: "/tls/ns_i_r+e.pem example.com",
+		},
+		{
+			name: "Options",
+			t: crtListTable{
+				certPair{Namespace: "ns", IngressName: "i", SecretName: "s"}: []string{"example.com"},
+				certPair{Namespace: "ns", IngressName: "j", SecretName: "s"}: []string{"example.org"},
+			},
+			options: map[metadata][]string{
+				metadata{Namespace: "ns", Name: "i"}: clientAuth{CAFile: "/ca/ns_i_ca.ca.pem", Verify: "required"}.Options(),
+			},
+			want: "/tls/ns_i_s.pem [ca-file /ca/ns_i_ca.ca.pem verify required] example.com\n/tls/ns_j_s.pem example.org",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(tc.t.Bytes("/tls", tc.options)); got != tc.want {
+				t.Errorf("t.Bytes(): want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCrtList(t *testing.T) {
+	withHosts := func(hosts ...string) *kubernetes.Ingress {
+		return &kubernetes.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress"},
+			Spec: kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{
+				{Hosts: hosts, SecretName: coolSecret.GetName()},
+			}},
+		}
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	shared := populate(t, fs, nil)
+	crtList := filepath.Join(shared, "crt-list")
+	pem := filepath.Join(dir, "ns_coolIngress_coolSecret.pem")
+
+	v := &contentValidator{fs: fs, dir: shared, invalid: []byte("invalid.example.com")}
+	sub := &testSubscriber{}
+	m, err := NewManager(dir,
+		mapSecretStore{metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret},
+		WithFilesystem(fs),
+		WithValidator(v),
+		WithSubscriber(sub),
+		WithCrtListFile(crtList))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	steps := []struct {
+		name         string
+		fn           func()
+		want         string
+		wantNotified int
+	}{
+		{
+			name:         "AddIngress",
+			fn:           func() { m.OnAdd(withHosts("b.example.com", "a.example.com")) },
+			want:         pem + " a.example.com b.example.com",
+			wantNotified: 1,
+		},
+		{
+			name:         "IngressUnchanged",
+			fn:           func() { m.OnUpdate(nil, withHosts("b.example.com", "a.example.com")) },
+			want:         pem + " a.example.com b.example.com",
+			wantNotified: 1,
+		},
+		{
+			name:         "HostsChanged",
+			fn:           func() { m.OnUpdate(nil, withHosts("c.example.com")) },
+			want:         pem + " c.example.com",
+			wantNotified: 2,
+		},
+		{
+			name:         "InvalidHostsRestored",
+			fn:           func() { m.OnUpdate(nil, withHosts("invalid.example.com")) },
+			want:         pem + " c.example.com",
+			wantNotified: 2,
+		},
+		{
+			name:         "DeleteIngress",
+			fn:           func() { m.OnDelete(withHosts("c.example.com")) },
+			want:         "",
+			wantNotified: 3,
+		},
+	}
+
+	for _, s := range steps {
+		s.fn()
+		got, err := afero.ReadFile(fs, crtList)
+		if err != nil {
+			t.Fatalf("%v: cannot read crt-list: %v", s.name, err)
+		}
+		if string(got) != s.want {
+			t.Errorf("%v: want crt-list %q, got %q", s.name, s.want, got)
+		}
+		if sub.notified != s.wantNotified {
+			t.Errorf("%v: want %v notifications, got %v", s.name, s.wantNotified, sub.notified)
+		}
+	}
+}
+
+// A listedValidator fails validation if any cert pair listed in its crt-list
+// contains invalid content. Cert pairs that are not listed are not validated.
+type listedValidator struct {
+	fs      afero.Fs
+	crtList string
+	invalid []byte
+}
+
+func (v *listedValidator) Validate() error {
+	list, err := afero.ReadFile(v.fs, v.crtList)
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(list), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		b, err := afero.ReadFile(v.fs, fields[0])
+		if err != nil {
+			return errors.Wrapf(err, "cannot read listed cert pair %v", fields[0])
+		}
+		if bytes.Contains(b, v.invalid) {
+			return errors.Errorf("listed cert pair %v is invalid", fields[0])
+		}
+	}
+	return nil
+}
+
+func TestCrtListInvalidCertPair(t *testing.T) {
+	newSecret := func(name string, invalid bool) *v1.Secret {
+		// The validator rejects the invalid cert pair, which is nonetheless
+		// well formed.
+		cert, key := newTestCertPair(time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+		if invalid {
+			cert = append(cert, []byte("invalid")...)
+		}
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+		}
+	}
+	withHosts := func(name, secretName string, hosts ...string) *kubernetes.Ingress {
+		return &kubernetes.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec: kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{
+				{Hosts: hosts, SecretName: secretName},
+			}},
+		}
+	}
+	secrets := mapSecretStore{
+		metadata{Namespace: "ns", Name: "good"}: newSecret("good", false),
+		metadata{Namespace: "ns", Name: "bad"}:  newSecret("bad", true),
+	}
+
+	cases := []struct {
+		name string
+		fn   func(m *Manager)
+	}{
+		{
+			name: "Upsert",
+			fn: func(m *Manager) {
+				m.OnAdd(withHosts("goodIngress", "good", "a.example.com"))
+				m.OnAdd(withHosts("badIngress", "bad", "b.example.com"))
+			},
+		},
+		{
+			name: "Reconcile",
+			fn: func(m *Manager) {
+				m.Reconcile([]*kubernetes.Ingress{
+					withHosts("goodIngress", "good", "a.example.com"),
+					withHosts("badIngress", "bad", "b.example.com"),
+				})
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, nil)
+			shared := populate(t, fs, nil)
+			crtList := filepath.Join(shared, "crt-list")
+			good := filepath.Join(dir, "ns_goodIngress_good.pem")
+
+			m, err := NewManager(dir, secrets,
+				WithFilesystem(fs),
+				WithValidator(&listedValidator{fs: fs, crtList: crtList, invalid: []byte("invalid")}),
+				WithCrtListFile(crtList))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			tc.fn(m)
+			if got, want := readFile(t, fs, crtList), good+" a.example.com"; got != want {
+				t.Errorf("want crt-list %q, got %q", want, got)
+			}
+			if ok, _ := afero.Exists(fs, filepath.Join(dir, "ns_badIngress_bad.pem")); ok {
+				t.Errorf("want invalid cert pair to be removed")
+			}
+
+			// The invalid cert pair must not prevent other updates.
+			m.OnUpdate(nil, withHosts("goodIngress", "good", "c.example.com"))
+			if got, want := readFile(t, fs, crtList), good+" c.example.com"; got != want {
+				t.Errorf("want crt-list %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func readFile(t *testing.T, fs afero.Fs, path string) string {
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		t.Fatalf("cannot read %v: %v", path, err)
+	}
+	return string(b)
+}
+
+func TestCrtListFileInTLSDir(t *testing.T) {
+	if _, err := NewManager("/tls", mapSecretStore{}, WithCrtListFile("/tls/crt-list")); err == nil {
+		t.Errorf("NewManager(...): want error for crt-list file in TLS dir, got nil")
+	}
+}
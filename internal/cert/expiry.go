@@ -0,0 +1,211 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// Defaults used by new expiry checkers.
+const (
+	DefaultExpiryCheckInterval = 1 * time.Hour
+)
+
+// DefaultExpiryThresholds are the remaining validity periods at which an
+// expiry checker warns that a certificate will soon expire by default.
+var DefaultExpiryThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour}
+
+// A crossing records the most severe expiry threshold a certificate has
+// crossed. Crossings are reset when a certificate's expiry time changes,
+// typically because it was renewed.
+type crossing struct {
+	notAfter time.Time
+
+	// level is the number of thresholds crossed. It is one greater than the
+	// number of thresholds once the certificate has expired.
+	level int
+}
+
+// An ExpiryChecker periodically checks the cert pairs managed by a certificate
+// manager for certificates that have expired or will soon expire, and records
+// an event each time a certificate crosses an expiry threshold.
+type ExpiryChecker struct {
+	m          *Manager
+	interval   time.Duration
+	thresholds []time.Duration
+	crossed    map[certPair]crossing
+}
+
+// NewExpiryChecker creates a new expiry checker for the cert pairs managed by
+// the supplied certificate manager. The checker records that a certificate is
+// expiring soon each time its remaining validity period drops below one of the
+// supplied thresholds, and that it has expired once it has done so.
+func NewExpiryChecker(m *Manager, interval time.Duration, thresholds ...time.Duration) (*ExpiryChecker, error) {
+	if interval <= 0 {
+		return nil, errors.Errorf("expiry check interval %v must be positive", interval)
+	}
+	t := make([]time.Duration, 0, len(thresholds))
+	for _, d := range thresholds {
+		if d <= 0 {
+			return nil, errors.Errorf("expiry threshold %v must be positive", d)
+		}
+		t = append(t, d)
+	}
+	// Thresholds are crossed in descending order.
+	sort.Slice(t, func(i, j int) bool { return t[i] > t[j] })
+	return &ExpiryChecker{m: m, interval: interval, thresholds: t, crossed: make(map[certPair]crossing)}, nil
+}
+
+// Run checks for expiring certificates every interval until the provided stop
+// channel is closed.
+func (c *ExpiryChecker) Run(stop <-chan struct{}) {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		c.Check()
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check the cert pairs currently on disk for expiring certificates.
+func (c *ExpiryChecker) Check() {
+	fi, err := afero.ReadDir(c.m.fs, c.m.tlsDir)
+	if err != nil {
+		c.m.log.Error("cannot list TLS cert pairs - not checking for expiring certificates", zap.Error(err))
+		c.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextCheckExpiry}).Inc()
+		return
+	}
+
+	now := c.m.now()
+	seen := make(map[certPair]bool)
+	for _, f := range fi {
+		cp, err := newCertPair(f.Name())
+		if err != nil {
+			continue
+		}
+		seen[cp] = true
+		log := c.m.log.With(
+			zap.String(LabelNamespace, cp.Namespace),
+			zap.String(LabelIngressName, cp.IngressName),
+			zap.String(LabelSecretName, cp.SecretName))
+
+		b, err := afero.ReadFile(c.m.fs, filepath.Join(c.m.tlsDir, f.Name()))
+		if err != nil {
+			log.Error("cannot read cert pair", zap.Error(err))
+			c.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextCheckExpiry}).Inc()
+			continue
+		}
+		leaf, err := parseLeaf(b)
+		if err != nil {
+			log.Debug("cannot parse cert pair - not checking for expiry", zap.Error(err))
+			continue
+		}
+
+		x := c.crossed[cp]
+		if !x.notAfter.Equal(leaf.NotAfter) {
+			x = crossing{notAfter: leaf.NotAfter}
+		}
+		if level := c.level(leaf.NotAfter.Sub(now)); level > x.level {
+			c.record(log, cp, leaf.NotAfter, level)
+			x.level = level
+		}
+		c.crossed[cp] = x
+	}
+
+	for cp := range c.crossed {
+		if !seen[cp] {
+			delete(c.crossed, cp)
+		}
+	}
+}
+
+// level returns the number of thresholds crossed by a certificate with the
+// supplied remaining validity period.
+func (c *ExpiryChecker) level(remaining time.Duration) int {
+	if remaining <= 0 {
+		return len(c.thresholds) + 1
+	}
+	level := 0
+	for _, t := range c.thresholds {
+		if remaining <= t {
+			level++
+		}
+	}
+	return level
+}
+
+func (c *ExpiryChecker) record(log *zap.Logger, cp certPair, notAfter time.Time, level int) {
+	if level > len(c.thresholds) {
+		log.Info("certificate expired", zap.Time("notAfter", notAfter))
+		c.m.recorder.NewExpired(cp.Namespace, cp.IngressName, cp.SecretName, notAfter)
+		return
+	}
+	log.Info("certificate expiring soon", zap.Time("notAfter", notAfter), zap.Duration("threshold", c.thresholds[level-1]))
+	c.m.recorder.NewExpiringSoon(cp.Namespace, cp.IngressName, cp.SecretName, notAfter)
+}
+
+// parseLeaf parses the first certificate in the supplied PEM encoded data.
+func parseLeaf(b []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("no PEM encoded certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// parseCertificates parses all certificates in the supplied PEM encoded data,
+// in the order they appear.
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse certificate %d of chain", len(chain))
+		}
+		chain = append(chain, crt)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return chain, nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/event"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+)
+
+type expiryRecorder struct {
+	event.NopRecorder
+	events []string
+}
+
+func (r *expiryRecorder) NewExpiringSoon(namespace, ingressName, secretName string, notAfter time.Time) {
+	r.events = append(r.events, "ExpiringSoon "+namespace+"/"+ingressName+"/"+secretName)
+}
+
+func (r *expiryRecorder) NewExpired(namespace, ingressName, secretName string, notAfter time.Time) {
+	r.events = append(r.events, "Expired "+namespace+"/"+ingressName+"/"+secretName)
+}
+
+func TestExpiryChecker(t *testing.T) {
+	start := time.Now()
+	cert, key := newTestCertPair(start.Add(-1*time.Hour), start.Add(10*24*time.Hour))
+	renewedCert, renewedKey := newTestCertPair(start.Add(-1*time.Hour), start.Add(90*24*time.Hour))
+	pem := func(cert, key []byte) []byte { return bytes.Join([][]byte{cert, key}, []byte("\n")) }
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, map[string][]byte{
+		"ns_coolIngress_coolSecret.pem": pem(cert, key),
+		"dankCert.pem":                  []byte("sodank"),
+	})
+
+	r := &expiryRecorder{}
+	m, err := NewManager(dir, mapSecretStore{}, WithFilesystem(fs), WithEventRecorder(r))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	c, err := NewExpiryChecker(m, DefaultExpiryCheckInterval, 7*24*time.Hour, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewExpiryChecker(...): %v", err)
+	}
+
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		renew   bool
+		want    []string
+	}{
+		// The certificate has already crossed the 30 day threshold.
+		{name: "ThirtyDays", elapsed: 0, want: []string{"ExpiringSoon ns/coolIngress/coolSecret"}},
+		{name: "ThirtyDaysAgain", elapsed: 1 * time.Hour},
+		{name: "SevenDays", elapsed: 4 * 24 * time.Hour, want: []string{"ExpiringSoon ns/coolIngress/coolSecret"}},
+		{name: "SevenDaysAgain", elapsed: 5 * 24 * time.Hour},
+		{name: "Expired", elapsed: 11 * 24 * time.Hour, want: []string{"Expired ns/coolIngress/coolSecret"}},
+		{name: "ExpiredAgain", elapsed: 12 * 24 * time.Hour},
+		{name: "Renewed", elapsed: 12 * 24 * time.Hour, renew: true},
+		{name: "RenewedCertExpiringSoon", elapsed: 70 * 24 * time.Hour, want: []string{"ExpiringSoon ns/coolIngress/coolSecret"}},
+	}
+
+	for _, s := range steps {
+		if s.renew {
+			if err := afero.WriteFile(fs, filepath.Join(dir, "ns_coolIngress_coolSecret.pem"), pem(renewedCert, renewedKey), certPairMode); err != nil {
+				t.Fatalf("cannot renew cert pair: %v", err)
+			}
+		}
+		r.events = nil
+		m.now = func() time.Time { return start.Add(s.elapsed) }
+		c.Check()
+		if diff := deep.Equal(s.want, r.events); diff != nil {
+			t.Errorf("%v: c.Check(): want != got: %v", s.name, diff)
+		}
+	}
+}
+
+func TestInvalidExpiryChecker(t *testing.T) {
+	m, err := NewManager("/tls", mapSecretStore{})
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	if _, err := NewExpiryChecker(m, 0); err == nil {
+		t.Errorf("NewExpiryChecker(m, 0): want error, got nil")
+	}
+	if _, err := NewExpiryChecker(m, DefaultExpiryCheckInterval, -1*time.Hour); err == nil {
+		t.Errorf("NewExpiryChecker(m, %v, %v): want error, got nil", DefaultExpiryCheckInterval, -1*time.Hour)
+	}
+}
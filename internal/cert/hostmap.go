@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// A hostMapTable tracks the value to which each ingress maps each of its hosts.
+type hostMapTable map[metadata]map[string]string
+
+// hostEntries maps each of the supplied hosts to the supplied value. It returns
+// no entries if the value is empty.
+func hostEntries(hosts []string, value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+	entries := make(map[string]string, len(hosts))
+	for _, h := range hosts {
+		entries[h] = value
+	}
+	return entries
+}
+
+// Mark sets the entries of an ingress, returning its previous entries and
+// whether they changed. An ingress with no entries is removed from the table.
+func (t hostMapTable) Mark(md metadata, entries map[string]string) (map[string]string, bool) {
+	existing := t[md]
+	if len(entries) == 0 {
+		delete(t, md)
+		return existing, len(existing) > 0
+	}
+	t[md] = entries
+	return existing, !reflect.DeepEqual(existing, entries)
+}
+
+// Delete removes an ingress from the table and returns whether the ingress
+// mapped any hosts.
+func (t hostMapTable) Delete(md metadata) bool {
+	_, changed := t.Mark(md, nil)
+	return changed
+}
+
+// owners returns the ingress that determines the value of each host. Hosts
+// mapped by several ingresses take the value of the first ingress, ordered by
+// namespace and name.
+func (t hostMapTable) owners() map[string]metadata {
+	ingresses := make([]metadata, 0, len(t))
+	for md := range t {
+		ingresses = append(ingresses, md)
+	}
+	owners := make(map[string]metadata)
+	for _, md := range sortMetadata(ingresses) {
+		for h := range t[md] {
+			if _, ok := owners[h]; !ok {
+				owners[h] = md
+			}
+		}
+	}
+	return owners
+}
+
+// Bytes returns an haproxy map of hostnames to their values. Hosts are sorted
+// such that the encoding is deterministic.
+func (t hostMapTable) Bytes() []byte {
+	owners := t.owners()
+	lines := make([]string, 0, len(owners))
+	for h, md := range owners {
+		lines = append(lines, h+" "+t[md][h])
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Conflicts returns the hosts of the supplied ingress that take the value of
+// another ingress, which differs from its own.
+func (t hostMapTable) Conflicts(md metadata) []string {
+	owners := t.owners()
+	conflicts := []string{}
+	for h, v := range t[md] {
+		if o := owners[h]; o != md && t[o][h] != v {
+			conflicts = append(conflicts, h)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// Hosts returns the hosts mapped by ingresses other than the supplied ingress.
+func (t hostMapTable) Hosts(except metadata) map[string]bool {
+	hosts := make(map[string]bool)
+	for md, entries := range t {
+		if md == except {
+			continue
+		}
+		for h := range entries {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+// A hostMap is an haproxy map file of hosts to values that is maintained from
+// ingresses. Each kind of host map supplies only how the entries of an ingress
+// are parsed.
+type hostMap struct {
+	hostMapTable
+
+	// Name describes the map in logs.
+	Name string
+
+	// File is the haproxy map file. The map is not written when it is empty.
+	File string
+
+	// Annotation is reported as invalid when the entries of an ingress cannot
+	// be parsed.
+	Annotation string
+
+	tempFilePrefix string
+
+	// entries returns the entries of the supplied ingress. Ingresses for which
+	// an error is returned keep their previous entries, unless entries are
+	// returned along with the error.
+	entries func(i *kubernetes.Ingress) (map[string]string, error)
+}
+
+// hostMaps returns all of the host maps maintained by the manager.
+func (m *Manager) hostMaps() []*hostMap {
+	return append([]*hostMap{m.hstsHosts, m.sourceAllowlist, m.backendHosts, m.passthroughs}, m.annotationMaps...)
+}
+
+// upsertHostMaps updates the entries of the supplied ingress in each host map,
+// returning true if any map changed. Ingresses with invalid annotations are
+// reported.
+func (m *Manager) upsertHostMaps(log *zap.Logger, i *kubernetes.Ingress, context string) bool {
+	changed := false
+	for _, hm := range m.hostMaps() {
+		if m.upsertHostMap(log.With(zap.String("map", hm.Name)), hm, i, context) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (m *Manager) upsertHostMap(log *zap.Logger, hm *hostMap, i *kubernetes.Ingress, context string) bool {
+	md := metadata{Namespace: i.GetNamespace(), Name: i.GetName()}
+	entries, err := hm.entries(i)
+	if err != nil {
+		log.Info("invalid annotation", zap.String("annotation", hm.Annotation), zap.Error(err))
+		m.recorder.NewInvalidAnnotation(md.Namespace, md.Name, hm.Annotation, err.Error())
+		if entries == nil {
+			return false
+		}
+	}
+	previous, changed := hm.Mark(md, entries)
+	if !changed {
+		return false
+	}
+	if hm.File != "" {
+		if _, err := m.writeValidated(hm.File, hm.tempFilePrefix, hm.Bytes()); err != nil {
+			if IsInvalid(err) {
+				log.Info("annotation would result in invalid configuration", zap.String("annotation", hm.Annotation), zap.Error(err))
+				m.recorder.NewInvalidAnnotation(md.Namespace, md.Name, hm.Annotation, err.Error())
+				hm.Mark(md, previous)
+				return false
+			}
+			log.Error("failed to write updated host map", zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+		}
+	}
+	if c := hm.Conflicts(md); len(c) > 0 {
+		log.Info("hosts take the differing value of another ingress", zap.Strings("hosts", c))
+	}
+	log.Debug("configuration change for host map")
+	return true
+}
+
+// deleteHostMaps removes the entries of the supplied ingress from each host
+// map, returning true if any map changed.
+func (m *Manager) deleteHostMaps(log *zap.Logger, i *kubernetes.Ingress) bool {
+	md := metadata{Namespace: i.GetNamespace(), Name: i.GetName()}
+	changed := false
+	for _, hm := range m.hostMaps() {
+		if !hm.Delete(md) {
+			continue
+		}
+		changed = true
+		if err := m.writeHostMap(hm); err != nil {
+			log.Error("failed to write updated host map", zap.String("map", hm.Name), zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextDeleteIngress}).Inc()
+		}
+	}
+	return changed
+}
+
+// markHostMaps sets the entries of the supplied ingress in each host map
+// without writing them. Invalid annotations are reported when the ingress is
+// upserted.
+func (m *Manager) markHostMaps(i *kubernetes.Ingress) {
+	md := metadata{Namespace: i.GetNamespace(), Name: i.GetName()}
+	for _, hm := range m.hostMaps() {
+		if entries, err := hm.entries(i); err == nil || entries != nil {
+			hm.Mark(md, entries)
+		}
+	}
+}
+
+// writeReconciledHostMaps writes each host map whose file does not match its
+// entries, and removes its stale temporary files. It returns true if any host
+// maps were written.
+func (m *Manager) writeReconciledHostMaps() bool {
+	changed := false
+	for _, hm := range m.hostMaps() {
+		if m.fileChanged(hm.File, hm.Bytes()) {
+			if err := m.writeHostMap(hm); err != nil {
+				m.log.Error("failed to write reconciled host map", zap.String("map", hm.Name), zap.Error(err))
+				m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+			}
+			changed = true
+		}
+		m.removeTempFiles(hm.File, hm.tempFilePrefix)
+	}
+	return changed
+}
+
+func (m *Manager) writeHostMap(hm *hostMap) error {
+	if hm.File == "" {
+		return nil
+	}
+	return m.writeAtomically(hm.File, hm.tempFilePrefix, hm.Bytes())
+}
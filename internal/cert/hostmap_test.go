@@ -0,0 +1,279 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/event"
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type hostMapRecorder struct {
+	event.NopRecorder
+	events []string
+}
+
+func (r *hostMapRecorder) NewInvalidAnnotation(namespace, ingressName, annotation, reason string) {
+	r.events = append(r.events, "InvalidAnnotation "+namespace+"/"+ingressName+" "+annotation)
+}
+
+func (r *hostMapRecorder) NewPassthroughConflict(namespace, ingressName string, hosts []string) {
+	r.events = append(r.events, "PassthroughConflict "+namespace+"/"+ingressName+" "+strings.Join(hosts, ","))
+}
+
+// hostMapIngress returns an ingress in namespace ns with the supplied
+// annotations and rule hosts, whose TLS is terminated using coolSecret.
+func hostMapIngress(name string, annotations map[string]string, hosts ...string) *kubernetes.Ingress {
+	i := &kubernetes.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, Annotations: map[string]string{}},
+		Spec:       kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{{SecretName: coolSecret.GetName()}}},
+	}
+	for k, v := range annotations {
+		i.Annotations[k] = v
+	}
+	for _, h := range hosts {
+		i.Spec.Rules = append(i.Spec.Rules, kubernetes.IngressRule{Host: h})
+	}
+	return i
+}
+
+// A hostMapStep changes the ingresses of a hostMapTest, and describes the host
+// map that should result.
+type hostMapStep struct {
+	name         string
+	fn           func()
+	want         string
+	wantEvents   []string
+	wantNotified int
+}
+
+// A hostMapTest drives a manager that maintains a single host map file.
+type hostMapTest struct {
+	*Manager
+	fs   afero.Fs
+	dir  string
+	file string
+	r    *hostMapRecorder
+	sub  *testSubscriber
+}
+
+// newHostMapTest returns a hostMapTest whose manager maintains a host map file
+// via the supplied option, e.g. WithHSTSHostsFile, and is configured with any
+// other supplied options.
+func newHostMapTest(t *testing.T, file func(string) ManagerOption, o ...ManagerOption) *hostMapTest {
+	fs := afero.NewMemMapFs()
+	ht := &hostMapTest{
+		fs:   fs,
+		dir:  populate(t, fs, nil),
+		file: filepath.Join(populate(t, fs, nil), "hosts.map"),
+		r:    &hostMapRecorder{},
+		sub:  &testSubscriber{},
+	}
+	o = append([]ManagerOption{WithFilesystem(fs), WithEventRecorder(ht.r), WithSubscriber(ht.sub), file(ht.file)}, o...)
+	m, err := NewManager(ht.dir,
+		mapSecretStore{metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret},
+		o...)
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	ht.Manager = m
+	return ht
+}
+
+// run runs the supplied steps, comparing the host map, events, and
+// notifications that result from each.
+func (ht *hostMapTest) run(t *testing.T, steps []hostMapStep) {
+	for _, s := range steps {
+		ht.r.events = nil
+		s.fn()
+		got, _ := afero.ReadFile(ht.fs, ht.file) // nolint:gas,gosec
+		if string(got) != s.want {
+			t.Errorf("%v: want host map %q, got %q", s.name, s.want, got)
+		}
+		if diff := deep.Equal(s.wantEvents, ht.r.events); diff != nil {
+			t.Errorf("%v: want != got events %v", s.name, diff)
+		}
+		if ht.sub.notified != s.wantNotified {
+			t.Errorf("%v: want %v notifications, got %v", s.name, s.wantNotified, ht.sub.notified)
+		}
+	}
+}
+
+func TestHostMapTable(t *testing.T) {
+	a, b := metadata{Namespace: "a", Name: "i"}, metadata{Namespace: "b", Name: "i"}
+	tbl := hostMapTable{}
+	if _, changed := tbl.Mark(b, map[string]string{"a.example.com": "b", "c.example.com": "b"}); !changed {
+		t.Errorf("t.Mark(...): want changed")
+	}
+	tbl.Mark(a, hostEntries([]string{"b.example.com", "a.example.com"}, "a"))
+
+	want := "a.example.com a\nb.example.com a\nc.example.com b"
+	if got := string(tbl.Bytes()); got != want {
+		t.Errorf("t.Bytes(): want %q, got %q", want, got)
+	}
+	if diff := deep.Equal([]string{"a.example.com"}, tbl.Conflicts(b)); diff != nil {
+		t.Errorf("t.Conflicts(...): want != got %v", diff)
+	}
+	if diff := deep.Equal([]string{}, tbl.Conflicts(a)); diff != nil {
+		t.Errorf("t.Conflicts(...): want != got %v", diff)
+	}
+	if diff := deep.Equal(map[string]bool{"a.example.com": true, "c.example.com": true}, tbl.Hosts(a)); diff != nil {
+		t.Errorf("t.Hosts(...): want != got %v", diff)
+	}
+
+	if _, changed := tbl.Mark(a, hostEntries([]string{"b.example.com", "a.example.com"}, "a")); changed {
+		t.Errorf("t.Mark(...): want unchanged")
+	}
+	if previous, changed := tbl.Mark(a, hostEntries([]string{"a.example.com"}, "")); !changed || len(previous) != 2 {
+		t.Errorf("t.Mark(...): want changed with 2 previous entries, got %v, %v", changed, previous)
+	}
+	if tbl.Delete(a) {
+		t.Errorf("t.Delete(...): want unchanged")
+	}
+	if !tbl.Delete(b) {
+		t.Errorf("t.Delete(...): want changed")
+	}
+	if got := string(tbl.Bytes()); got != "" {
+		t.Errorf("t.Bytes(): want empty map, got %q", got)
+	}
+}
+
+func TestHostMaps(t *testing.T) {
+	const annoMaintenance = "example.org/maintenance"
+	cases := []struct {
+		name       string
+		file       func(string) ManagerOption
+		annotation string
+		valid      map[string]string
+		want       string
+		changed    map[string]string
+		wantChange string
+		invalid    map[string]string
+	}{
+		{
+			name:       "HSTS",
+			file:       WithHSTSHostsFile,
+			annotation: annoHSTSMaxAge,
+			valid:      map[string]string{annoHSTSMaxAge: "300"},
+			want:       "acme.com max-age=300\nexample.com max-age=300",
+			changed:    map[string]string{annoHSTSMaxAge: "300", annoHSTSIncludeSubdomains: "true"},
+			wantChange: "acme.com max-age=300; includeSubDomains\nexample.com max-age=300; includeSubDomains",
+			invalid:    map[string]string{annoHSTSMaxAge: "forever"},
+		},
+		{
+			name:       "SourceAllowlist",
+			file:       WithSourceAllowlistFile,
+			annotation: annoWhitelistSourceRange,
+			valid:      map[string]string{annoWhitelistSourceRange: "10.0.0.0/8"},
+			want:       "acme.com 10.0.0.0/8\nexample.com 10.0.0.0/8",
+			changed:    map[string]string{annoWhitelistSourceRange: "10.0.0.0/8,192.168.0.0/16"},
+			wantChange: "acme.com 10.0.0.0/8,192.168.0.0/16\nexample.com 10.0.0.0/8,192.168.0.0/16",
+			invalid:    map[string]string{annoWhitelistSourceRange: "10.0.0.0/8,nope"},
+		},
+		{
+			name:       "BackendHosts",
+			file:       WithBackendHostsFile,
+			annotation: annoBackendProtocol,
+			valid:      map[string]string{annoBackendProtocol: "h2"},
+			want:       "acme.com linkerd_h2\nexample.com linkerd_h2",
+			changed:    map[string]string{annoBackendProtocol: "http1"},
+			wantChange: "acme.com linkerd_http\nexample.com linkerd_http",
+			invalid:    map[string]string{annoBackendProtocol: "spdy"},
+		},
+		{
+			name: "AnnotationMap",
+			file: func(file string) ManagerOption {
+				return WithAnnotationMaps(AnnotationMap{Annotation: annoMaintenance, File: file})
+			},
+			annotation: annoMaintenance,
+			valid:      map[string]string{annoMaintenance: "true"},
+			want:       "acme.com true\nexample.com true",
+			changed:    map[string]string{annoMaintenance: "false"},
+			wantChange: "acme.com false\nexample.com false",
+			invalid:    map[string]string{annoMaintenance: "tr\nue"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ht := newHostMapTest(t, tc.file)
+			ingress := func(annotations map[string]string) *kubernetes.Ingress {
+				return hostMapIngress("coolIngress", annotations, "example.com", "acme.com")
+			}
+			invalid := []string{"InvalidAnnotation ns/coolIngress " + tc.annotation}
+			ht.run(t, []hostMapStep{
+				{
+					name:         "AddIngress",
+					fn:           func() { ht.OnAdd(ingress(tc.valid)) },
+					want:         tc.want,
+					wantNotified: 1,
+				},
+				{
+					name:         "Unchanged",
+					fn:           func() { ht.OnUpdate(nil, ingress(tc.valid)) },
+					want:         tc.want,
+					wantNotified: 1,
+				},
+				{
+					name:         "Changed",
+					fn:           func() { ht.OnUpdate(nil, ingress(tc.changed)) },
+					want:         tc.wantChange,
+					wantNotified: 2,
+				},
+				{
+					name:         "InvalidKeepsPreviousEntries",
+					fn:           func() { ht.OnUpdate(nil, ingress(tc.invalid)) },
+					want:         tc.wantChange,
+					wantEvents:   invalid,
+					wantNotified: 2,
+				},
+				{
+					name:         "AnnotationRemoved",
+					fn:           func() { ht.OnUpdate(nil, ingress(nil)) },
+					want:         "",
+					wantNotified: 3,
+				},
+				{
+					name:         "InvalidWithoutPreviousEntries",
+					fn:           func() { ht.OnUpdate(nil, ingress(tc.invalid)) },
+					want:         "",
+					wantEvents:   invalid,
+					wantNotified: 3,
+				},
+				{
+					name:         "Restored",
+					fn:           func() { ht.OnUpdate(nil, ingress(tc.valid)) },
+					want:         tc.want,
+					wantNotified: 4,
+				},
+				{
+					name:         "DeleteIngress",
+					fn:           func() { ht.OnDelete(ingress(tc.valid)) },
+					want:         "",
+					wantNotified: 5,
+				},
+			})
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// The max-age directive of the Strict-Transport-Security header sent for
+	// the ingress' hosts, in seconds. No header is sent when unset.
+	annoHSTSMaxAge = "hal5d.planetlabs.com/hsts-max-age"
+
+	// Adds the includeSubDomains directive to the Strict-Transport-Security
+	// header when true.
+	annoHSTSIncludeSubdomains = "hal5d.planetlabs.com/hsts-include-subdomains"
+
+	// Adds the preload directive to the Strict-Transport-Security header when
+	// true.
+	annoHSTSPreload = "hal5d.planetlabs.com/hsts-preload"
+
+	hstsTempFilePrefix = "hsts-tempfile"
+)
+
+// hstsHeader returns the value of the Strict-Transport-Security header the
+// supplied ingress' hosts should send, or an empty string if they should not
+// send one.
+func hstsHeader(i *kubernetes.Ingress) (string, error) {
+	a := i.GetAnnotations()
+	v, ok := a[annoHSTSMaxAge]
+	if !ok {
+		return "", nil
+	}
+	maxAge, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return "", errors.Errorf("invalid HSTS max-age %q", v)
+	}
+	directives := []string{"max-age=" + strconv.FormatUint(maxAge, 10)}
+	if strings.ToLower(strings.TrimSpace(a[annoHSTSIncludeSubdomains])) == "true" {
+		directives = append(directives, "includeSubDomains")
+	}
+	if strings.ToLower(strings.TrimSpace(a[annoHSTSPreload])) == "true" {
+		directives = append(directives, "preload")
+	}
+	return strings.Join(directives, "; "), nil
+}
+
+// newHSTSHosts returns a host map of hostnames to the value of the
+// Strict-Transport-Security header they should send.
+func newHSTSHosts() *hostMap {
+	return &hostMap{
+		hostMapTable:   hostMapTable{},
+		Name:           "HSTS host map",
+		Annotation:     annoHSTSMaxAge,
+		tempFilePrefix: hstsTempFilePrefix,
+		entries: func(i *kubernetes.Ingress) (map[string]string, error) {
+			header, err := hstsHeader(i)
+			if err != nil {
+				return nil, err
+			}
+			return hostEntries(collectHosts(i), header), nil
+		},
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHSTSHeader(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "Unset",
+		},
+		{
+			name:        "MaxAge",
+			annotations: map[string]string{annoHSTSMaxAge: "31536000"},
+			want:        "max-age=31536000",
+		},
+		{
+			name: "AllDirectives",
+			annotations: map[string]string{
+				annoHSTSMaxAge:            "63072000",
+				annoHSTSIncludeSubdomains: "true",
+				annoHSTSPreload:           "True",
+			},
+			want: "max-age=63072000; includeSubDomains; preload",
+		},
+		{
+			name:        "DirectivesWithoutMaxAge",
+			annotations: map[string]string{annoHSTSIncludeSubdomains: "true"},
+		},
+		{
+			name:        "InvalidMaxAge",
+			annotations: map[string]string{annoHSTSMaxAge: "forever"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}}
+			got, err := hstsHeader(i)
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("hstsHeader(...): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("hstsHeader(...): want error, got nil")
+			}
+			if got != tc.want {
+				t.Errorf("hstsHeader(...): want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHSTSHosts(t *testing.T) {
+	ht := newHostMapTest(t, WithHSTSHostsFile)
+	ht.run(t, []hostMapStep{
+		{
+			name: "AddIngress",
+			fn: func() {
+				ht.OnAdd(hostMapIngress("b", map[string]string{annoHSTSMaxAge: "300"}, "example.com", "acme.com"))
+			},
+			want:         "acme.com max-age=300\nexample.com max-age=300",
+			wantNotified: 1,
+		},
+		{
+			// The first ingress, ordered by namespace and name, determines
+			// the header of hosts whose ingresses disagree.
+			name: "ConflictingIngress",
+			fn: func() {
+				ht.OnAdd(hostMapIngress("a", map[string]string{annoHSTSMaxAge: "0", annoHSTSPreload: "true"}, "example.com"))
+			},
+			want:         "acme.com max-age=300\nexample.com max-age=0; preload",
+			wantNotified: 2,
+		},
+		{
+			name:         "DeleteConflictingIngress",
+			fn:           func() { ht.OnDelete(hostMapIngress("a", nil, "example.com")) },
+			want:         "acme.com max-age=300\nexample.com max-age=300",
+			wantNotified: 3,
+		},
+	})
+}
+
+func TestHSTSConflicts(t *testing.T) {
+	ht := newHostMapTest(t, WithHSTSHostsFile)
+	ht.OnAdd(hostMapIngress("a", map[string]string{annoHSTSMaxAge: "300"}, "example.com", "acme.com"))
+	ht.OnAdd(hostMapIngress("b", map[string]string{annoHSTSMaxAge: "600"}, "example.com"))
+	ht.OnAdd(hostMapIngress("c", map[string]string{annoHSTSMaxAge: "300"}, "acme.com"))
+
+	for name, want := range map[string][]string{"a": {}, "b": {"example.com"}, "c": {}} {
+		if diff := deep.Equal(want, ht.hstsHosts.Conflicts(metadata{Namespace: "ns", Name: name})); diff != nil {
+			t.Errorf("Conflicts(ns/%v): want != got %v", name, diff)
+		}
+	}
+}
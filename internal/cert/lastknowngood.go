@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// keepLastKnownGood adds the cert pairs on disk that contain the supplied
+// secret to keep, such that they continue to be served while the secret is
+// invalid. It returns true if any were kept, which is recorded as an event
+// once per distinct reason. Cert pairs are only kept if the manager was
+// configured to keep the last known good cert pairs.
+func (m *Manager) keepLastKnownGood(log *zap.Logger, cp certPair, err error, keep map[certPair]bool) bool {
+	if !m.lastKnownGood {
+		return false
+	}
+	existing, xerr := m.existing(cp.Namespace, cp.IngressName)
+	if xerr != nil {
+		log.Error("cannot get existing cert pairs - not keeping last known good cert pair", zap.Error(xerr))
+		return false
+	}
+	cp = cp.unbundled()
+	kept := false
+	for e := range existing {
+		if e.unbundled() == cp {
+			keep[e] = true
+			kept = true
+		}
+	}
+	if !kept {
+		return false
+	}
+
+	m.metric.LastKnownGood.With(prometheus.Labels{
+		LabelNamespace:   cp.Namespace,
+		LabelIngressName: cp.IngressName,
+		LabelSecretName:  cp.SecretName,
+	}).Set(1)
+	if m.kept[cp] == err.Error() {
+		return true
+	}
+	m.kept[cp] = err.Error()
+	log.Warn("TLS secret is invalid - keeping last known good cert pair", zap.Error(err))
+	m.recorder.NewKeptLastKnownGood(cp.Namespace, cp.IngressName, cp.SecretName, err.Error())
+	return true
+}
+
+// forgetLastKnownGood records that the supplied cert pair is no longer
+// served from a secret that is now invalid, either because the secret is
+// valid again or because the cert pair was removed.
+func (m *Manager) forgetLastKnownGood(cp certPair) {
+	cp = cp.unbundled()
+	if _, ok := m.kept[cp]; !ok {
+		return
+	}
+	delete(m.kept, cp)
+	m.metric.LastKnownGood.Delete(prometheus.Labels{
+		LabelNamespace:   cp.Namespace,
+		LabelIngressName: cp.IngressName,
+		LabelSecretName:  cp.SecretName,
+	})
+}
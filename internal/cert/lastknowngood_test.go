@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/event"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type lastKnownGoodRecorder struct {
+	event.NopRecorder
+	events []string
+}
+
+func (r *lastKnownGoodRecorder) NewInvalidSecret(namespace, ingressName, secretName, reason string) {
+	r.events = append(r.events, "InvalidSecret "+namespace+"/"+ingressName+" "+secretName)
+}
+
+func (r *lastKnownGoodRecorder) NewKeptLastKnownGood(namespace, ingressName, secretName, reason string) {
+	r.events = append(r.events, "KeptLastKnownGood "+namespace+"/"+ingressName+" "+secretName)
+}
+
+func TestLastKnownGood(t *testing.T) {
+	dankSecretNamedCool := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolSecret"},
+		Data: map[string][]byte{
+			v1.TLSCertKey:       dankCert,
+			v1.TLSPrivateKeyKey: dankKey,
+		},
+	}
+	dankPEM := bytes.Join([][]byte{dankCert, dankKey}, []byte("\n"))
+	md := metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}
+	labels := labelKey(map[string]string{LabelNamespace: "ns", LabelIngressName: "coolIngress", LabelSecretName: "coolSecret"})
+
+	cases := []struct {
+		name      string
+		keep      bool
+		wantFiles map[string][]byte
+		wantKept  map[string]*float64
+		wantEvent string
+	}{
+		{
+			name:      "Keep",
+			keep:      true,
+			wantFiles: map[string][]byte{"ns_coolIngress_coolSecret.pem": coolPEM},
+			wantKept:  map[string]*float64{labels: func() *float64 { v := 1.0; return &v }()},
+			wantEvent: "KeptLastKnownGood ns/coolIngress coolSecret",
+		},
+		{
+			name:      "Remove",
+			wantFiles: map[string][]byte{},
+			wantKept:  map[string]*float64{},
+			wantEvent: "InvalidSecret ns/coolIngress coolSecret",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, nil)
+			store := mapSecretStore{md: coolSecret}
+			r := &lastKnownGoodRecorder{}
+			mx := newNopMetrics()
+			kept := mapGaugeVec{}
+			mx.LastKnownGood = kept
+			m, err := NewManager(dir, store,
+				WithFilesystem(fs),
+				WithEventRecorder(r),
+				WithMetrics(mx),
+				WithLastKnownGood(tc.keep))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			m.OnAdd(coolIngress)
+			validate(t, fs, dir, map[string][]byte{"ns_coolIngress_coolSecret.pem": coolPEM})
+
+			// The secret is updated such that it is invalid, then resynced.
+			store[md] = coolSecretWithoutKey
+			m.OnUpdate(nil, coolSecretWithoutKey)
+			m.OnUpdate(nil, coolSecretWithoutKey)
+			validate(t, fs, dir, tc.wantFiles)
+			if diff := deep.Equal(tc.wantKept, map[string]*float64(kept)); diff != nil {
+				t.Errorf("invalid secret: want != got last known good gauge %v", diff)
+			}
+			// Invalid secret events are recorded on every upsert, while the
+			// last known good cert pair is reported once per reason.
+			want := []string{tc.wantEvent}
+			if !tc.keep {
+				want = append(want, tc.wantEvent)
+			}
+			if diff := deep.Equal(want, r.events); diff != nil {
+				t.Errorf("invalid secret: want != got events %v", diff)
+			}
+
+			// The ingress is upserted while its secret is missing.
+			r.events = nil
+			delete(store, md)
+			m.OnUpdate(nil, coolIngress)
+			validate(t, fs, dir, tc.wantFiles)
+			if diff := deep.Equal([]string{tc.wantEvent}, r.events); diff != nil {
+				t.Errorf("missing secret: want != got events %v", diff)
+			}
+
+			// The secret is fixed.
+			r.events = nil
+			store[md] = dankSecretNamedCool
+			m.OnUpdate(nil, dankSecretNamedCool)
+			m.OnUpdate(nil, coolIngress)
+			validate(t, fs, dir, map[string][]byte{"ns_coolIngress_coolSecret.pem": dankPEM})
+			if diff := deep.Equal(map[string]*float64{}, map[string]*float64(kept)); diff != nil {
+				t.Errorf("fixed secret: want != got last known good gauge %v", diff)
+			}
+			if len(r.events) != 0 {
+				t.Errorf("fixed secret: want no events, got %v", r.events)
+			}
+		})
+	}
+}
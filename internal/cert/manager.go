@@ -18,12 +18,14 @@ package cert
 
 import (
 	"bytes"
-	"fmt"
 	"hash/fnv"
 	"io"
+	"net/url"
 	"path/filepath"
-	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/planetlabs/hal5d/internal/event"
 	"github.com/planetlabs/hal5d/internal/kubernetes"
@@ -34,7 +36,6 @@ import (
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/api/extensions/v1beta1"
 )
 
 // Labels used by metrics and logs.
@@ -44,6 +45,10 @@ const (
 	LabelSecretName  = "secret_name"
 	LabelContext     = "context"
 	LabelAllowHTTP   = "allow_http"
+	LabelSubject     = "subject"
+	LabelIssuer      = "issuer"
+	LabelSerial      = "serial"
+	LabelFingerprint = "sha256_fingerprint"
 )
 
 // Error contexts used as metric labels.
@@ -52,18 +57,53 @@ const (
 	ContextUpsertSecret  = "upsert_secret"
 	ContextDeleteIngress = "delete_ingress"
 	ContextDeleteSecret  = "delete_secret"
+	ContextMigrate       = "migrate"
+	ContextReconcile     = "reconcile"
+	ContextCheckExpiry   = "check_expiry"
+	ContextStapleOCSP    = "staple_ocsp"
+	ContextMassDeletion  = "mass_deletion"
 )
 
+// StagedCertPairPrefix prefixes the temporary files in which cert pairs are
+// staged in the TLS directory before they are committed. haproxy loads staged
+// cert pairs from the TLS directory, such that they are validated, but they
+// are otherwise not intended to be served.
+const StagedCertPairPrefix = "staged-"
+
 const (
 	certPairSuffix    = ".pem"
-	certPairSeparator = "-"
+	certPairSeparator = "_"
 	certPairMode      = 0600
+
+	forceHTTPSTempFilePrefix    = "https-only-tempfile"
+	httpsRedirectTempFilePrefix = "https-redirect-tempfile"
+
+	// Older versions of hal5d separated cert pair filename components with a
+	// hyphen, which is ambiguous because Kubernetes names may contain hyphens.
+	legacyCertPairSeparator = "-"
 )
 
+// certPairEscaper escapes the characters that would make a cert pair filename
+// ambiguous or invalid. Valid Kubernetes names never contain these characters,
+// but escaping them ensures any name round trips.
+var certPairEscaper = strings.NewReplacer("%", "%25", certPairSeparator, "%5F", "/", "%2F", bundleSeparator, "%2B")
+
 const (
 	// Corresponds to GCE Ingress annotation that accomplishes the same thing.
 	// https://cloud.google.com/kubernetes-engine/docs/concepts/ingress#disabling_http
 	annoAllowHTTP = "kubernetes.io/ingress.allow-http"
+
+	// Redirects plain HTTP requests for the ingress' hosts to HTTPS, rather
+	// than denying them, when true.
+	annoSSLRedirect = "hal5d.planetlabs.com/ssl-redirect"
+
+	// The HTTP status code with which plain HTTP requests are redirected to
+	// HTTPS. Defaults to DefaultRedirectCode.
+	annoSSLRedirectCode = "hal5d.planetlabs.com/ssl-redirect-code"
+
+	// The deprecated, but still widely used, ingress class annotation. Takes
+	// precedence over spec.ingressClassName when set.
+	annoIngressClass = "kubernetes.io/ingress.class"
 )
 
 type errInvalid struct {
@@ -103,7 +143,7 @@ func IsInvalid(err error) bool {
 }
 
 // collectHosts returns the host names contained within the rules of an ingress resource.
-func collectHosts(i *v1beta1.Ingress) []string {
+func collectHosts(i *kubernetes.Ingress) []string {
 	hosts := []string(nil)
 	for _, r := range i.Spec.Rules {
 		if r.Host != "" {
@@ -113,6 +153,28 @@ func collectHosts(i *v1beta1.Ingress) []string {
 	return hosts
 }
 
+// tlsHosts returns the host names listed in the TLS configuration of an
+// ingress resource for the supplied TLS secret.
+func tlsHosts(i *kubernetes.Ingress, secretName string) []string {
+	hosts := []string(nil)
+	for _, tls := range i.Spec.TLS {
+		if tls.SecretName == secretName {
+			hosts = append(hosts, tls.Hosts...)
+		}
+	}
+	return hosts
+}
+
+// expectedHosts returns the host names the supplied TLS secret is expected to
+// serve for an ingress; those listed in the ingress' TLS configuration for
+// that secret, or all of the ingress' hosts if none are listed.
+func expectedHosts(i *kubernetes.Ingress, secretName string) []string {
+	if hosts := tlsHosts(i, secretName); len(hosts) > 0 {
+		return hosts
+	}
+	return collectHosts(i)
+}
+
 type allowHTTP string
 
 // IsTrue indicates whether the value of the allow-http annotation is true.
@@ -122,74 +184,213 @@ func (s allowHTTP) IsTrue() bool {
 	return strings.ToLower(strings.TrimSpace(string(s))) != "false"
 }
 
+// DefaultRedirectCode is the HTTP status code with which plain HTTP requests
+// are redirected to HTTPS, unless an ingress specifies otherwise.
+const DefaultRedirectCode = 301
+
+// redirectCodes are the HTTP status codes haproxy can redirect with.
+var redirectCodes = map[int]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+// redirectCode returns the HTTP status code with which plain HTTP requests for
+// the supplied ingress' hosts should be redirected to HTTPS, or zero if they
+// should not be redirected. Invalid codes are replaced by DefaultRedirectCode
+// and returned along with an error.
+func redirectCode(i *kubernetes.Ingress) (int, error) {
+	a := i.GetAnnotations()
+	if strings.ToLower(strings.TrimSpace(a[annoSSLRedirect])) != "true" {
+		return 0, nil
+	}
+	v, ok := a[annoSSLRedirectCode]
+	if !ok {
+		return DefaultRedirectCode, nil
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || !redirectCodes[code] {
+		return DefaultRedirectCode, errors.Errorf("invalid redirect code %q", v)
+	}
+	return code, nil
+}
+
 type certPair struct {
 	Namespace   string
 	IngressName string
 	SecretName  string
+
+	// KeyType and Peer are set when the cert pair is one half of an haproxy
+	// multi-cert bundle. KeyType is the type of the cert pair's key, and Peer
+	// is the name of the secret containing the other half of the bundle.
+	KeyType string
+	Peer    string
 }
 
 func newCertPair(filename string) (certPair, error) {
-	if !strings.HasSuffix(filename, certPairSuffix) {
+	keyType := ""
+	for _, kt := range []string{keyTypeRSA, keyTypeECDSA} {
+		if strings.HasSuffix(filename, certPairSuffix+"."+kt) {
+			keyType = kt
+		}
+	}
+	name := strings.TrimSuffix(filename, "."+keyType)
+	if !strings.HasSuffix(name, certPairSuffix) {
 		return certPair{}, errors.Errorf("filename %s does not end with expected suffix %s", filename, certPairSuffix)
 	}
-	parts := strings.Split(strings.TrimSuffix(filename, certPairSuffix), certPairSeparator)
+	parts := strings.Split(strings.TrimSuffix(name, certPairSuffix), certPairSeparator)
 	if len(parts) != 3 {
-		return certPair{}, errors.Errorf("filename %s does not match expected namespace-ingressname-secretname.pem pattern", filename)
+		return certPair{}, errors.Errorf("filename %s does not match expected namespace_ingressname_secretname.pem pattern", filename)
 	}
-	return certPair{Namespace: parts[0], IngressName: parts[1], SecretName: parts[2]}, nil
+	secrets := []string{parts[2]}
+	if keyType != "" {
+		secrets = strings.Split(parts[2], bundleSeparator)
+		if len(secrets) != 2 {
+			return certPair{}, errors.Errorf("filename %s does not match expected namespace_ingressname_rsasecret+ecdsasecret.pem.%s pattern", filename, keyType)
+		}
+	}
+	names := append([]string{parts[0], parts[1]}, secrets...)
+	for i := range names {
+		n, err := url.PathUnescape(names[i])
+		if err != nil {
+			return certPair{}, errors.Wrapf(err, "cannot unescape filename %s", filename)
+		}
+		names[i] = n
+	}
+	cp := certPair{Namespace: names[0], IngressName: names[1], SecretName: names[2]}
+	switch keyType {
+	case keyTypeRSA:
+		cp.KeyType, cp.Peer = keyTypeRSA, names[3]
+	case keyTypeECDSA:
+		cp.KeyType, cp.SecretName, cp.Peer = keyTypeECDSA, names[3], names[2]
+	}
+	return cp, nil
 }
 
+// Filename returns the name of the file containing this cert pair. The halves
+// of a multi-cert bundle share a name, suffixed with their key type.
 func (c certPair) Filename() string {
-	return fmt.Sprintf("%s-%s-%s.pem", c.Namespace, c.IngressName, c.SecretName)
+	if c.KeyType == "" {
+		return c.bundleFilename()
+	}
+	return c.bundleFilename() + "." + c.KeyType
+}
+
+// bundleFilename returns the name by which haproxy refers to this cert pair;
+// the name shared by both halves of a multi-cert bundle, or the cert pair's
+// filename if it is not part of a bundle.
+func (c certPair) bundleFilename() string {
+	secret := certPairEscaper.Replace(c.SecretName)
+	switch c.KeyType {
+	case keyTypeRSA:
+		secret = secret + bundleSeparator + certPairEscaper.Replace(c.Peer)
+	case keyTypeECDSA:
+		secret = certPairEscaper.Replace(c.Peer) + bundleSeparator + secret
+	}
+	return strings.Join([]string{
+		certPairEscaper.Replace(c.Namespace),
+		certPairEscaper.Replace(c.IngressName),
+		secret,
+	}, certPairSeparator) + certPairSuffix
+}
+
+// unbundled returns this cert pair as it would be were it not part of a
+// multi-cert bundle.
+func (c certPair) unbundled() certPair {
+	return certPair{Namespace: c.Namespace, IngressName: c.IngressName, SecretName: c.SecretName}
+}
+
+// legacyFilename returns the filename older versions of hal5d used for this
+// cert pair.
+func (c certPair) legacyFilename() string {
+	return strings.Join([]string{c.Namespace, c.IngressName, c.SecretName}, legacyCertPairSeparator) + certPairSuffix
 }
 
 type certData struct {
 	certPair
 	Cert []byte
 	Key  []byte
+
+	// Hosts the cert pair is expected to serve.
+	Hosts []string
 }
 
 func (c certData) Bytes() []byte {
 	return bytes.Join([][]byte{c.Cert, c.Key}, []byte("\n"))
 }
 
-type forceHTTPSMetadata struct {
-	Hosts      []string
-	ForceHTTPS bool
+// forceHTTPSDeny is the value of hosts that are denied plain HTTP requests in a
+// forceHTTPSTable.
+const forceHTTPSDeny = "deny"
+
+// A forceHTTPSTable maps the hosts of each ingress for which https is forced to
+// the HTTP status code with which plain HTTP requests are redirected to https,
+// or to forceHTTPSDeny if they are denied.
+type forceHTTPSTable struct {
+	hostMapTable
 }
-type forceHTTPSTable map[metadata]forceHTTPSMetadata
 
-// Bytes returns a line-delimited encoded list of hostnames for which https should be forced.
+// Bytes returns a line-delimited encoded list of hostnames for which https should be forced
+// by denying plain HTTP requests. Hosts are sorted and deduplicated such that the encoding
+// is deterministic.
 func (da forceHTTPSTable) Bytes() []byte {
-	forcedHosts := []string{}
-	for _, m := range da {
-		if m.ForceHTTPS {
-			forcedHosts = append(forcedHosts, m.Hosts...)
-		}
+	denied := da.denied()
+	deniedHosts := make([]string, 0, len(denied))
+	for h := range denied {
+		deniedHosts = append(deniedHosts, h)
 	}
-	return []byte(strings.Join(forcedHosts, "\n"))
+	sort.Strings(deniedHosts)
+	return []byte(strings.Join(deniedHosts, "\n"))
 }
 
-func (da forceHTTPSTable) Delete(namespace, ingressName string) {
-	m := metadata{Namespace: namespace, Name: ingressName}
-	delete(da, m)
+// RedirectBytes returns an haproxy map of the hostnames for which https should be forced by
+// redirecting plain HTTP requests, to the HTTP status code to redirect with. Hosts that are
+// denied plain HTTP by any ingress are not redirected. Hosts redirected by several ingresses
+// are redirected with the lowest of their codes. Hosts are sorted such that the encoding is
+// deterministic.
+func (da forceHTTPSTable) RedirectBytes() []byte {
+	denied := da.denied()
+	codes := make(map[string]int)
+	for _, entries := range da.hostMapTable {
+		for h, v := range entries {
+			code, err := strconv.Atoi(v)
+			if err != nil || denied[h] {
+				continue
+			}
+			if c, ok := codes[h]; !ok || code < c {
+				codes[h] = code
+			}
+		}
+	}
+	lines := make([]string, 0, len(codes))
+	for h, c := range codes {
+		lines = append(lines, h+" "+strconv.Itoa(c))
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n"))
 }
 
-// MarkForceHTTPS marks an ingress as HTTPS only and returns whether the setting for that ingress changed.
-func (da forceHTTPSTable) MarkForceHTTPS(namespace, ingressName string, force bool, hosts []string) bool {
-	changed := false
-
-	m := metadata{Namespace: namespace, Name: ingressName}
-	a := forceHTTPSMetadata{
-		Hosts:      hosts,
-		ForceHTTPS: force,
+func (da forceHTTPSTable) denied() map[string]bool {
+	denied := make(map[string]bool)
+	for _, entries := range da.hostMapTable {
+		for h, v := range entries {
+			if v == forceHTTPSDeny {
+				denied[h] = true
+			}
+		}
 	}
+	return denied
+}
 
-	if existing := da[m]; !reflect.DeepEqual(existing, a) {
-		changed = true
+// MarkForceHTTPS marks an ingress as HTTPS only and returns whether the setting for that ingress changed.
+// HTTPS is forced by redirecting plain HTTP requests with the supplied redirectCode, or by denying them
+// if redirectCode is zero.
+func (da forceHTTPSTable) MarkForceHTTPS(namespace, ingressName string, force bool, redirectCode int, hosts []string) bool {
+	v := ""
+	switch {
+	case !force:
+	case redirectCode == 0:
+		v = forceHTTPSDeny
+	default:
+		v = strconv.Itoa(redirectCode)
 	}
-
-	da[m] = a
+	_, changed := da.Mark(metadata{Namespace: namespace, Name: ingressName}, hostEntries(hosts, v))
 	return changed
 }
 
@@ -198,6 +399,18 @@ type metadata struct {
 	Name      string
 }
 
+// sortMetadata sorts the supplied metadata by namespace, then name, and
+// returns it.
+func sortMetadata(mds []metadata) []metadata {
+	sort.Slice(mds, func(i, j int) bool {
+		if mds[i].Namespace != mds[j].Namespace {
+			return mds[i].Namespace < mds[j].Namespace
+		}
+		return mds[i].Name < mds[j].Name
+	})
+	return mds
+}
+
 type secretRefs map[metadata]map[string]bool
 
 func (r secretRefs) Add(namespace, ingressName, secretName string) {
@@ -213,6 +426,16 @@ func (r secretRefs) Delete(namespace, ingressName, secretName string) {
 	delete(r[m], ingressName)
 }
 
+// DeleteIngress removes all references from the supplied ingress.
+func (r secretRefs) DeleteIngress(namespace, ingressName string) {
+	for m, ingresses := range r {
+		if m.Namespace != namespace {
+			continue
+		}
+		delete(ingresses, ingressName)
+	}
+}
+
 func (r secretRefs) Get(namespace, secretName string) map[string]bool {
 	m := metadata{Namespace: namespace, Name: secretName}
 	return r[m]
@@ -241,14 +464,48 @@ type Metrics struct {
 	Deletes  metrics.CounterVec
 	Errors   metrics.CounterVec
 	Invalids metrics.CounterVec
+
+	// NotBefore and NotAfter expose the validity period of each cert pair's
+	// leaf certificate as seconds since the Unix epoch.
+	NotBefore metrics.GaugeVec
+	NotAfter  metrics.GaugeVec
+
+	// Info exposes the identity of each cert pair's leaf certificate via its
+	// labels. Its value is always 1.
+	Info metrics.GaugeVec
+
+	// UncoveredHosts exposes the number of hosts each cert pair is expected
+	// to serve that are not covered by its leaf certificate.
+	UncoveredHosts metrics.GaugeVec
+
+	// OCSPFailures counts failures to fetch a valid OCSP response for each
+	// cert pair's leaf certificate.
+	OCSPFailures metrics.CounterVec
+
+	// LastKnownGood exposes the cert pairs that continue to be served while
+	// the secret they were written from is invalid. Its value is always 1.
+	LastKnownGood metrics.GaugeVec
+
+	// HeldDeletions exposes the number of ingress and secret deletions, and
+	// of stale cert pair removals, held by a deletion breaker, labelled with
+	// ContextDeleteIngress, ContextDeleteSecret, or ContextReconcile.
+	HeldDeletions metrics.GaugeVec
 }
 
 func newNopMetrics() Metrics {
 	return Metrics{
-		Writes:   &metrics.NopCounterVec{},
-		Deletes:  &metrics.NopCounterVec{},
-		Errors:   &metrics.NopCounterVec{},
-		Invalids: &metrics.NopCounterVec{},
+		Writes:    &metrics.NopCounterVec{},
+		Deletes:   &metrics.NopCounterVec{},
+		Errors:    &metrics.NopCounterVec{},
+		Invalids:  &metrics.NopCounterVec{},
+		NotBefore: &metrics.NopGaugeVec{},
+		NotAfter:  &metrics.NopGaugeVec{},
+		Info:      &metrics.NopGaugeVec{},
+
+		UncoveredHosts: &metrics.NopGaugeVec{},
+		OCSPFailures:   &metrics.NopCounterVec{},
+		LastKnownGood:  &metrics.NopGaugeVec{},
+		HeldDeletions:  &metrics.NopGaugeVec{},
 	}
 }
 
@@ -262,11 +519,37 @@ type Manager struct {
 
 	tlsDir              string
 	forceHTTPSHostsFile string
+	redirectHostsFile   string
 	v                   Validator
 	secretStore         kubernetes.SecretStore
+	ingressClasses      map[string]bool
+	classStore          kubernetes.IngressClassStore
+	controller          string
 	secretRefs          secretRefs
 	forceHTTPSTable     forceHTTPSTable
+	hstsHosts           *hostMap
+	sourceAllowlist     *hostMap
+	backendHosts        *hostMap
+	passthroughs        *hostMap
+	annotationMaps      []*hostMap
 	subscribers         []Subscriber
+	checkValidity       bool
+	strictHosts         bool
+	now                 func() time.Time
+	certInfo            map[certPair]prometheus.Labels
+	certHosts           map[certPair][]string
+	sniHosts            map[certPair][]string
+	groups              map[certPair][]string
+	crtListFile         string
+	crtList             crtListTable
+	clientCADir         string
+	clientAuth          map[metadata]clientAuth
+	caRefs              secretRefs
+	uncovered           map[certPair]string
+	lastKnownGood       bool
+	kept                map[certPair]string
+	managed             map[metadata]bool
+	breaker             *DeletionBreaker
 }
 
 // A ManagerOption can be used to configure new certificate managers.
@@ -305,6 +588,39 @@ func WithValidator(v Validator) ManagerOption {
 	}
 }
 
+// WithValidityPeriodCheck configures whether a certificate manager rejects
+// cert pairs whose leaf certificate has expired or is not yet valid. This is
+// disabled by default, because haproxy will serve such cert pairs. Cert pairs
+// are always parsed, and their private key matched to their leaf certificate,
+// before they are validated.
+func WithValidityPeriodCheck(check bool) ManagerOption {
+	return func(m *Manager) error {
+		m.checkValidity = check
+		return nil
+	}
+}
+
+// WithStrictHostCoverage configures whether a certificate manager rejects cert
+// pairs whose leaf certificate does not cover all of the hosts it is expected
+// to serve. Uncovered hosts are always reported.
+func WithStrictHostCoverage(strict bool) ManagerOption {
+	return func(m *Manager) error {
+		m.strictHosts = strict
+		return nil
+	}
+}
+
+// WithLastKnownGood configures whether a certificate manager keeps serving the
+// cert pairs on disk when the secret they were written from becomes invalid,
+// rather than removing them. Cert pairs are kept until their secret is valid
+// again, or is deleted.
+func WithLastKnownGood(keep bool) ManagerOption {
+	return func(m *Manager) error {
+		m.lastKnownGood = keep
+		return nil
+	}
+}
+
 // WithSubscriber registers a subscriber to a certificate manager. Each
 // subscriber will be called every time the managed cert pairs change.
 func WithSubscriber(s Subscriber) ManagerOption {
@@ -314,6 +630,17 @@ func WithSubscriber(s Subscriber) ManagerOption {
 	}
 }
 
+// WithOCSPStapler registers an OCSP stapler to a certificate manager. The
+// stapler will staple OCSP responses to the manager's cert pairs, and is
+// notified every time they change.
+func WithOCSPStapler(s *OCSPStapler) ManagerOption {
+	return func(m *Manager) error {
+		s.m = m
+		m.subscribers = append(m.subscribers, s)
+		return nil
+	}
+}
+
 // WithEventRecorder configures a certificate manager's Kubernetes event
 // recorder. The event recorder will emit events when certificate pairs change.
 func WithEventRecorder(r event.Recorder) ManagerOption {
@@ -332,6 +659,134 @@ func WithForceHTTPSHostsFile(forceHTTPSHostsFile string) ManagerOption {
 	}
 }
 
+// WithHTTPSRedirectHostsFile specifies the location of the haproxy map file
+// hal5d will manage containing hostnames for which http traffic should be
+// redirected to https, and the HTTP status code to redirect with.
+func WithHTTPSRedirectHostsFile(redirectHostsFile string) ManagerOption {
+	return func(m *Manager) error {
+		m.redirectHostsFile = redirectHostsFile
+		return nil
+	}
+}
+
+// WithHSTSHostsFile specifies the location of the haproxy map file hal5d will
+// manage containing hostnames and the value of the Strict-Transport-Security
+// header they should send.
+func WithHSTSHostsFile(hstsHostsFile string) ManagerOption {
+	return func(m *Manager) error {
+		m.hstsHosts.File = hstsHostsFile
+		return nil
+	}
+}
+
+// WithSourceAllowlistFile specifies the location of the haproxy map file hal5d
+// will manage containing restricted hostnames and the CIDRs allowed to access
+// them.
+func WithSourceAllowlistFile(sourceAllowlistFile string) ManagerOption {
+	return func(m *Manager) error {
+		m.sourceAllowlist.File = sourceAllowlistFile
+		return nil
+	}
+}
+
+// WithBackendHostsFile specifies the location of the haproxy map file hal5d
+// will manage containing hostnames and the haproxy backend their traffic should
+// be routed to, per the protocol spoken by their ingress' backends.
+func WithBackendHostsFile(backendHostsFile string) ManagerOption {
+	return func(m *Manager) error {
+		m.backendHosts.File = backendHostsFile
+		return nil
+	}
+}
+
+// WithPassthroughHostsFile specifies the location of the haproxy map file hal5d
+// will manage containing the SNI hostnames of ingresses that pass TLS through,
+// and the haproxy backend their connections should be passed to.
+func WithPassthroughHostsFile(passthroughHostsFile string) ManagerOption {
+	return func(m *Manager) error {
+		m.passthroughs.File = passthroughHostsFile
+		return nil
+	}
+}
+
+// WithAnnotationMaps configures a certificate manager to maintain the supplied
+// annotation maps. Map files must be distinct, and must not be in the TLS
+// directory.
+func WithAnnotationMaps(maps ...AnnotationMap) ManagerOption {
+	return func(m *Manager) error {
+		files := make(map[string]bool)
+		for _, a := range maps {
+			hm, err := newAnnotationMap(a)
+			if err != nil {
+				return err
+			}
+			f := filepath.Clean(a.File)
+			if filepath.Dir(f) == filepath.Clean(m.tlsDir) {
+				return errors.Errorf("annotation map file %v must not be in TLS directory %v", a.File, m.tlsDir)
+			}
+			if files[f] {
+				return errors.Errorf("annotation map file %v is configured more than once", a.File)
+			}
+			files[f] = true
+			m.annotationMaps = append(m.annotationMaps, hm)
+		}
+		return nil
+	}
+}
+
+// WithCrtListFile specifies the location of the haproxy crt-list file hal5d
+// will manage. The crt-list lists every cert pair in the TLS directory, with
+// SNI filters taken from the TLS hosts of the ingress that references it. The
+// crt-list file must not be in the TLS directory.
+func WithCrtListFile(crtListFile string) ManagerOption {
+	return func(m *Manager) error {
+		if crtListFile != "" && filepath.Clean(filepath.Dir(crtListFile)) == filepath.Clean(m.tlsDir) {
+			return errors.Errorf("crt-list file %v must not be in TLS directory %v", crtListFile, m.tlsDir)
+		}
+		m.crtListFile = crtListFile
+		return nil
+	}
+}
+
+// WithClientCADir specifies the directory in which hal5d will write the client
+// CA bundles and CRLs of ingresses that verify client certificates. Client
+// certificates are verified via crt-list options, so a crt-list file must also
+// be specified. The client CA directory must not be the TLS directory.
+func WithClientCADir(dir string) ManagerOption {
+	return func(m *Manager) error {
+		if dir != "" && filepath.Clean(dir) == filepath.Clean(m.tlsDir) {
+			return errors.Errorf("client CA directory %v must not be TLS directory %v", dir, m.tlsDir)
+		}
+		m.clientCADir = dir
+		return nil
+	}
+}
+
+// WithIngressClasses configures a certificate manager to manage only ingresses
+// of the supplied classes. An ingress' class is determined by its
+// kubernetes.io/ingress.class annotation, or by its spec.ingressClassName if
+// the annotation is unset. All ingresses are managed when no classes are
+// supplied.
+func WithIngressClasses(classes ...string) ManagerOption {
+	return func(m *Manager) error {
+		for _, c := range classes {
+			m.ingressClasses[c] = true
+		}
+		return nil
+	}
+}
+
+// WithIngressClassController configures a certificate manager to also manage
+// ingresses that reference an IngressClass handled by the supplied controller.
+// This option only has an effect when combined with WithIngressClasses.
+func WithIngressClassController(s kubernetes.IngressClassStore, controller string) ManagerOption {
+	return func(m *Manager) error {
+		m.classStore = s
+		m.controller = controller
+		return nil
+	}
+}
+
 // NewManager creates a new certificate manager.
 func NewManager(dir string, s kubernetes.SecretStore, o ...ManagerOption) (*Manager, error) {
 	m := &Manager{
@@ -342,27 +797,62 @@ func NewManager(dir string, s kubernetes.SecretStore, o ...ManagerOption) (*Mana
 		tlsDir:          dir,
 		v:               &optimisticValidator{},
 		secretStore:     s,
+		ingressClasses:  make(map[string]bool),
 		secretRefs:      make(map[metadata]map[string]bool),
 		subscribers:     make([]Subscriber, 0),
-		forceHTTPSTable: forceHTTPSTable{},
+		forceHTTPSTable: forceHTTPSTable{hostMapTable{}},
+		hstsHosts:       newHSTSHosts(),
+		sourceAllowlist: newSourceAllowlist(),
+		backendHosts:    newBackendHosts(),
+		passthroughs:    newPassthroughHosts(),
+		now:             time.Now,
+		certInfo:        make(map[certPair]prometheus.Labels),
+		certHosts:       make(map[certPair][]string),
+		sniHosts:        make(map[certPair][]string),
+		groups:          make(map[certPair][]string),
+		crtList:         crtListTable{},
+		clientAuth:      make(map[metadata]clientAuth),
+		caRefs:          make(map[metadata]map[string]bool),
+		uncovered:       make(map[certPair]string),
+		kept:            make(map[certPair]string),
+		managed:         make(map[metadata]bool),
 	}
 	for _, mo := range o {
 		if err := mo(m); err != nil {
 			return nil, errors.Wrap(err, "cannot apply manager option")
 		}
 	}
+	if m.clientCADir != "" && m.crtListFile == "" {
+		return nil, errors.New("client CA directory requires a crt-list file")
+	}
 	return m, nil
 }
 
 // OnAdd handles notifications of new ingress or secret resources.
 func (m *Manager) OnAdd(obj interface{}) {
 	switch obj := obj.(type) {
-	case *v1beta1.Ingress:
-		if changed := m.upsertIngress(obj); changed {
+	case *kubernetes.Ingress:
+		md := metadata{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		if !m.manages(obj) {
+			// The ingress may have previously been of a class we manage, in
+			// which case it is handled as if it were deleted.
+			if !m.managed[md] {
+				return
+			}
+			changed := m.deleteIngress(obj)
+			if m.syncCrtList(ContextDeleteIngress) || changed {
+				m.notifySubscribers()
+			}
+			return
+		}
+		m.managed[md] = true
+		changed := m.upsertIngress(obj)
+		if m.syncCrtList(ContextUpsertIngress) || changed {
 			m.notifySubscribers()
 		}
 	case *v1.Secret:
-		if changed := m.upsertSecret(obj); changed {
+		changed := m.upsertSecret(obj)
+		if m.syncCrtList(ContextUpsertSecret) || changed {
 			m.notifySubscribers()
 		}
 	}
@@ -376,18 +866,51 @@ func (m *Manager) OnUpdate(_, newObj interface{}) {
 // OnDelete handles notifications of deleted ingress or secret resources.
 func (m *Manager) OnDelete(obj interface{}) {
 	switch obj := obj.(type) {
-	case *v1beta1.Ingress:
-		if changed := m.deleteIngress(obj); changed {
+	case *kubernetes.Ingress:
+		changed := m.deleteIngress(obj)
+		if m.syncCrtList(ContextDeleteIngress) || changed {
 			m.notifySubscribers()
 		}
 	case *v1.Secret:
-		if changed := m.deleteSecret(obj); changed {
+		changed := m.deleteSecret(obj)
+		if m.syncCrtList(ContextDeleteSecret) || changed {
+			m.notifySubscribers()
+		}
+	case staleCertPair:
+		changed := m.removeStaleCertPair(certPair(obj))
+		if m.syncCrtList(ContextReconcile) || changed {
 			m.notifySubscribers()
 		}
 	}
 }
 
-func (m *Manager) upsertIngress(i *v1beta1.Ingress) bool { // nolint:gocyclo
+// manages returns true if the supplied ingress is of a class managed by this
+// certificate manager.
+func (m *Manager) manages(i *kubernetes.Ingress) bool {
+	if len(m.ingressClasses) == 0 {
+		return true
+	}
+	class := i.GetAnnotations()[annoIngressClass]
+	if class == "" {
+		class = i.Spec.IngressClassName
+	}
+	if class == "" {
+		return false
+	}
+	if m.ingressClasses[class] {
+		return true
+	}
+	if m.classStore == nil {
+		return false
+	}
+	c, err := m.classStore.Get(class)
+	if err != nil {
+		return false
+	}
+	return c.Controller == m.controller
+}
+
+func (m *Manager) upsertIngress(i *kubernetes.Ingress) bool {
 	log := m.log.With(
 		zap.String(LabelNamespace, i.GetNamespace()),
 		zap.String(LabelIngressName, i.GetName()))
@@ -395,102 +918,175 @@ func (m *Manager) upsertIngress(i *v1beta1.Ingress) bool { // nolint:gocyclo
 
 	changed := false
 
-	// We determine whether we should force https based on whether the `allow-http` annotation is false.
+	// We determine whether we should force https based on whether the `allow-http` annotation is false,
+	// or the `ssl-redirect` annotation is true. https is never forced for hosts that pass TLS through.
 	allowHTTP := allowHTTP(i.GetAnnotations()[annoAllowHTTP]).IsTrue()
+	code, err := redirectCode(i)
+	if err != nil {
+		log.Info("invalid redirect code annotation - using default redirect code", zap.Error(err))
+	}
 	hosts := collectHosts(i)
-	if m.forceHTTPSTable.MarkForceHTTPS(i.GetNamespace(), i.GetName(), !allowHTTP, hosts) {
+	force := !passthrough(i) && (!allowHTTP || code != 0)
+	if m.forceHTTPSTable.MarkForceHTTPS(i.GetNamespace(), i.GetName(), force, code, hosts) {
 		changed = true
-		log.With(zap.Bool(LabelAllowHTTP, allowHTTP)).Debug("configuration change for allowed http endpoints")
+		log.With(zap.Bool(LabelAllowHTTP, allowHTTP), zap.Int("redirectCode", code)).Debug("configuration change for allowed http endpoints")
 		if err := m.writeForceHTTPSHosts(); err != nil {
 			log.Error("failed to write updated force https host list", zap.Error(err))
 			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextUpsertIngress}).Inc()
 		}
 	}
-
-	existing, err := m.existing(i.GetNamespace(), i.GetName())
-	if err != nil {
-		log.Error("cannot get existing cert pairs - stale cert pairs will not be reaped")
-		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextUpsertIngress}).Inc()
+	if m.upsertHostMaps(log, i, ContextUpsertIngress) {
+		changed = true
 	}
 
 	keep := make(map[certPair]bool)
-	for _, tls := range i.Spec.TLS {
-		log := log.With(zap.String(LabelSecretName, tls.SecretName)) //nolint:vetshadow
-		m.secretRefs.Add(i.GetNamespace(), i.GetName(), tls.SecretName)
-		s, err := m.secretStore.Get(i.GetNamespace(), tls.SecretName)
-		if err != nil {
-			// This error is indicative of user misconfiguration, i.e. an
-			// ingress referencing a TLS secret that does not yet exist. We log
-			// it informationally, and do not emit an error metric.
-			log.Info("cannot get TLS secret", zap.Error(err))
-			m.recorder.NewInvalidSecret(i.GetNamespace(), i.GetName(), tls.SecretName)
-			m.metric.Invalids.With(prometheus.Labels{
-				LabelNamespace:   i.GetNamespace(),
-				LabelIngressName: i.GetName(),
-				LabelSecretName:  tls.SecretName,
-			}).Inc()
-			continue
+	referenced := make(map[string]bool)
+	m.deleteGroups(i.GetNamespace(), i.GetName())
+	groups := tlsGroups(i)
+	if passthrough(i) {
+		// The secrets of ingresses that pass TLS through are never written to
+		// disk. Any cert pairs written before the ingress passed TLS through
+		// are removed as stale.
+		m.forgetTLS(i.GetNamespace(), i.GetName())
+		groups = nil
+	}
+	for _, group := range groups {
+		cds := make([]certData, 0, len(group))
+		for _, secretName := range group {
+			log := log.With(zap.String(LabelSecretName, secretName)) //nolint:vetshadow
+			referenced[secretName] = true
+			m.secretRefs.Add(i.GetNamespace(), i.GetName(), secretName)
+			cp := certPair{Namespace: i.GetNamespace(), IngressName: i.GetName(), SecretName: secretName}
+			m.groups[cp] = group
+			s, err := m.secretStore.Get(i.GetNamespace(), secretName)
+			if err != nil {
+				// This error is indicative of user misconfiguration, i.e. an
+				// ingress referencing a TLS secret that does not yet exist. We log
+				// it informationally, and do not emit an error metric.
+				log.Info("cannot get TLS secret", zap.Error(err))
+				m.keepLastKnownGood(log, cp, err, keep)
+				m.reportInvalid(cp, err)
+				continue
+			}
+			log.Debug("found secret")
+
+			m.certHosts[cp] = expectedHosts(i, secretName)
+			m.sniHosts[cp] = tlsHosts(i, secretName)
+			cd, err := newCertData(cp, s, m.certHosts[cp])
+			if err != nil {
+				log.Info("invalid TLS secret", zap.Error(err))
+				m.keepLastKnownGood(log, cp, err, keep)
+				m.reportInvalid(cp, err)
+				continue
+			}
+			cds = append(cds, cd)
+		}
+		written, c := m.upsertCertData(log, cds, ContextUpsertIngress)
+		for cp := range written {
+			keep[cp] = true
 		}
-		log.Debug("found secret")
+		changed = changed || c
+	}
 
-		cert, ok := s.Data[v1.TLSCertKey]
-		if !ok {
-			log.Info("missing certificate", zap.String("secret key", v1.TLSCertKey))
-			m.recorder.NewInvalidSecret(i.GetNamespace(), i.GetName(), s.GetName())
-			m.metric.Invalids.With(prometheus.Labels{
-				LabelNamespace:   i.GetNamespace(),
-				LabelIngressName: i.GetName(),
-				LabelSecretName:  s.GetName(),
-			}).Inc()
+	if m.removeStale(log, i.GetNamespace(), i.GetName(), keep, referenced, nil, ContextUpsertIngress) {
+		changed = true
+	}
+	m.reportPassthroughConflicts(log, i.GetNamespace(), i.GetName())
+
+	if m.upsertClientAuth(i, ContextUpsertIngress) {
+		changed = true
+	}
+
+	return changed
+}
+
+// upsertCertData writes any of the supplied cert pairs that are new or
+// changed. The supplied cert pairs must serve the same hosts, and are written
+// as a multi-cert bundle if possible. upsertCertData returns the cert pairs
+// that are on disk, and whether any were written.
+func (m *Manager) upsertCertData(log *zap.Logger, cds []certData, context string) (map[certPair]bool, bool) {
+	keep := make(map[certPair]bool)
+	pending := make([]certData, 0, len(cds))
+	for _, cd := range bundle(cds) {
+		log := log.With(zap.String(LabelSecretName, cd.SecretName)) //nolint:vetshadow
+		m.checkHosts(log, cd)
+		if !m.changed(cd) {
+			log.Debug("cert pair unchanged")
+			m.observe(cd)
+			keep[cd.certPair] = true
 			continue
 		}
-		key, ok := s.Data[v1.TLSPrivateKeyKey]
-		if !ok {
-			log.Info("missing private key", zap.String("secret key", v1.TLSPrivateKeyKey))
-			m.recorder.NewInvalidSecret(i.GetNamespace(), i.GetName(), s.GetName())
-			m.metric.Invalids.With(prometheus.Labels{
-				LabelNamespace:   i.GetNamespace(),
-				LabelIngressName: i.GetName(),
-				LabelSecretName:  s.GetName(),
-			}).Inc()
+		if err := m.verify(cd); err != nil {
+			log.Info("invalid cert pair", zap.Error(err))
+			m.keepLastKnownGood(log, cd.certPair, err, keep)
+			m.reportInvalid(cd.certPair, err)
 			continue
 		}
+		pending = append(pending, cd)
+	}
+	if len(pending) == 0 {
+		return keep, false
+	}
 
-		cp := certPair{Namespace: i.GetNamespace(), IngressName: i.GetName(), SecretName: s.GetName()}
-		cd := certData{certPair: cp, Cert: cert, Key: key}
-		if existing[cp] && !m.changed(cd) {
-			log.Debug("cert pair unchanged")
-			keep[cp] = true
-			continue
-		}
-		if err := m.write(cd); err != nil {
+	// The halves of a multi-cert bundle are validated together.
+	if err := m.write(pending...); err != nil {
+		for _, cd := range pending {
+			log := log.With(zap.String(LabelSecretName, cd.SecretName)) //nolint:vetshadow
 			if IsInvalid(err) {
 				log.Info("invalid cert pair", zap.Error(err))
-				m.recorder.NewInvalidSecret(i.GetNamespace(), i.GetName(), s.GetName())
-				m.metric.Invalids.With(prometheus.Labels{
-					LabelNamespace:   i.GetNamespace(),
-					LabelIngressName: i.GetName(),
-					LabelSecretName:  s.GetName(),
-				}).Inc()
+				m.keepLastKnownGood(log, cd.certPair, err, keep)
+				m.reportInvalid(cd.certPair, err)
 				continue
 			}
 			log.Error("cannot write cert pair", zap.Error(err))
-			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextUpsertIngress}).Inc()
-			continue
+			m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
 		}
-		keep[cp] = true
-		changed = true
+		return keep, false
+	}
+
+	for _, cd := range pending {
+		keep[cd.certPair] = true
+		m.observe(cd)
 		m.metric.Writes.With(prometheus.Labels{
-			LabelNamespace:   i.GetNamespace(),
-			LabelIngressName: i.GetName(),
-			LabelSecretName:  s.GetName(),
+			LabelNamespace:   cd.Namespace,
+			LabelIngressName: cd.IngressName,
+			LabelSecretName:  cd.SecretName,
 		}).Inc()
-		m.recorder.NewWrite(i.GetNamespace(), i.GetName(), s.GetName())
-		log.Debug("wrote cert pair")
+		m.recorder.NewWrite(cd.Namespace, cd.IngressName, cd.SecretName)
+		log.Debug("wrote cert pair", zap.String(LabelSecretName, cd.SecretName))
 	}
+	return keep, true
+}
 
+// reportInvalid reports that the supplied cert pair is invalid. No invalid
+// secret event is recorded for cert pairs whose last known good version is
+// kept; keepLastKnownGood records its own.
+func (m *Manager) reportInvalid(cp certPair, err error) {
+	if _, kept := m.kept[cp.unbundled()]; !kept {
+		m.recorder.NewInvalidSecret(cp.Namespace, cp.IngressName, cp.SecretName, err.Error())
+	}
+	m.metric.Invalids.With(prometheus.Labels{
+		LabelNamespace:   cp.Namespace,
+		LabelIngressName: cp.IngressName,
+		LabelSecretName:  cp.SecretName,
+	}).Inc()
+}
+
+// removeStale removes the cert pairs of the supplied ingress that should not
+// be kept. Only cert pairs containing the supplied secrets are removed, unless
+// secrets is nil. Secrets that are no longer referenced by the ingress are
+// forgotten. removeStale returns true if any cert pairs were removed.
+func (m *Manager) removeStale(log *zap.Logger, namespace, ingressName string, keep map[certPair]bool, referenced, secrets map[string]bool, context string) bool {
+	existing, err := m.existing(namespace, ingressName)
+	if err != nil {
+		log.Error("cannot get existing cert pairs - stale cert pairs will not be reaped")
+		m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
+		return false
+	}
+
+	changed := false
 	for cp := range existing {
-		if keep[cp] {
+		if keep[cp] || (secrets != nil && !secrets[cp.SecretName]) {
 			continue
 		}
 		log := log.With(zap.String(LabelSecretName, cp.SecretName)) //nolint:vetshadow
@@ -498,45 +1094,39 @@ func (m *Manager) upsertIngress(i *v1beta1.Ingress) bool { // nolint:gocyclo
 		path := filepath.Join(m.tlsDir, cp.Filename())
 		if err := m.fs.Remove(path); err != nil {
 			log.Error("cannot remove stale cert pair", zap.Error(err))
-			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextUpsertIngress}).Inc()
+			m.metric.Errors.With(prometheus.Labels{LabelContext: context}).Inc()
 			continue
 		}
-		m.secretRefs.Delete(i.GetNamespace(), i.GetName(), cp.SecretName)
+		if !referenced[cp.SecretName] {
+			m.secretRefs.Delete(namespace, ingressName, cp.SecretName)
+			delete(m.certHosts, cp.unbundled())
+			delete(m.sniHosts, cp.unbundled())
+			delete(m.groups, cp.unbundled())
+		}
 		changed = true
+		m.forget(cp)
 		m.metric.Deletes.With(prometheus.Labels{
-			LabelNamespace:   i.GetNamespace(),
-			LabelIngressName: i.GetName(),
+			LabelNamespace:   namespace,
+			LabelIngressName: ingressName,
 			LabelSecretName:  cp.SecretName,
 		}).Inc()
-		m.recorder.NewDelete(i.GetNamespace(), i.GetName(), cp.SecretName)
+		m.recorder.NewDelete(namespace, ingressName, cp.SecretName)
 		log.Debug("deleted cert pair")
 	}
-
 	return changed
 }
 
 func (m *Manager) writeForceHTTPSHosts() error {
+	if m.redirectHostsFile != "" {
+		if err := m.writeAtomically(m.redirectHostsFile, httpsRedirectTempFilePrefix, m.forceHTTPSTable.RedirectBytes()); err != nil {
+			return err
+		}
+	}
 	if m.forceHTTPSHostsFile == "" {
 		m.log.Debug("no force https hosts file specified, skipping")
 		return nil
 	}
-
-	f, err := afero.TempFile(m.fs, filepath.Dir(m.forceHTTPSHostsFile), "https-only-tempfile")
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	defer m.fs.Remove(f.Name())
-
-	if _, err := f.Write(m.forceHTTPSTable.Bytes()); err != nil {
-		return errors.Wrapf(err, "cannot write %v", f.Name())
-	}
-
-	if err := f.Sync(); err != nil {
-		return errors.Wrapf(err, "cannot fsync %v", f.Name())
-	}
-
-	return errors.Wrapf(m.fs.Rename(f.Name(), m.forceHTTPSHostsFile), "cannot move %v to %v", f.Name(), m.forceHTTPSHostsFile)
+	return m.writeAtomically(m.forceHTTPSHostsFile, forceHTTPSTempFilePrefix, m.forceHTTPSTable.Bytes())
 }
 
 func (m *Manager) changed(c certData) bool {
@@ -559,33 +1149,80 @@ func (m *Manager) changed(c certData) bool {
 	return proposed.Sum32() != existing.Sum32()
 }
 
-func (m *Manager) write(c certData) error {
-	f, err := afero.TempFile(m.fs, m.tlsDir, c.Filename())
+// write stages the supplied cert pairs, validates them, and commits them.
+// Cert pairs must be verified before they are written. Managers that maintain
+// a crt-list validate each cert pair along with its crt-list line.
+func (m *Manager) write(cs ...certData) error {
+	staged := make([]string, 0, len(cs))
+	defer func() {
+		for _, tmp := range staged {
+			m.fs.Remove(tmp) // nolint:gas,gosec
+		}
+	}()
+	for _, c := range cs {
+		tmp, err := m.stage(c)
+		if err != nil {
+			return err
+		}
+		staged = append(staged, tmp)
+	}
+
+	if m.crtListFile != "" {
+		sps := make([]stagedCertPair, 0, len(cs))
+		for n, c := range cs {
+			sps = append(sps, stagedCertPair{certData: c, path: staged[n]})
+		}
+		if err := m.commitListed(sps); err != nil {
+			return err
+		}
+		for _, c := range cs {
+			m.removeOCSPResponse(c.certPair)
+		}
+		return nil
+	}
+
+	// This assumes the validate function treats the temp files as it would
+	// any other file in the TLS directory.
+	if err := m.v.Validate(); err != nil {
+		return ErrInvalid(errors.Wrapf(err, "writing certificate pair would result in invalid configuration"))
+	}
+	for n, c := range cs {
+		path := filepath.Join(m.tlsDir, c.Filename())
+		if err := m.fs.Rename(staged[n], path); err != nil {
+			return errors.Wrapf(err, "cannot move %v to %v", staged[n], path)
+		}
+		m.removeOCSPResponse(c.certPair)
+	}
+	return nil
+}
+
+// stage writes the supplied cert pair to a temporary file in the TLS
+// directory, returning the path to the temporary file. Temporary files are
+// prefixed with StagedCertPairPrefix.
+func (m *Manager) stage(c certData) (string, error) {
+	f, err := afero.TempFile(m.fs, m.tlsDir, StagedCertPairPrefix+c.Filename())
 	if err != nil {
-		return errors.Wrapf(err, "cannot create temp file in %v", m.tlsDir)
+		return "", errors.Wrapf(err, "cannot create temp file in %v", m.tlsDir)
 	}
 	defer f.Close()
-	defer m.fs.Remove(f.Name())
 
 	if _, err := f.Write(c.Bytes()); err != nil {
-		return errors.Wrapf(err, "cannot write cert pair data to %v", f.Name())
+		m.fs.Remove(f.Name()) // nolint:gas,gosec
+		return "", errors.Wrapf(err, "cannot write cert pair data to %v", f.Name())
 	}
 	if err := f.Sync(); err != nil {
-		return errors.Wrapf(err, "cannot fsync %v", f.Name())
+		m.fs.Remove(f.Name()) // nolint:gas,gosec
+		return "", errors.Wrapf(err, "cannot fsync %v", f.Name())
 	}
 	if err := f.Close(); err != nil {
-		return errors.Wrapf(err, "cannot close %v", f.Name())
+		m.fs.Remove(f.Name()) // nolint:gas,gosec
+		return "", errors.Wrapf(err, "cannot close %v", f.Name())
 	}
 	if err := m.fs.Chmod(f.Name(), certPairMode); err != nil {
-		return errors.Wrapf(err, "cannot chmod %v to %d", f.Name(), certPairMode)
-	}
-	// This assumes the validate function treats the temp file as it would any
-	// other file in the TLS directory.
-	if err := m.v.Validate(); err != nil {
-		return ErrInvalid(errors.Wrapf(err, "writing certificate pair would result in invalid configuration"))
+		m.fs.Remove(f.Name()) // nolint:gas,gosec
+		return "", errors.Wrapf(err, "cannot chmod %v to %d", f.Name(), certPairMode)
 	}
-	path := filepath.Join(m.tlsDir, c.Filename())
-	return errors.Wrapf(m.fs.Rename(f.Name(), path), "cannot move %v to %v", f.Name(), path)
+	return f.Name(), nil
 }
 
 func (m *Manager) upsertSecret(s *v1.Secret) bool {
@@ -597,72 +1234,102 @@ func (m *Manager) upsertSecret(s *v1.Secret) bool {
 	changed := false
 	for ingressName := range m.secretRefs.Get(s.GetNamespace(), s.GetName()) {
 		log := log.With(zap.String(LabelIngressName, ingressName)) // nolint:vetshadow
-		cert, ok := s.Data[v1.TLSCertKey]
-		if !ok {
-			m.log.Info("missing TLS certificate", zap.String("secret key", v1.TLSCertKey))
-			m.recorder.NewInvalidSecret(s.GetNamespace(), ingressName, s.GetName())
-			m.metric.Invalids.With(prometheus.Labels{
-				LabelNamespace:   s.GetNamespace(),
-				LabelIngressName: ingressName,
-				LabelSecretName:  s.GetName(),
-			}).Inc()
-			continue
-		}
-		key, ok := s.Data[v1.TLSPrivateKeyKey]
-		if !ok {
-			m.log.Info("missing TLS private key", zap.String("secret key", v1.TLSPrivateKeyKey))
-			m.recorder.NewInvalidSecret(s.GetNamespace(), ingressName, s.GetName())
-			m.metric.Invalids.With(prometheus.Labels{
-				LabelNamespace:   s.GetNamespace(),
-				LabelIngressName: ingressName,
-				LabelSecretName:  s.GetName(),
-			}).Inc()
-			continue
+		cp := certPair{Namespace: s.GetNamespace(), IngressName: ingressName, SecretName: s.GetName()}
+		if m.upsertGroup(log, cp, m.group(cp), s, ContextUpsertSecret) {
+			changed = true
 		}
+	}
 
-		cp := certPair{Namespace: s.GetNamespace(), IngressName: ingressName, SecretName: s.GetName()}
-		cd := certData{certPair: cp, Cert: cert, Key: key}
-		if !m.changed(cd) {
-			log.Debug("cert pair unchanged")
-			continue
+	if m.upsertClientCASecret(s) {
+		changed = true
+	}
+
+	return changed
+}
+
+// group returns the names of the secrets that serve the same hosts as the
+// supplied cert pair, including its own.
+func (m *Manager) group(cp certPair) []string {
+	if g, ok := m.groups[cp.unbundled()]; ok {
+		return g
+	}
+	return []string{cp.SecretName}
+}
+
+// deleteGroups forgets how the TLS secrets of the supplied ingress are grouped.
+func (m *Manager) deleteGroups(namespace, ingressName string) {
+	for cp := range m.groups {
+		if cp.Namespace == namespace && cp.IngressName == ingressName {
+			delete(m.groups, cp)
 		}
-		if err := m.write(cd); err != nil {
-			if IsInvalid(err) {
-				log.Info("invalid cert pair", zap.Error(err))
-				m.recorder.NewInvalidSecret(s.GetNamespace(), ingressName, s.GetName())
-				m.metric.Invalids.With(prometheus.Labels{
-					LabelNamespace:   s.GetNamespace(),
-					LabelIngressName: ingressName,
-					LabelSecretName:  s.GetName(),
-				}).Inc()
+	}
+}
+
+// upsertGroup writes the cert pairs of the supplied ingress that contain the
+// supplied secrets, which serve the same hosts, and removes any of their
+// stale cert pairs. The supplied secret is used in place of the one with the
+// same name in the secret store, and is reported if it is invalid. Other
+// secrets are reported when they are upserted.
+func (m *Manager) upsertGroup(log *zap.Logger, ing certPair, secretNames []string, s *v1.Secret, context string) bool {
+	cds := make([]certData, 0, len(secretNames))
+	secrets := make(map[string]bool)
+	referenced := make(map[string]bool)
+	lastKnownGood := make(map[certPair]bool)
+	for _, secretName := range secretNames {
+		referenced[secretName] = true
+		sec := s
+		if s == nil || secretName != s.GetName() {
+			var err error
+			if sec, err = m.secretStore.Get(ing.Namespace, secretName); err != nil {
 				continue
 			}
-			log.Error("cannot write cert pair", zap.Error(err))
-			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextUpsertSecret}).Inc()
+		}
+		secrets[secretName] = true
+		cp := certPair{Namespace: ing.Namespace, IngressName: ing.IngressName, SecretName: secretName}
+		cd, err := newCertData(cp, sec, m.certHosts[cp])
+		if err != nil {
+			m.keepLastKnownGood(log, cp, err, lastKnownGood)
+			if sec == s {
+				log.Info("invalid TLS secret", zap.Error(err))
+				m.reportInvalid(cp, err)
+			}
 			continue
 		}
-		changed = true
-		m.metric.Writes.With(prometheus.Labels{
-			LabelNamespace:   s.GetNamespace(),
-			LabelIngressName: ingressName,
-			LabelSecretName:  s.GetName(),
-		}).Inc()
-		m.recorder.NewWrite(s.GetNamespace(), ingressName, s.GetName())
-		log.Debug("wrote cert pair")
+		cds = append(cds, cd)
 	}
 
+	keep, changed := m.upsertCertData(log, cds, context)
+	for cp := range lastKnownGood {
+		keep[cp] = true
+	}
+	if m.removeStale(log, ing.Namespace, ing.IngressName, keep, referenced, secrets, context) {
+		changed = true
+	}
 	return changed
 }
 
-func (m *Manager) deleteIngress(i *v1beta1.Ingress) bool {
+func (m *Manager) deleteIngress(i *kubernetes.Ingress) bool {
 	log := m.log.With(
 		zap.String(LabelNamespace, i.GetNamespace()),
 		zap.String(LabelIngressName, i.GetName()))
 	log.Debug("processing ingress delete")
 
-	m.forceHTTPSTable.Delete(i.GetNamespace(), i.GetName())
+	delete(m.managed, metadata{Namespace: i.GetNamespace(), Name: i.GetName()})
+	m.forgetTLS(i.GetNamespace(), i.GetName())
+	m.deleteGroups(i.GetNamespace(), i.GetName())
+
+	changed := m.deleteClientAuth(metadata{Namespace: i.GetNamespace(), Name: i.GetName()})
+	if m.forceHTTPSTable.Delete(metadata{Namespace: i.GetNamespace(), Name: i.GetName()}) {
+		changed = true
+		if err := m.writeForceHTTPSHosts(); err != nil {
+			log.Error("failed to write updated force https host list", zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextDeleteIngress}).Inc()
+		}
+	}
+	if m.deleteHostMaps(log, i) {
+		changed = true
+	}
 
-	changed := false
 	existing, err := m.existing(i.GetNamespace(), i.GetName())
 	if err != nil {
 		log.Error("cannot get existing cert pairs - stale cert pairs will not be reaped")
@@ -675,8 +1342,8 @@ func (m *Manager) deleteIngress(i *v1beta1.Ingress) bool {
 			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextDeleteIngress}).Inc()
 			continue
 		}
-		m.secretRefs.Delete(i.GetNamespace(), i.GetName(), cp.SecretName)
 		changed = true
+		m.forget(cp)
 		m.metric.Deletes.With(prometheus.Labels{
 			LabelNamespace:   i.GetNamespace(),
 			LabelIngressName: i.GetName(),
@@ -688,6 +1355,19 @@ func (m *Manager) deleteIngress(i *v1beta1.Ingress) bool {
 	return changed
 }
 
+// forgetTLS forgets the secrets referenced by the supplied ingress, and the
+// hosts its cert pairs serve. Secrets that were never written to disk may
+// still be referenced.
+func (m *Manager) forgetTLS(namespace, ingressName string) {
+	m.secretRefs.DeleteIngress(namespace, ingressName)
+	for cp := range m.certHosts {
+		if cp.Namespace == namespace && cp.IngressName == ingressName {
+			delete(m.certHosts, cp)
+			delete(m.sniHosts, cp)
+		}
+	}
+}
+
 func (m *Manager) deleteSecret(s *v1.Secret) bool {
 	log := m.log.With(
 		zap.String(LabelNamespace, s.GetNamespace()),
@@ -696,22 +1376,50 @@ func (m *Manager) deleteSecret(s *v1.Secret) bool {
 
 	changed := false
 	for ingressName := range m.secretRefs.Get(s.GetNamespace(), s.GetName()) {
-		cp := certPair{Namespace: s.GetNamespace(), IngressName: ingressName, SecretName: s.GetName()}
-		log := log.With(zap.String(LabelIngressName, cp.IngressName)) //nolint:vetshadow
-		path := filepath.Join(m.tlsDir, cp.Filename())
-		if err := m.fs.Remove(path); err != nil {
-			log.Error("cannot remove stale TLS certpair", zap.Error(err))
+		log := log.With(zap.String(LabelIngressName, ingressName)) //nolint:vetshadow
+		existing, err := m.existing(s.GetNamespace(), ingressName)
+		if err != nil {
+			log.Error("cannot get existing cert pairs - stale cert pairs will not be reaped")
 			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextDeleteSecret}).Inc()
 			continue
 		}
+		for cp := range existing {
+			if cp.SecretName != s.GetName() {
+				continue
+			}
+			path := filepath.Join(m.tlsDir, cp.Filename())
+			if err := m.fs.Remove(path); err != nil {
+				log.Error("cannot remove stale TLS certpair", zap.Error(err))
+				m.metric.Errors.With(prometheus.Labels{LabelContext: ContextDeleteSecret}).Inc()
+				continue
+			}
+			changed = true
+			m.forget(cp)
+			m.recorder.NewDelete(s.GetNamespace(), cp.IngressName, s.GetName())
+			log.Debug("deleted cert pair")
+			m.metric.Deletes.With(prometheus.Labels{
+				LabelNamespace:   s.GetNamespace(),
+				LabelIngressName: ingressName,
+				LabelSecretName:  s.GetName(),
+			}).Inc()
+		}
+
+		// The other half of a multi-cert bundle must be rewritten as a
+		// standalone cert pair.
+		cp := certPair{Namespace: s.GetNamespace(), IngressName: ingressName, SecretName: s.GetName()}
+		peers := []string{}
+		for _, secretName := range m.group(cp) {
+			if secretName != s.GetName() {
+				peers = append(peers, secretName)
+			}
+		}
+		if len(peers) > 0 && m.upsertGroup(log, cp, peers, nil, ContextDeleteSecret) {
+			changed = true
+		}
+	}
+
+	if m.deleteClientCASecret(s) {
 		changed = true
-		m.recorder.NewDelete(s.GetNamespace(), cp.IngressName, s.GetName())
-		log.Debug("deleted cert pair")
-		m.metric.Deletes.With(prometheus.Labels{
-			LabelNamespace:   s.GetNamespace(),
-			LabelIngressName: ingressName,
-			LabelSecretName:  s.GetName(),
-		}).Inc()
 	}
 
 	return changed
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/planetlabs/hal5d/internal/kubernetes"
 
@@ -29,30 +31,33 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
-	coolIngress = &v1beta1.Ingress{
+	coolCert, coolKey = newTestCertPair(time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+	dankCert, dankKey = newTestCertPair(time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+	coolPEM           = bytes.Join([][]byte{coolCert, coolKey}, []byte("\n"))
+
+	coolIngress = &kubernetes.Ingress{
 		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress"},
-		Spec:       v1beta1.IngressSpec{TLS: []v1beta1.IngressTLS{{SecretName: coolSecret.GetName()}}},
+		Spec:       kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{{SecretName: coolSecret.GetName()}}},
 	}
-	coolIngressWithHTTPAllowed = &v1beta1.Ingress{
+	coolIngressWithHTTPAllowed = &kubernetes.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace:   "ns",
 			Name:        "coolIngress",
 			Annotations: map[string]string{},
 		},
-		Spec: v1beta1.IngressSpec{
-			Rules: []v1beta1.IngressRule{
-				v1beta1.IngressRule{Host: "acme.com"},
-				v1beta1.IngressRule{Host: "example.com"},
+		Spec: kubernetes.IngressSpec{
+			Rules: []kubernetes.IngressRule{
+				kubernetes.IngressRule{Host: "acme.com"},
+				kubernetes.IngressRule{Host: "example.com"},
 			},
-			TLS: []v1beta1.IngressTLS{{SecretName: coolSecret.GetName()}},
+			TLS: []kubernetes.IngressTLS{{SecretName: coolSecret.GetName()}},
 		},
 	}
-	coolIngressWithNoHTTPAllowed = &v1beta1.Ingress{
+	coolIngressWithNoHTTPAllowed = &kubernetes.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "ns",
 			Name:      "coolIngress",
@@ -60,38 +65,38 @@ var (
 				annoAllowHTTP: "false",
 			},
 		},
-		Spec: v1beta1.IngressSpec{
-			Rules: []v1beta1.IngressRule{
-				v1beta1.IngressRule{Host: "acme.com"},
-				v1beta1.IngressRule{Host: "example.com"},
+		Spec: kubernetes.IngressSpec{
+			Rules: []kubernetes.IngressRule{
+				kubernetes.IngressRule{Host: "acme.com"},
+				kubernetes.IngressRule{Host: "example.com"},
 			},
-			TLS: []v1beta1.IngressTLS{{SecretName: coolSecret.GetName()}},
+			TLS: []kubernetes.IngressTLS{{SecretName: coolSecret.GetName()}},
 		},
 	}
 	coolSecret = &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolSecret"},
 		Data: map[string][]byte{
-			v1.TLSCertKey:       []byte("cert"),
-			v1.TLSPrivateKeyKey: []byte("key"),
+			v1.TLSCertKey:       coolCert,
+			v1.TLSPrivateKeyKey: coolKey,
 		},
 	}
 	coolSecretWithoutCert = &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolSecret"},
 		Data: map[string][]byte{
-			v1.TLSPrivateKeyKey: []byte("key"),
+			v1.TLSPrivateKeyKey: coolKey,
 		},
 	}
 	coolSecretWithoutKey = &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolSecret"},
 		Data: map[string][]byte{
-			v1.TLSCertKey: []byte("cert"),
+			v1.TLSCertKey: coolCert,
 		},
 	}
 	dankSecret = &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "dankSecret"},
 		Data: map[string][]byte{
-			v1.TLSCertKey:       []byte("dankcert"),
-			v1.TLSPrivateKeyKey: []byte("dankkey"),
+			v1.TLSCertKey:       dankCert,
+			v1.TLSPrivateKeyKey: dankKey,
 		},
 	}
 )
@@ -147,7 +152,7 @@ func TestNewCertPair(t *testing.T) {
 	}{
 		{
 			name:     "ValidFilename",
-			filename: "ns-ingress-secret.pem",
+			filename: "ns_ingress_secret.pem",
 			want:     certPair{Namespace: "ns", IngressName: "ingress", SecretName: "secret"},
 		},
 		{
@@ -155,9 +160,39 @@ func TestNewCertPair(t *testing.T) {
 			filename: "ns-ingress-secret.crt",
 			wantErr:  true,
 		},
+		{
+			name:     "HyphenatedNames",
+			filename: "team-a_my-ingress_my-tls.pem",
+			want:     certPair{Namespace: "team-a", IngressName: "my-ingress", SecretName: "my-tls"},
+		},
+		{
+			name:     "EscapedNames",
+			filename: "ns_in%5Fgress_secret%25.pem",
+			want:     certPair{Namespace: "ns", IngressName: "in_gress", SecretName: "secret%"},
+		},
 		{
 			name:     "InvalidParts",
-			filename: "ingress-secret.pem",
+			filename: "ingress_secret.pem",
+			wantErr:  true,
+		},
+		{
+			name:     "LegacyFilename",
+			filename: "ns-ingress-secret.pem",
+			wantErr:  true,
+		},
+		{
+			name:     "RSABundle",
+			filename: "ns_ingress_rsa+ecdsa.pem.rsa",
+			want:     certPair{Namespace: "ns", IngressName: "ingress", SecretName: "rsa", KeyType: "rsa", Peer: "ecdsa"},
+		},
+		{
+			name:     "ECDSABundle",
+			filename: "ns_ingress_rsa+ecdsa.pem.ecdsa",
+			want:     certPair{Namespace: "ns", IngressName: "ingress", SecretName: "ecdsa", KeyType: "ecdsa", Peer: "rsa"},
+		},
+		{
+			name:     "InvalidBundle",
+			filename: "ns_ingress_secret.pem.rsa",
 			wantErr:  true,
 		},
 	}
@@ -178,6 +213,32 @@ func TestNewCertPair(t *testing.T) {
 	}
 }
 
+func TestCertPairFilenameRoundTrip(t *testing.T) {
+	cases := []certPair{
+		{Namespace: "ns", IngressName: "ingress", SecretName: "secret"},
+		{Namespace: "team-a", IngressName: "my-ingress", SecretName: "my-tls"},
+		{Namespace: "a-b", IngressName: "c", SecretName: "d"},
+		{Namespace: "a", IngressName: "b-c", SecretName: "d"},
+		{Namespace: "ns", IngressName: "my.ingress", SecretName: "secret.pem"},
+		{Namespace: "n_s", IngressName: "in%gress", SecretName: "sec/ret"},
+		{Namespace: "ns", IngressName: "ingress", SecretName: "se+cret"},
+		{Namespace: "ns", IngressName: "ingress", SecretName: "rsa", KeyType: "rsa", Peer: "ecdsa"},
+		{Namespace: "ns", IngressName: "ingress", SecretName: "ecdsa", KeyType: "ecdsa", Peer: "rsa"},
+		{Namespace: "ns", IngressName: "ingress", SecretName: "r+sa", KeyType: "rsa", Peer: "ec_dsa"},
+	}
+	for _, want := range cases {
+		t.Run(want.Filename(), func(t *testing.T) {
+			got, err := newCertPair(want.Filename())
+			if err != nil {
+				t.Fatalf("newCertPair(%v): %v", want.Filename(), err)
+			}
+			if diff := deep.Equal(want, got); diff != nil {
+				t.Errorf("newCertPair(%v): want != got %v", want.Filename(), diff)
+			}
+		})
+	}
+}
+
 type pessimisticValidator struct{}
 
 func (v *pessimisticValidator) Validate() error {
@@ -248,7 +309,7 @@ func (m mapSecretStore) Get(namespace, name string) (*v1.Secret, error) {
 func TestUpsertIngress(t *testing.T) {
 	cases := []struct {
 		name     string
-		i        *v1beta1.Ingress
+		i        *kubernetes.Ingress
 		s        kubernetes.SecretStore
 		v        Validator
 		existing map[string][]byte
@@ -262,7 +323,7 @@ func TestUpsertIngress(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 		},
 		{
@@ -273,15 +334,15 @@ func TestUpsertIngress(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			existing: map[string][]byte{
-				"ns-anotherIngress-existingSecret.pem":     []byte("cert\nkey2"),
+				"ns_anotherIngress_existingSecret.pem":     []byte("cert\nkey2"),
 				"dankCert.pem":                             []byte("sodank"),
-				"anotherns-coolIngress-existingSecret.pem": []byte("cert\nkey3"),
+				"anotherns_coolIngress_existingSecret.pem": []byte("cert\nkey3"),
 			},
 			want: map[string][]byte{
-				"ns-anotherIngress-existingSecret.pem":     []byte("cert\nkey2"),
-				"ns-coolIngress-coolSecret.pem":            []byte("cert\nkey"),
+				"ns_anotherIngress_existingSecret.pem":     []byte("cert\nkey2"),
+				"ns_coolIngress_coolSecret.pem":            coolPEM,
 				"dankCert.pem":                             []byte("sodank"),
-				"anotherns-coolIngress-existingSecret.pem": []byte("cert\nkey3"),
+				"anotherns_coolIngress_existingSecret.pem": []byte("cert\nkey3"),
 			},
 		},
 		{
@@ -292,10 +353,10 @@ func TestUpsertIngress(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			existing: map[string][]byte{
-				"ns-coolIngress-existingSecret.pem": []byte("cert\nkey1"),
+				"ns_coolIngress_existingSecret.pem": []byte("cert\nkey1"),
 			},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 		},
 		{
@@ -306,10 +367,10 @@ func TestUpsertIngress(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			existing: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("suchcert\nverykey"),
+				"ns_coolIngress_coolSecret.pem": []byte("suchcert\nverykey"),
 			},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 		},
 		{
@@ -320,10 +381,10 @@ func TestUpsertIngress(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			existing: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 		},
 		{
@@ -369,7 +430,7 @@ func TestUpsertIngress(t *testing.T) {
 				t.Fatalf("NewManager(...): %v", err)
 			}
 
-			m.OnUpdate(&v1beta1.Ingress{}, tc.i)
+			m.OnUpdate(&kubernetes.Ingress{}, tc.i)
 			got, want := sub.notified == 1, !reflect.DeepEqual(tc.existing, tc.want)
 			if got != want {
 				t.Errorf("m.OnAdd(...): changed directory content: want %v, got %v", want, got)
@@ -382,7 +443,7 @@ func TestUpsertIngress(t *testing.T) {
 func TestUpsertSecret(t *testing.T) {
 	cases := []struct {
 		name        string
-		i           *v1beta1.Ingress
+		i           *kubernetes.Ingress
 		s           *v1.Secret
 		st          kubernetes.SecretStore
 		v           Validator
@@ -396,7 +457,7 @@ func TestUpsertSecret(t *testing.T) {
 			st:   mapSecretStore{},
 			v:    &optimisticValidator{},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			wantChanges: 1,
 		},
@@ -408,14 +469,14 @@ func TestUpsertSecret(t *testing.T) {
 				metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: &v1.Secret{
 					ObjectMeta: metav1.ObjectMeta{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()},
 					Data: map[string][]byte{
-						v1.TLSCertKey:       []byte("oldcert"),
-						v1.TLSPrivateKeyKey: []byte("oldkey"),
+						v1.TLSCertKey:       dankCert,
+						v1.TLSPrivateKeyKey: dankKey,
 					},
 				},
 			},
 			v: &optimisticValidator{},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			wantChanges: 2,
 		},
@@ -428,7 +489,7 @@ func TestUpsertSecret(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			wantChanges: 1,
 		},
@@ -465,7 +526,7 @@ func TestUpsertSecret(t *testing.T) {
 			},
 			v: &optimisticValidator{},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			wantChanges: 1,
 		},
@@ -496,7 +557,7 @@ func TestUpsertSecret(t *testing.T) {
 func TestDeleteIngress(t *testing.T) {
 	cases := []struct {
 		name     string
-		i        *v1beta1.Ingress
+		i        *kubernetes.Ingress
 		s        kubernetes.SecretStore
 		existing map[string][]byte
 		want     map[string][]byte
@@ -505,18 +566,18 @@ func TestDeleteIngress(t *testing.T) {
 			name: "DeleteOnlyIngress",
 			i:    coolIngress,
 			existing: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
-				"ns-coolIngress-dankSecret.pem": []byte("anothercert\nanotherkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+				"ns_coolIngress_dankSecret.pem": []byte("anothercert\nanotherkey"),
 			},
 		},
 		{
 			name: "DeleteUnknownIngress",
 			i:    coolIngress,
 			existing: map[string][]byte{
-				"anotherns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"anotherns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			want: map[string][]byte{
-				"anotherns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"anotherns_coolIngress_coolSecret.pem": coolPEM,
 			},
 		},
 	}
@@ -545,7 +606,7 @@ func TestDeleteIngress(t *testing.T) {
 func TestDeleteSecret(t *testing.T) {
 	cases := []struct {
 		name        string
-		i           *v1beta1.Ingress
+		i           *kubernetes.Ingress
 		s           *v1.Secret
 		st          kubernetes.SecretStore
 		want        map[string][]byte
@@ -568,7 +629,7 @@ func TestDeleteSecret(t *testing.T) {
 				metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret,
 			},
 			want: map[string][]byte{
-				"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+				"ns_coolIngress_coolSecret.pem": coolPEM,
 			},
 			wantChanges: 1,
 		},
@@ -611,7 +672,7 @@ func TestUpsertDeleteUpsertSecret(t *testing.T) {
 	m.OnDelete(coolSecret)
 	m.OnAdd(coolSecret)
 	validate(t, fs, dir, map[string][]byte{
-		"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+		"ns_coolIngress_coolSecret.pem": coolPEM,
 	})
 }
 
@@ -632,7 +693,7 @@ func TestUpsertDeleteUpsertIngress(t *testing.T) {
 	m.OnDelete(coolIngress)
 	m.OnAdd(coolIngress)
 	validate(t, fs, dir, map[string][]byte{
-		"ns-coolIngress-coolSecret.pem": []byte("cert\nkey"),
+		"ns_coolIngress_coolSecret.pem": coolPEM,
 	})
 }
 
@@ -666,8 +727,8 @@ func TestAllowHTTP(t *testing.T) {
 func TestForceHTTPHosts(t *testing.T) {
 	cases := []struct {
 		name         string
-		i            *v1beta1.Ingress
-		iu           *v1beta1.Ingress
+		i            *kubernetes.Ingress
+		iu           *kubernetes.Ingress
 		s            *v1.Secret
 		st           kubernetes.SecretStore
 		want         string
@@ -740,3 +801,671 @@ func TestForceHTTPHosts(t *testing.T) {
 		})
 	}
 }
+
+func TestForceHTTPSTableRedirectBytes(t *testing.T) {
+	type mark struct {
+		name  string
+		code  int
+		force bool
+		hosts []string
+	}
+	cases := []struct {
+		name     string
+		marks    []mark
+		want     string
+		wantDeny string
+	}{
+		{
+			name: "RedirectedAndDenied",
+			marks: []mark{
+				{name: "a", code: 308, force: true, hosts: []string{"b.example.com", "a.example.com"}},
+				{name: "b", force: true, hosts: []string{"c.example.com"}},
+			},
+			want:     "a.example.com 308\nb.example.com 308",
+			wantDeny: "c.example.com",
+		},
+		{
+			name: "LowestCodeWins",
+			marks: []mark{
+				{name: "a", code: 308, force: true, hosts: []string{"a.example.com"}},
+				{name: "b", code: 301, force: true, hosts: []string{"a.example.com"}},
+			},
+			want:     "a.example.com 301",
+			wantDeny: "",
+		},
+		{
+			name: "DenyWins",
+			marks: []mark{
+				{name: "a", code: 301, force: true, hosts: []string{"a.example.com"}},
+				{name: "b", force: true, hosts: []string{"a.example.com"}},
+			},
+			want:     "",
+			wantDeny: "a.example.com",
+		},
+		{
+			name: "NotForced",
+			marks: []mark{
+				{name: "a", code: 301, hosts: []string{"a.example.com"}},
+			},
+			want:     "",
+			wantDeny: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tbl := forceHTTPSTable{hostMapTable{}}
+			for _, m := range tc.marks {
+				tbl.MarkForceHTTPS("ns", m.name, m.force, m.code, m.hosts)
+			}
+			if got := string(tbl.RedirectBytes()); got != tc.want {
+				t.Errorf("t.RedirectBytes(): want %q, got %q", tc.want, got)
+			}
+			if got := string(tbl.Bytes()); got != tc.wantDeny {
+				t.Errorf("t.Bytes(): want %q, got %q", tc.wantDeny, got)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirectHosts(t *testing.T) {
+	withRedirect := func(annotations map[string]string) *kubernetes.Ingress {
+		return &kubernetes.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress", Annotations: annotations},
+			Spec: kubernetes.IngressSpec{
+				Rules: []kubernetes.IngressRule{{Host: "example.com"}, {Host: "acme.com"}},
+				TLS:   []kubernetes.IngressTLS{{SecretName: coolSecret.GetName()}},
+			},
+		}
+	}
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	shared := populate(t, fs, nil)
+	deny := filepath.Join(shared, "force-https-hosts.lst")
+	redirect := filepath.Join(shared, "https-redirect-hosts.map")
+
+	sub := &testSubscriber{}
+	m, err := NewManager(dir,
+		mapSecretStore{metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret},
+		WithFilesystem(fs),
+		WithSubscriber(sub),
+		WithForceHTTPSHostsFile(deny),
+		WithHTTPSRedirectHostsFile(redirect))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	steps := []struct {
+		name         string
+		i            *kubernetes.Ingress
+		want         string
+		wantDeny     string
+		wantNotified int
+	}{
+		{
+			name:         "Redirect",
+			i:            withRedirect(map[string]string{annoSSLRedirect: "true"}),
+			want:         "acme.com 301\nexample.com 301",
+			wantNotified: 1,
+		},
+		{
+			name:         "RedirectCode",
+			i:            withRedirect(map[string]string{annoSSLRedirect: "true", annoSSLRedirectCode: "308"}),
+			want:         "acme.com 308\nexample.com 308",
+			wantNotified: 2,
+		},
+		{
+			name:         "InvalidRedirectCode",
+			i:            withRedirect(map[string]string{annoSSLRedirect: "true", annoSSLRedirectCode: "200"}),
+			want:         "acme.com 301\nexample.com 301",
+			wantNotified: 3,
+		},
+		{
+			name:         "Deny",
+			i:            withRedirect(map[string]string{annoAllowHTTP: "false"}),
+			wantDeny:     "acme.com\nexample.com",
+			wantNotified: 4,
+		},
+		{
+			name:         "Allow",
+			i:            withRedirect(nil),
+			wantNotified: 5,
+		},
+	}
+
+	for _, s := range steps {
+		m.OnAdd(s.i)
+		validate(t, fs, shared, map[string][]byte{
+			filepath.Base(deny):     []byte(s.wantDeny),
+			filepath.Base(redirect): []byte(s.want),
+		})
+		if sub.notified != s.wantNotified {
+			t.Errorf("%v: want %v notifications, got %v", s.name, s.wantNotified, sub.notified)
+		}
+	}
+}
+
+type mapIngressClassStore map[string]*kubernetes.IngressClass
+
+func (m mapIngressClassStore) Get(name string) (*kubernetes.IngressClass, error) {
+	c, ok := m[name]
+	if !ok {
+		return nil, errors.New("no such ingress class")
+	}
+	return c, nil
+}
+
+func classedIngress(annotation, className string) *kubernetes.Ingress {
+	i := &kubernetes.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress", Annotations: map[string]string{}},
+		Spec: kubernetes.IngressSpec{
+			IngressClassName: className,
+			TLS:              []kubernetes.IngressTLS{{SecretName: coolSecret.GetName()}},
+		},
+	}
+	if annotation != "" {
+		i.Annotations[annoIngressClass] = annotation
+	}
+	return i
+}
+
+func TestIngressClass(t *testing.T) {
+	classes := mapIngressClassStore{
+		"ours":   &kubernetes.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: "ours"}, Controller: "example.org/hal5d"},
+		"theirs": &kubernetes.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: "theirs"}, Controller: "example.org/nginx"},
+	}
+	cases := []struct {
+		name    string
+		classes []string
+		i       *kubernetes.Ingress
+		want    bool
+	}{
+		{
+			name: "NoClassesConfigured",
+			i:    classedIngress("nginx", ""),
+			want: true,
+		},
+		{
+			name:    "AnnotationMatches",
+			classes: []string{"haproxy"},
+			i:       classedIngress("haproxy", ""),
+			want:    true,
+		},
+		{
+			name:    "AnnotationDoesNotMatch",
+			classes: []string{"haproxy"},
+			i:       classedIngress("nginx", ""),
+			want:    false,
+		},
+		{
+			name:    "AnnotationTakesPrecedence",
+			classes: []string{"haproxy"},
+			i:       classedIngress("nginx", "haproxy"),
+			want:    false,
+		},
+		{
+			name:    "IngressClassNameMatches",
+			classes: []string{"haproxy"},
+			i:       classedIngress("", "haproxy"),
+			want:    true,
+		},
+		{
+			name:    "IngressClassControllerMatches",
+			classes: []string{"haproxy"},
+			i:       classedIngress("", "ours"),
+			want:    true,
+		},
+		{
+			name:    "IngressClassControllerDoesNotMatch",
+			classes: []string{"haproxy"},
+			i:       classedIngress("", "theirs"),
+			want:    false,
+		},
+		{
+			name:    "NoClass",
+			classes: []string{"haproxy"},
+			i:       classedIngress("", ""),
+			want:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, nil)
+
+			st := mapSecretStore{
+				metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret,
+			}
+			m, err := NewManager(dir, st,
+				WithFilesystem(fs),
+				WithIngressClasses(tc.classes...),
+				WithIngressClassController(classes, "example.org/hal5d"))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			m.OnAdd(tc.i)
+			want := map[string][]byte{}
+			if tc.want {
+				want["ns_coolIngress_coolSecret.pem"] = coolPEM
+			}
+			validate(t, fs, dir, want)
+		})
+	}
+}
+
+func TestIngressClassChanged(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, map[string][]byte{"ns_otherIngress_coolSecret.pem": coolPEM})
+
+	st := mapSecretStore{
+		metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret,
+	}
+	sub := &testSubscriber{}
+	m, err := NewManager(dir, st, WithFilesystem(fs), WithSubscriber(sub), WithIngressClasses("haproxy"))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	// Ingresses that were never managed are not handled as deletions.
+	other := classedIngress("nginx", "")
+	other.Name = "otherIngress"
+	m.OnAdd(other)
+	stale := map[string][]byte{"ns_otherIngress_coolSecret.pem": coolPEM}
+	validate(t, fs, dir, stale)
+
+	m.OnAdd(classedIngress("haproxy", ""))
+	validate(t, fs, dir, map[string][]byte{
+		"ns_coolIngress_coolSecret.pem":  coolPEM,
+		"ns_otherIngress_coolSecret.pem": coolPEM,
+	})
+
+	m.OnUpdate(classedIngress("haproxy", ""), classedIngress("nginx", ""))
+	validate(t, fs, dir, stale)
+
+	// The secret should no longer be considered referenced by the ingress.
+	m.OnUpdate(coolSecret, coolSecret)
+	validate(t, fs, dir, stale)
+
+	if sub.notified != 2 {
+		t.Errorf("expected to be notified 2 times, notified %v times", sub.notified)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	hyphenated := &kubernetes.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "my-ingress"},
+		Spec:       kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{{SecretName: "my-tls"}}},
+	}
+	cases := []struct {
+		name      string
+		ingresses []*kubernetes.Ingress
+		existing  map[string][]byte
+		want      map[string][]byte
+	}{
+		{
+			name:      "MigrateLegacyCertPairs",
+			ingresses: []*kubernetes.Ingress{coolIngress, hyphenated},
+			existing: map[string][]byte{
+				"ns-coolIngress-coolSecret.pem": coolPEM,
+				"team-a-my-ingress-my-tls.pem":  []byte("cert\nkey2"),
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+				"team-a_my-ingress_my-tls.pem":  []byte("cert\nkey2"),
+			},
+		},
+		{
+			name:      "IgnoreCurrentCertPairs",
+			ingresses: []*kubernetes.Ingress{coolIngress},
+			existing: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+		},
+		{
+			name:      "IgnoreUnknownLegacyCertPairs",
+			ingresses: []*kubernetes.Ingress{coolIngress},
+			existing: map[string][]byte{
+				"ns-deletedIngress-coolSecret.pem": coolPEM,
+				"dankCert.pem":                     []byte("sodank"),
+			},
+			want: map[string][]byte{
+				"ns-deletedIngress-coolSecret.pem": coolPEM,
+				"dankCert.pem":                     []byte("sodank"),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, tc.existing)
+
+			m, err := NewManager(dir, mapSecretStore{}, WithFilesystem(fs))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			m.Migrate(tc.ingresses)
+			validate(t, fs, dir, tc.want)
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	cases := []struct {
+		name         string
+		ingresses    []*kubernetes.Ingress
+		existing     map[string][]byte
+		invalid      bool
+		want         map[string][]byte
+		wantNotified int
+	}{
+		{
+			name:      "RemoveStaleFiles",
+			ingresses: []*kubernetes.Ingress{coolIngress},
+			existing: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem":        coolPEM,
+				"ns_deletedIngress_coolSecret.pem":     coolPEM,
+				"ns_coolIngress_coolSecret.pem4815162": []byte("cert\nk"),
+				"dankCert.pem":                         []byte("sodank"),
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+			wantNotified: 1,
+		},
+		{
+			name:      "AlreadyReconciled",
+			ingresses: []*kubernetes.Ingress{coolIngress},
+			existing: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+			want: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+		},
+		{
+			name: "NoIngresses",
+			existing: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+			wantNotified: 1,
+		},
+		{
+			name:      "RemoveStaleFilesWithInvalidConfig",
+			ingresses: []*kubernetes.Ingress{coolIngress},
+			existing: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem":    coolPEM,
+				"ns_deletedIngress_coolSecret.pem": coolPEM,
+			},
+			invalid: true,
+			want: map[string][]byte{
+				"ns_coolIngress_coolSecret.pem": coolPEM,
+			},
+			wantNotified: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, tc.existing)
+
+			sub := &testSubscriber{}
+			o := []ManagerOption{WithFilesystem(fs), WithSubscriber(sub)}
+			if tc.invalid {
+				o = append(o, WithValidator(&pessimisticValidator{}))
+			}
+			m, err := NewManager(dir, mapSecretStore{}, o...)
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			m.Reconcile(tc.ingresses)
+			if sub.notified != tc.wantNotified {
+				t.Errorf("m.Reconcile(...): want %v notifications, got %v", tc.wantNotified, sub.notified)
+			}
+			validate(t, fs, dir, tc.want)
+		})
+	}
+}
+
+func TestReconcileForceHTTPSHosts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	shared := populate(t, fs, map[string][]byte{
+		"force-https-hosts.lst":      []byte("stale.com"),
+		"https-only-tempfile8675309": []byte("crashed"),
+	})
+
+	sub := &testSubscriber{}
+	m, err := NewManager(dir, mapSecretStore{},
+		WithFilesystem(fs),
+		WithSubscriber(sub),
+		WithForceHTTPSHostsFile(filepath.Join(shared, "force-https-hosts.lst")))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	m.Reconcile([]*kubernetes.Ingress{coolIngressWithNoHTTPAllowed})
+	if sub.notified != 1 {
+		t.Errorf("m.Reconcile(...): want 1 notification, got %v", sub.notified)
+	}
+	validate(t, fs, shared, map[string][]byte{
+		"force-https-hosts.lst": []byte("acme.com\nexample.com"),
+	})
+
+	// Subsequent updates to the reconciled ingress should not change anything.
+	m.OnAdd(coolIngressWithNoHTTPAllowed)
+	if sub.notified != 1 {
+		t.Errorf("m.OnAdd(...): want 1 notification, got %v", sub.notified)
+	}
+}
+
+// A contentValidator fails validation if any file in its directory contains
+// invalid content.
+type contentValidator struct {
+	fs        afero.Fs
+	dir       string
+	invalid   []byte
+	validated int
+}
+
+func (v *contentValidator) Validate() error {
+	v.validated++
+	fi, err := afero.ReadDir(v.fs, v.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range fi {
+		b, err := afero.ReadFile(v.fs, filepath.Join(v.dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(b, v.invalid) {
+			return errors.Errorf("%v is invalid", f.Name())
+		}
+	}
+	return nil
+}
+
+// A stagedValidator validates the TLS directory as haproxy loads it, skipping
+// dotfiles. It rejects the configuration if it contains a staged cert pair.
+type stagedValidator struct {
+	fs     afero.Fs
+	dir    string
+	reject bool
+	staged []string
+}
+
+func (v *stagedValidator) Validate() error {
+	fi, err := afero.ReadDir(v.fs, v.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range fi {
+		if strings.HasPrefix(f.Name(), ".") || !strings.HasPrefix(f.Name(), StagedCertPairPrefix) {
+			continue
+		}
+		v.staged = append(v.staged, strings.TrimRight(f.Name(), "0123456789"))
+		if v.reject {
+			return errors.Errorf("%v is invalid", f.Name())
+		}
+	}
+	return nil
+}
+
+func TestWriteValidatesStagedCertPair(t *testing.T) {
+	cases := []struct {
+		name   string
+		reject bool
+		want   []string
+	}{
+		{name: "Valid", want: []string{"ns_coolIngress_coolSecret.pem"}},
+		{name: "Invalid", reject: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, nil)
+			v := &stagedValidator{fs: fs, dir: dir, reject: tc.reject}
+			m, err := NewManager(dir,
+				mapSecretStore{metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret},
+				WithFilesystem(fs),
+				WithValidator(v))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+			m.OnAdd(coolIngress)
+
+			if diff := deep.Equal([]string{StagedCertPairPrefix + "ns_coolIngress_coolSecret.pem"}, v.staged); diff != nil {
+				t.Errorf("validator: want != got staged cert pairs %v", diff)
+			}
+			fi, err := afero.ReadDir(fs, dir)
+			if err != nil {
+				t.Fatalf("cannot read TLS dir: %v", err)
+			}
+			var got []string
+			for _, f := range fi {
+				got = append(got, f.Name())
+			}
+			if diff := deep.Equal(tc.want, got); diff != nil {
+				t.Errorf("want != got cert pairs %v", diff)
+			}
+		})
+	}
+}
+
+func TestReconcileBatch(t *testing.T) {
+	cases := []struct {
+		name          string
+		count         int
+		invalid       map[int]bool
+		existing      map[int]bool
+		wantPairs     int
+		wantNotified  int
+		maxValidation int
+	}{
+		{
+			name:          "AllValid",
+			count:         100,
+			wantPairs:     100,
+			wantNotified:  1,
+			maxValidation: 1,
+		},
+		{
+			name:          "SomeInvalid",
+			count:         100,
+			invalid:       map[int]bool{7: true, 42: true},
+			wantPairs:     98,
+			wantNotified:  1,
+			maxValidation: 30,
+		},
+		{
+			name:          "AllInvalid",
+			count:         4,
+			invalid:       map[int]bool{0: true, 1: true, 2: true, 3: true},
+			maxValidation: 9,
+		},
+		{
+			name:      "AlreadyWritten",
+			count:     1,
+			existing:  map[int]bool{0: true},
+			wantPairs: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ingresses := []*kubernetes.Ingress{}
+			secrets := mapSecretStore{}
+			existing := map[string][]byte{}
+			want := map[string][]byte{}
+			for n := 0; n < tc.count; n++ {
+				cp := certPair{Namespace: "ns", IngressName: fmt.Sprintf("ingress%d", n), SecretName: fmt.Sprintf("secret%d", n)}
+				ingresses = append(ingresses, &kubernetes.Ingress{
+					ObjectMeta: metav1.ObjectMeta{Namespace: cp.Namespace, Name: cp.IngressName},
+					Spec:       kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{{SecretName: cp.SecretName}}},
+				})
+
+				// The validator rejects the invalid cert pairs, which are
+				// nonetheless well formed.
+				cert, key := newTestCertPair(time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+				if tc.invalid[n] {
+					cert = append(cert, []byte("invalid")...)
+				}
+				secrets[metadata{Namespace: cp.Namespace, Name: cp.SecretName}] = &v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: cp.Namespace, Name: cp.SecretName},
+					Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+				}
+
+				cd := certData{certPair: cp, Cert: cert, Key: key}
+				if tc.existing[n] {
+					existing[cp.Filename()] = cd.Bytes()
+				}
+				if !tc.invalid[n] {
+					want[cp.Filename()] = cd.Bytes()
+				}
+			}
+
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, existing)
+
+			sub := &testSubscriber{}
+			v := &contentValidator{fs: fs, dir: dir, invalid: []byte("invalid")}
+			m, err := NewManager(dir, secrets, WithFilesystem(fs), WithValidator(v), WithSubscriber(sub))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			m.Reconcile(ingresses)
+			if sub.notified != tc.wantNotified {
+				t.Errorf("m.Reconcile(...): want %v notifications, got %v", tc.wantNotified, sub.notified)
+			}
+			if v.validated > tc.maxValidation {
+				t.Errorf("m.Reconcile(...): want at most %v validations, got %v", tc.maxValidation, v.validated)
+			}
+
+			if len(want) != tc.wantPairs {
+				t.Fatalf("test case wants %v cert pairs, but expects %v", len(want), tc.wantPairs)
+			}
+			validate(t, fs, dir, want)
+
+			// Handling the reconciled ingresses should not write anything.
+			validated := v.validated
+			for _, i := range ingresses {
+				m.OnAdd(i)
+			}
+			if got := v.validated - validated; got != len(tc.invalid) {
+				t.Errorf("m.OnAdd(...): want %v validations, got %v", len(tc.invalid), got)
+			}
+		})
+	}
+}
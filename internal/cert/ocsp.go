@@ -0,0 +1,290 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Defaults used by new OCSP staplers.
+const (
+	DefaultOCSPRefreshInterval = 1 * time.Hour
+)
+
+// ocspSuffix is appended to a cert pair's filename to name the file containing
+// the OCSP response haproxy staples to its leaf certificate.
+const ocspSuffix = ".ocsp"
+
+// An OCSPResponder answers OCSP requests.
+type OCSPResponder interface {
+	// Respond sends the supplied DER encoded OCSP request to the supplied
+	// OCSP server, and returns its DER encoded response.
+	Respond(server string, request []byte) ([]byte, error)
+}
+
+// An OCSPStapler periodically fetches OCSP responses for the cert pairs
+// managed by a certificate manager, and writes each next to the cert pair it
+// describes such that haproxy will staple it. Responses are refreshed once
+// half of their validity period has elapsed, well before their NextUpdate.
+// An OCSPStapler is a Subscriber; it checks for cert pairs that need a
+// response every time the managed cert pairs change.
+type OCSPStapler struct {
+	m        *Manager
+	r        OCSPResponder
+	interval time.Duration
+	changed  chan struct{}
+	failed   map[certPair]string
+}
+
+// NewOCSPStapler creates a new OCSP stapler that fetches responses from the
+// supplied responder, checking whether any need refreshing every interval.
+// The stapler must be registered with a certificate manager using
+// WithOCSPStapler.
+func NewOCSPStapler(r OCSPResponder, interval time.Duration) (*OCSPStapler, error) {
+	if interval <= 0 {
+		return nil, errors.Errorf("OCSP refresh interval %v must be positive", interval)
+	}
+	return &OCSPStapler{r: r, interval: interval, changed: make(chan struct{}, 1), failed: make(map[certPair]string)}, nil
+}
+
+// Changed triggers a check for cert pairs that need an OCSP response. It does
+// not block.
+func (s *OCSPStapler) Changed() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks for cert pairs that need an OCSP response every interval, and
+// every time the managed cert pairs change, until the provided stop channel is
+// closed.
+func (s *OCSPStapler) Run(stop <-chan struct{}) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		s.Check()
+		select {
+		case <-t.C:
+		case <-s.changed:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check the cert pairs currently on disk, fetching an OCSP response for each
+// that does not have a fresh one. Responses for cert pairs that no longer
+// exist are removed. Subscribers other than the stapler are notified if any
+// responses are written.
+func (s *OCSPStapler) Check() {
+	m := s.m
+	fi, err := afero.ReadDir(m.fs, m.tlsDir)
+	if err != nil {
+		m.log.Error("cannot list TLS cert pairs - not stapling OCSP responses", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextStapleOCSP}).Inc()
+		return
+	}
+
+	exists := make(map[string]bool)
+	for _, f := range fi {
+		exists[f.Name()] = true
+	}
+
+	written := false
+	seen := make(map[certPair]bool)
+	for _, f := range fi {
+		if name := strings.TrimSuffix(f.Name(), ocspSuffix); name != f.Name() {
+			if _, err := newCertPair(name); err == nil && !exists[name] {
+				s.removeOrphan(f.Name())
+			}
+			continue
+		}
+		cp, err := newCertPair(f.Name())
+		if err != nil {
+			continue
+		}
+		seen[cp] = true
+		if s.staple(cp) {
+			written = true
+		}
+	}
+
+	for cp := range s.failed {
+		if !seen[cp] {
+			delete(s.failed, cp)
+		}
+	}
+
+	if !written {
+		return
+	}
+	for _, sub := range m.subscribers {
+		if sub != Subscriber(s) {
+			sub.Changed()
+		}
+	}
+}
+
+// staple ensures the supplied cert pair has a fresh OCSP response, returning
+// true if a new response was written.
+func (s *OCSPStapler) staple(cp certPair) bool {
+	m := s.m
+	log := m.log.With(
+		zap.String(LabelNamespace, cp.Namespace),
+		zap.String(LabelIngressName, cp.IngressName),
+		zap.String(LabelSecretName, cp.SecretName))
+
+	path := filepath.Join(m.tlsDir, cp.Filename())
+	b, err := afero.ReadFile(m.fs, path)
+	if err != nil {
+		log.Error("cannot read cert pair", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextStapleOCSP}).Inc()
+		return false
+	}
+	chain, err := parseCertificates(b)
+	if err != nil {
+		log.Debug("cannot parse cert pair - not stapling OCSP response", zap.Error(err))
+		return false
+	}
+	leaf := chain[0]
+	if len(leaf.OCSPServer) == 0 {
+		log.Debug("certificate has no OCSP server - not stapling OCSP response")
+		return false
+	}
+	if len(chain) < 2 {
+		s.fail(log, cp, errors.New("certificate chain does not include the issuer of the leaf certificate"))
+		return false
+	}
+	issuer := chain[1]
+
+	now := m.now()
+	if existing, err := afero.ReadFile(m.fs, path+ocspSuffix); err == nil {
+		if rsp, err := ocsp.ParseResponseForCert(existing, leaf, issuer); err == nil && fresh(rsp, now) {
+			log.Debug("OCSP response is fresh")
+			return false
+		}
+	}
+
+	der, err := s.fetch(leaf, issuer, now)
+	if err != nil {
+		s.fail(log, cp, err)
+		return false
+	}
+	// haproxy ignores dotfiles in the TLS directory, so it will never try to
+	// load the temporary file as a cert pair.
+	if err := m.writeAtomically(path+ocspSuffix, "."+cp.Filename()+ocspSuffix, der); err != nil {
+		log.Error("cannot write OCSP response", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextStapleOCSP}).Inc()
+		return false
+	}
+	delete(s.failed, cp)
+	log.Debug("wrote OCSP response")
+	return true
+}
+
+// fetch requests an OCSP response for the supplied leaf certificate from each
+// of its OCSP servers in turn, returning the first response that verifies
+// against the supplied issuer and reports the certificate as good.
+func (s *OCSPStapler) fetch(leaf, issuer *x509.Certificate, now time.Time) ([]byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create OCSP request")
+	}
+	err = errors.New("certificate has no OCSP server")
+	for _, server := range leaf.OCSPServer {
+		var der []byte
+		der, err = s.r.Respond(server, req)
+		if err != nil {
+			err = errors.Wrapf(err, "cannot get OCSP response from %v", server)
+			continue
+		}
+		var rsp *ocsp.Response
+		rsp, err = ocsp.ParseResponseForCert(der, leaf, issuer)
+		if err != nil {
+			err = errors.Wrapf(err, "cannot verify OCSP response from %v", server)
+			continue
+		}
+		switch {
+		case rsp.Status == ocsp.Revoked:
+			return nil, errors.Errorf("certificate was revoked at %s", rsp.RevokedAt.UTC().Format(time.RFC3339))
+		case rsp.Status != ocsp.Good:
+			err = errors.Errorf("OCSP server %v does not know the certificate", server)
+			continue
+		case !rsp.NextUpdate.IsZero() && !now.Before(rsp.NextUpdate):
+			err = errors.Errorf("OCSP response from %v expired at %s", server, rsp.NextUpdate.UTC().Format(time.RFC3339))
+			continue
+		}
+		return der, nil
+	}
+	return nil, err
+}
+
+// fail reports a failure to staple an OCSP response to the supplied cert pair.
+// Each distinct failure is recorded as an event once.
+func (s *OCSPStapler) fail(log *zap.Logger, cp certPair, err error) {
+	log.Info("cannot staple OCSP response", zap.Error(err))
+	s.m.metric.OCSPFailures.With(prometheus.Labels{
+		LabelNamespace:   cp.Namespace,
+		LabelIngressName: cp.IngressName,
+		LabelSecretName:  cp.SecretName,
+	}).Inc()
+	if s.failed[cp] == err.Error() {
+		return
+	}
+	s.failed[cp] = err.Error()
+	s.m.recorder.NewOCSPFailure(cp.Namespace, cp.IngressName, cp.SecretName, err.Error())
+}
+
+func (s *OCSPStapler) removeOrphan(filename string) {
+	if err := s.m.fs.Remove(filepath.Join(s.m.tlsDir, filename)); err != nil {
+		s.m.log.Error("cannot remove orphaned OCSP response", zap.String("filename", filename), zap.Error(err))
+		s.m.metric.Errors.With(prometheus.Labels{LabelContext: ContextStapleOCSP}).Inc()
+		return
+	}
+	s.m.log.Debug("removed orphaned OCSP response", zap.String("filename", filename))
+}
+
+// fresh returns true if less than half of the supplied OCSP response's
+// validity period has elapsed. Responses without a NextUpdate are never fresh.
+func fresh(rsp *ocsp.Response, now time.Time) bool {
+	if rsp.NextUpdate.IsZero() {
+		return false
+	}
+	return now.Before(rsp.ThisUpdate.Add(rsp.NextUpdate.Sub(rsp.ThisUpdate) / 2))
+}
+
+// removeOCSPResponse removes the OCSP response stapled to the supplied cert
+// pair, if any. It is called whenever a cert pair is rewritten or removed, so
+// that a response never describes a certificate other than the one it is
+// stapled to.
+func (m *Manager) removeOCSPResponse(cp certPair) {
+	path := filepath.Join(m.tlsDir, cp.Filename()+ocspSuffix)
+	if err := m.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		m.log.Error("cannot remove OCSP response", zap.String("filename", path), zap.Error(err))
+	}
+}
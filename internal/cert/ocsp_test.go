@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/event"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ocsp"
+)
+
+const testOCSPServer = "http://ocsp.example.org"
+
+// newTestChain returns a PEM encoded leaf certificate and private key, and the
+// certificate and private key of the CA that issued it. The leaf certificate
+// directs OCSP requests to testOCSPServer.
+func newTestChain(notBefore, notAfter time.Time) ([]byte, []byte, *x509.Certificate, crypto.Signer) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hal5d test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "hal5d test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		OCSPServer:   []string{testOCSPServer},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+	k, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	chain := append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), ca, caKey
+}
+
+// A testResponder signs OCSP responses with the supplied CA. Each response
+// is valid for four hours from the time returned by now.
+type testResponder struct {
+	ca     *x509.Certificate
+	key    crypto.Signer
+	now    func() time.Time
+	status int
+	calls  int
+}
+
+func (r *testResponder) Respond(server string, request []byte) ([]byte, error) {
+	r.calls++
+	req, err := ocsp.ParseRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	now := r.now().Truncate(time.Second)
+	return ocsp.CreateResponse(r.ca, r.ca, ocsp.Response{
+		Status:       r.status,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(4 * time.Hour),
+		RevokedAt:    r.ca.NotBefore,
+	}, r.key)
+}
+
+type ocspRecorder struct {
+	event.NopRecorder
+	events []string
+}
+
+func (r *ocspRecorder) NewOCSPFailure(namespace, ingressName, secretName, reason string) {
+	r.events = append(r.events, "OCSPFailure "+namespace+"/"+ingressName+"/"+secretName)
+}
+
+func TestOCSPStapler(t *testing.T) {
+	start := time.Now()
+	chain, key, ca, caKey := newTestChain(start.Add(-1*time.Hour), start.Add(90*24*time.Hour))
+	pem := func(cert, key []byte) []byte { return bytes.Join([][]byte{cert, key}, []byte("\n")) }
+
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, map[string][]byte{
+		"ns_coolIngress_coolSecret.pem":      pem(chain, key),
+		"ns_dankIngress_dankSecret.pem":      pem(dankCert, dankKey),
+		"ns_goneIngress_goneSecret.pem.ocsp": []byte("orphaned"),
+	})
+
+	now := start
+	rsp := &testResponder{ca: ca, key: caKey, now: func() time.Time { return now }, status: ocsp.Good}
+	s, err := NewOCSPStapler(rsp, DefaultOCSPRefreshInterval)
+	if err != nil {
+		t.Fatalf("NewOCSPStapler(...): %v", err)
+	}
+	r := &ocspRecorder{}
+	sub := &testSubscriber{}
+	m, err := NewManager(dir, mapSecretStore{}, WithFilesystem(fs), WithEventRecorder(r), WithSubscriber(sub), WithOCSPStapler(s))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	m.now = func() time.Time { return now }
+
+	steps := []struct {
+		name         string
+		elapsed      time.Duration
+		status       int
+		wantCalls    int
+		wantNotified int
+		want         []string
+	}{
+		{name: "Staple", elapsed: 0, status: ocsp.Good, wantCalls: 1, wantNotified: 1},
+		{name: "Fresh", elapsed: 1 * time.Hour, status: ocsp.Good, wantCalls: 1, wantNotified: 1},
+		{name: "Refresh", elapsed: 3 * time.Hour, status: ocsp.Good, wantCalls: 2, wantNotified: 2},
+		{name: "Revoked", elapsed: 6 * time.Hour, status: ocsp.Revoked, wantCalls: 3, wantNotified: 2, want: []string{"OCSPFailure ns/coolIngress/coolSecret"}},
+		{name: "RevokedAgain", elapsed: 7 * time.Hour, status: ocsp.Revoked, wantCalls: 4, wantNotified: 2},
+	}
+
+	for _, st := range steps {
+		t.Run(st.name, func(t *testing.T) {
+			r.events = nil
+			now = start.Add(st.elapsed)
+			rsp.status = st.status
+			s.Check()
+
+			if rsp.calls != st.wantCalls {
+				t.Errorf("s.Check(): want %d OCSP requests, got %d", st.wantCalls, rsp.calls)
+			}
+			if sub.notified != st.wantNotified {
+				t.Errorf("s.Check(): want %d subscriber notifications, got %d", st.wantNotified, sub.notified)
+			}
+			if diff := deep.Equal(st.want, r.events); diff != nil {
+				t.Errorf("s.Check(): want != got %v", diff)
+			}
+		})
+	}
+
+	exists := func(filename string) bool {
+		ok, err := afero.Exists(fs, filepath.Join(dir, filename))
+		if err != nil {
+			t.Fatalf("afero.Exists(%v): %v", filename, err)
+		}
+		return ok
+	}
+	for filename, want := range map[string]bool{
+		"ns_coolIngress_coolSecret.pem.ocsp": true,
+		"ns_dankIngress_dankSecret.pem.ocsp": false,
+		"ns_goneIngress_goneSecret.pem.ocsp": false,
+	} {
+		if got := exists(filename); got != want {
+			t.Errorf("%v exists: want %v, got %v", filename, want, got)
+		}
+	}
+
+	// A cert pair's OCSP response is removed along with the cert pair.
+	m.forget(certPair{Namespace: "ns", IngressName: "coolIngress", SecretName: "coolSecret"})
+	if exists("ns_coolIngress_coolSecret.pem.ocsp") {
+		t.Errorf("m.forget(...): OCSP response was not removed")
+	}
+}
+
+func TestInvalidOCSPStapler(t *testing.T) {
+	if _, err := NewOCSPStapler(&testResponder{}, 0); err == nil {
+		t.Errorf("NewOCSPStapler(...): want error for zero interval")
+	}
+}
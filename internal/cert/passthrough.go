@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// Passes TLS connections to the ingress' hosts through to an haproxy
+	// backend without terminating them when true. The ingress' TLS secrets are
+	// never written to disk.
+	annoSSLPassthrough = "hal5d.planetlabs.com/ssl-passthrough"
+
+	// The haproxy backend to which TLS connections to a passthrough ingress'
+	// hosts are passed. Defaults to <namespace>_<ingress name>.
+	annoSSLPassthroughBackend = "hal5d.planetlabs.com/ssl-passthrough-backend"
+
+	passthroughTempFilePrefix = "passthrough-hosts-tempfile"
+)
+
+// haproxy backend names may contain only these characters.
+var validBackendName = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// passthrough returns true if the supplied ingress passes TLS connections
+// through rather than terminating them.
+func passthrough(i *kubernetes.Ingress) bool {
+	return strings.ToLower(strings.TrimSpace(i.GetAnnotations()[annoSSLPassthrough])) == "true"
+}
+
+// passthroughBackend returns the haproxy backend to which TLS connections to
+// the supplied passthrough ingress' hosts should be passed. The default backend
+// is returned along with an error if the annotated backend is invalid.
+func passthroughBackend(i *kubernetes.Ingress) (string, error) {
+	def := i.GetNamespace() + "_" + i.GetName()
+	v, ok := i.GetAnnotations()[annoSSLPassthroughBackend]
+	if !ok {
+		return def, nil
+	}
+	if v = strings.TrimSpace(v); !validBackendName.MatchString(v) {
+		return def, errors.Errorf("invalid haproxy backend name %q", v)
+	}
+	return v, nil
+}
+
+// newPassthroughHosts returns a host map of the SNI hostnames of ingresses that
+// pass TLS through to the backend their connections should be passed to.
+// Ingresses with an invalid backend annotation use their default backend.
+func newPassthroughHosts() *hostMap {
+	return &hostMap{
+		hostMapTable:   hostMapTable{},
+		Name:           "TLS passthrough host map",
+		Annotation:     annoSSLPassthroughBackend,
+		tempFilePrefix: passthroughTempFilePrefix,
+		entries: func(i *kubernetes.Ingress) (map[string]string, error) {
+			if !passthrough(i) {
+				return nil, nil
+			}
+			b, err := passthroughBackend(i)
+			return hostEntries(passthroughHosts(i), b), err
+		},
+	}
+}
+
+// passthroughHosts returns the hosts of the supplied ingress that should be
+// passed through; its rule hosts and TLS hosts.
+func passthroughHosts(i *kubernetes.Ingress) []string {
+	seen := make(map[string]bool)
+	hosts := []string{}
+	for _, h := range collectHosts(i) {
+		if !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	for _, tls := range i.Spec.TLS {
+		for _, h := range tls.Hosts {
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// passthroughConflicts returns the hosts of the supplied ingress that are
+// passed through by one ingress, and terminated by another. Hosts of a
+// passthrough ingress conflict with the hosts the cert pairs of other ingresses
+// are expected to serve, while hosts of a terminating ingress conflict with the
+// hosts other ingresses pass through.
+func (m *Manager) passthroughConflicts(namespace, ingressName string) []string {
+	md := metadata{Namespace: namespace, Name: ingressName}
+	terminated := func(own bool) map[string]bool {
+		hosts := make(map[string]bool)
+		for cp, hs := range m.certHosts {
+			if (cp.Namespace == namespace && cp.IngressName == ingressName) != own {
+				continue
+			}
+			for _, h := range hs {
+				hosts[h] = true
+			}
+		}
+		return hosts
+	}
+
+	var mine, theirs map[string]bool
+	if entries, ok := m.passthroughs.hostMapTable[md]; ok {
+		mine, theirs = make(map[string]bool), terminated(false)
+		for h := range entries {
+			mine[h] = true
+		}
+	} else {
+		mine, theirs = terminated(true), m.passthroughs.Hosts(md)
+	}
+
+	conflicts := []string{}
+	for h := range mine {
+		if theirs[h] {
+			conflicts = append(conflicts, h)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// reportPassthroughConflicts logs and records an event for any hosts of the
+// supplied ingress that are both passed through and terminated.
+func (m *Manager) reportPassthroughConflicts(log *zap.Logger, namespace, ingressName string) {
+	c := m.passthroughConflicts(namespace, ingressName)
+	if len(c) == 0 {
+		return
+	}
+	log.Info("hosts are both passed through and terminated by different ingresses", zap.Strings("hosts", c))
+	m.recorder.NewPassthroughConflict(namespace, ingressName, c)
+}
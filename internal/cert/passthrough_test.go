@@ -0,0 +1,166 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPassthroughBackend(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "Default",
+			want: "ns_coolIngress",
+		},
+		{
+			name:        "Annotated",
+			annotations: map[string]string{annoSSLPassthroughBackend: " vault "},
+			want:        "vault",
+		},
+		{
+			name:        "Invalid",
+			annotations: map[string]string{annoSSLPassthroughBackend: "vault servers"},
+			want:        "ns_coolIngress",
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress", Annotations: tc.annotations}}
+			got, err := passthroughBackend(i)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("passthroughBackend(...): want error %v, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("passthroughBackend(...): want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	ingress := func(name string, passthrough bool, backend string, hosts ...string) *kubernetes.Ingress {
+		a := map[string]string{annoAllowHTTP: "false"}
+		if passthrough {
+			a[annoSSLPassthrough] = "true"
+		}
+		if backend != "" {
+			a[annoSSLPassthroughBackend] = backend
+		}
+		return hostMapIngress(name, a, hosts...)
+	}
+
+	forceHTTPSHosts := "/shared/force-https-hosts.lst"
+	ht := newHostMapTest(t, WithPassthroughHostsFile, WithForceHTTPSHostsFile(forceHTTPSHosts))
+
+	steps := []struct {
+		hostMapStep
+		wantCertPairs  []string
+		wantForceHTTPS string
+	}{
+		{
+			hostMapStep: hostMapStep{
+				name:         "Terminate",
+				fn:           func() { ht.OnAdd(ingress("coolIngress", false, "", "example.com", "acme.com")) },
+				wantNotified: 1,
+			},
+			wantCertPairs:  []string{"ns_coolIngress_coolSecret.pem"},
+			wantForceHTTPS: "acme.com\nexample.com",
+		},
+		{
+			hostMapStep: hostMapStep{
+				name:         "PassThrough",
+				fn:           func() { ht.OnUpdate(nil, ingress("coolIngress", true, "", "example.com", "acme.com")) },
+				want:         "acme.com ns_coolIngress\nexample.com ns_coolIngress",
+				wantNotified: 2,
+			},
+		},
+		{
+			hostMapStep: hostMapStep{
+				name:         "InvalidBackendUsesDefault",
+				fn:           func() { ht.OnUpdate(nil, ingress("coolIngress", true, "no way", "example.com", "acme.com")) },
+				want:         "acme.com ns_coolIngress\nexample.com ns_coolIngress",
+				wantEvents:   []string{"InvalidAnnotation ns/coolIngress " + annoSSLPassthroughBackend},
+				wantNotified: 2,
+			},
+		},
+		{
+			// Connections to passed through hosts never reach the ingress
+			// that would terminate them.
+			hostMapStep: hostMapStep{
+				name:         "PassedThroughHostAlsoTerminated",
+				fn:           func() { ht.OnAdd(ingress("otherIngress", false, "", "example.com")) },
+				want:         "acme.com ns_coolIngress\nexample.com ns_coolIngress",
+				wantEvents:   []string{"PassthroughConflict ns/otherIngress example.com"},
+				wantNotified: 3,
+			},
+			wantCertPairs:  []string{"ns_otherIngress_coolSecret.pem"},
+			wantForceHTTPS: "example.com",
+		},
+		{
+			hostMapStep: hostMapStep{
+				name:         "TerminatedHostAlsoPassedThrough",
+				fn:           func() { ht.OnUpdate(nil, ingress("coolIngress", true, "vault", "example.com", "acme.com")) },
+				want:         "acme.com vault\nexample.com vault",
+				wantEvents:   []string{"PassthroughConflict ns/coolIngress example.com"},
+				wantNotified: 4,
+			},
+			wantCertPairs:  []string{"ns_otherIngress_coolSecret.pem"},
+			wantForceHTTPS: "example.com",
+		},
+		{
+			hostMapStep: hostMapStep{
+				name:         "DeletePassthroughIngress",
+				fn:           func() { ht.OnDelete(ingress("coolIngress", true, "vault", "example.com", "acme.com")) },
+				wantNotified: 5,
+			},
+			wantCertPairs:  []string{"ns_otherIngress_coolSecret.pem"},
+			wantForceHTTPS: "example.com",
+		},
+	}
+
+	for _, s := range steps {
+		ht.run(t, []hostMapStep{s.hostMapStep})
+
+		fi, err := afero.ReadDir(ht.fs, ht.dir)
+		if err != nil {
+			t.Fatalf("%v: cannot read TLS dir: %v", s.name, err)
+		}
+		var got []string
+		for _, f := range fi {
+			got = append(got, f.Name())
+		}
+		if diff := deep.Equal(s.wantCertPairs, got); diff != nil {
+			t.Errorf("%v: want != got cert pairs %v", s.name, diff)
+		}
+		if b, _ := afero.ReadFile(ht.fs, forceHTTPSHosts); string(b) != s.wantForceHTTPS {
+			t.Errorf("%v: want force https hosts %q, got %q", s.name, s.wantForceHTTPS, b)
+		}
+	}
+}
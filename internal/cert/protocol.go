@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// The protocol spoken by the ingress' backends; one of http1, h2, or grpc.
+	// Hosts are routed to haproxy's default backend when unset.
+	annoBackendProtocol = "hal5d.planetlabs.com/backend-protocol"
+
+	backendHostsTempFilePrefix = "backend-hosts-tempfile"
+)
+
+// The haproxy backends that forward to linkerd's HTTP/1.1 and HTTP/2 ingress
+// routers in the example configuration.
+const (
+	backendLinkerdHTTP = "linkerd_http"
+	backendLinkerdH2   = "linkerd_h2"
+)
+
+// protocolBackends maps each supported backend protocol to the haproxy backend
+// that routes it. gRPC is carried over HTTP/2.
+var protocolBackends = map[string]string{
+	"http1": backendLinkerdHTTP,
+	"h2":    backendLinkerdH2,
+	"grpc":  backendLinkerdH2,
+}
+
+// backend returns the haproxy backend to which the supplied ingress' hosts
+// should be routed, or an empty string if they should be routed to the default
+// backend.
+func backend(i *kubernetes.Ingress) (string, error) {
+	v, ok := i.GetAnnotations()[annoBackendProtocol]
+	if !ok {
+		return "", nil
+	}
+	b, ok := protocolBackends[strings.ToLower(strings.TrimSpace(v))]
+	if !ok {
+		return "", errors.Errorf("unsupported backend protocol %q", v)
+	}
+	return b, nil
+}
+
+// newBackendHosts returns a host map of hostnames to the haproxy backend their
+// traffic should be routed to.
+func newBackendHosts() *hostMap {
+	return &hostMap{
+		hostMapTable:   hostMapTable{},
+		Name:           "backend host map",
+		Annotation:     annoBackendProtocol,
+		tempFilePrefix: backendHostsTempFilePrefix,
+		entries: func(i *kubernetes.Ingress) (map[string]string, error) {
+			b, err := backend(i)
+			if err != nil {
+				return nil, err
+			}
+			return hostEntries(collectHosts(i), b), nil
+		},
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackend(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "Unset",
+		},
+		{
+			name:        "HTTP1",
+			annotations: map[string]string{annoBackendProtocol: "http1"},
+			want:        backendLinkerdHTTP,
+		},
+		{
+			name:        "H2",
+			annotations: map[string]string{annoBackendProtocol: " H2 "},
+			want:        backendLinkerdH2,
+		},
+		{
+			name:        "GRPC",
+			annotations: map[string]string{annoBackendProtocol: "grpc"},
+			want:        backendLinkerdH2,
+		},
+		{
+			name:        "Unsupported",
+			annotations: map[string]string{annoBackendProtocol: "spdy"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &kubernetes.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}}
+			got, err := backend(i)
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("backend(...): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("backend(...): want error, got nil")
+			}
+			if got != tc.want {
+				t.Errorf("backend(...): want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBackendHosts(t *testing.T) {
+	withProtocol := func(name, protocol string, hosts ...string) *kubernetes.Ingress {
+		return hostMapIngress(name, map[string]string{annoBackendProtocol: protocol}, hosts...)
+	}
+
+	ht := newHostMapTest(t, WithBackendHostsFile)
+	ht.run(t, []hostMapStep{
+		{
+			name:         "AddIngress",
+			fn:           func() { ht.OnAdd(withProtocol("b", "h2", "example.com", "acme.com")) },
+			want:         "acme.com linkerd_h2\nexample.com linkerd_h2",
+			wantNotified: 1,
+		},
+		{
+			name:         "GRPCUsesSameBackend",
+			fn:           func() { ht.OnUpdate(nil, withProtocol("b", "grpc", "example.com", "acme.com")) },
+			want:         "acme.com linkerd_h2\nexample.com linkerd_h2",
+			wantNotified: 1,
+		},
+		{
+			// An ingress that does not choose a protocol does not change the
+			// backend another ingress chose for a host they share. Its cert
+			// pair is new.
+			name:         "DefaultProtocolSharesHost",
+			fn:           func() { ht.OnAdd(hostMapIngress("a", nil, "example.com")) },
+			want:         "acme.com linkerd_h2\nexample.com linkerd_h2",
+			wantNotified: 2,
+		},
+		{
+			name:         "ConflictingProtocol",
+			fn:           func() { ht.OnUpdate(nil, withProtocol("a", "http1", "example.com")) },
+			want:         "acme.com linkerd_h2\nexample.com linkerd_http",
+			wantNotified: 3,
+		},
+		{
+			name:         "DeleteConflictingIngress",
+			fn:           func() { ht.OnDelete(withProtocol("a", "http1", "example.com")) },
+			want:         "acme.com linkerd_h2\nexample.com linkerd_h2",
+			wantNotified: 4,
+		},
+	})
+}
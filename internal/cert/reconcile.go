@@ -0,0 +1,512 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// Migrate renames cert pairs written by older versions of hal5d, which used an
+// ambiguous filename scheme, to the current scheme. The supplied ingresses are
+// used to determine which cert pair each legacy file contains. Cert pairs are
+// renamed rather than rewritten such that the certificates served never
+// change. Migrate should be called before the manager handles any ingress or
+// secret notifications.
+func (m *Manager) Migrate(ingresses []*kubernetes.Ingress) {
+	fi, err := afero.ReadDir(m.fs, m.tlsDir)
+	if err != nil {
+		m.log.Error("cannot list TLS cert pairs - legacy cert pairs will not be migrated", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextMigrate}).Inc()
+		return
+	}
+
+	legacy := make(map[string]bool)
+	for _, f := range fi {
+		if !strings.HasSuffix(f.Name(), certPairSuffix) {
+			continue
+		}
+		if _, err := newCertPair(f.Name()); err == nil {
+			continue
+		}
+		legacy[f.Name()] = true
+	}
+
+	for _, i := range ingresses {
+		for _, tls := range i.Spec.TLS {
+			cp := certPair{Namespace: i.GetNamespace(), IngressName: i.GetName(), SecretName: tls.SecretName}
+			if !legacy[cp.legacyFilename()] {
+				continue
+			}
+			delete(legacy, cp.legacyFilename())
+			log := m.log.With(
+				zap.String(LabelNamespace, cp.Namespace),
+				zap.String(LabelIngressName, cp.IngressName),
+				zap.String(LabelSecretName, cp.SecretName))
+			from, to := filepath.Join(m.tlsDir, cp.legacyFilename()), filepath.Join(m.tlsDir, cp.Filename())
+			if err := m.fs.Rename(from, to); err != nil {
+				log.Error("cannot migrate legacy cert pair", zap.Error(err))
+				m.metric.Errors.With(prometheus.Labels{LabelContext: ContextMigrate}).Inc()
+				continue
+			}
+			log.Info("migrated legacy cert pair", zap.String("from", from), zap.String("to", to))
+		}
+	}
+
+	for f := range legacy {
+		m.log.Info("unexpected file in TLS dir does not match any ingress - not migrating",
+			zap.String("filename", f),
+			zap.String("tlsDir", m.tlsDir))
+	}
+}
+
+// Reconcile removes everything but the cert pairs referenced by the supplied
+// ingresses from the TLS directory, including temporary files left behind by
+// a crash. It also rewrites the force https hosts file, HSTS host map, source
+// allowlist, backend and TLS passthrough host maps, annotation maps, crt-list,
+// and client CA bundles to reflect the supplied ingresses and removes their
+// stale temporary files. Any new or changed cert pairs are then written as a single batch,
+// such that the resulting configuration is validated as few times as possible
+// and subscribers are notified at most once. Reconcile should be called after Migrate, once the
+// ingress and secret caches have synced, and before the manager handles any
+// ingress or secret notifications.
+func (m *Manager) Reconcile(ingresses []*kubernetes.Ingress) {
+	desired := make(map[string]bool)
+	unresolved := make(map[certPair]bool)
+	batch := []certData{}
+	clientCAsChanged := false
+	for _, i := range ingresses {
+		if !m.manages(i) {
+			continue
+		}
+		m.managed[metadata{Namespace: i.GetNamespace(), Name: i.GetName()}] = true
+		allowHTTP := allowHTTP(i.GetAnnotations()[annoAllowHTTP]).IsTrue()
+		// Invalid redirect codes and host map annotations, and conflicts
+		// between passthrough and terminating ingresses, are reported when
+		// the ingress is upserted.
+		code, _ := redirectCode(i)
+		force := !passthrough(i) && (!allowHTTP || code != 0)
+		m.forceHTTPSTable.MarkForceHTTPS(i.GetNamespace(), i.GetName(), force, code, collectHosts(i))
+		m.markHostMaps(i)
+		groups := tlsGroups(i)
+		if passthrough(i) {
+			groups = nil
+		}
+		for _, group := range groups {
+			cds := make([]certData, 0, len(group))
+			for _, secretName := range group {
+				m.secretRefs.Add(i.GetNamespace(), i.GetName(), secretName)
+				cp := certPair{Namespace: i.GetNamespace(), IngressName: i.GetName(), SecretName: secretName}
+				m.groups[cp] = group
+
+				// Cert pairs that cannot be read from their secret, or that
+				// fail verification, are left for the manager to report when
+				// it handles the ingress. Their existing files are kept until
+				// then, whether or not they are part of a multi-cert bundle.
+				s, err := m.secretStore.Get(i.GetNamespace(), secretName)
+				if err != nil {
+					unresolved[cp] = true
+					continue
+				}
+				m.certHosts[cp] = expectedHosts(i, secretName)
+				m.sniHosts[cp] = tlsHosts(i, secretName)
+				cd, err := newCertData(cp, s, m.certHosts[cp])
+				if err != nil {
+					unresolved[cp] = true
+					continue
+				}
+				cds = append(cds, cd)
+			}
+			for _, cd := range bundle(cds) {
+				desired[cd.Filename()] = true
+				if !m.changed(cd) {
+					m.observe(cd)
+					continue
+				}
+				if m.verify(cd) != nil {
+					unresolved[cd.unbundled()] = true
+					continue
+				}
+				batch = append(batch, cd)
+			}
+		}
+		if m.upsertClientAuth(i, ContextReconcile) {
+			clientCAsChanged = true
+		}
+	}
+
+	changed := m.removeUndesired(desired, unresolved)
+	if m.removeUndesiredClientCAs() || clientCAsChanged {
+		changed = true
+	}
+
+	if m.forceHTTPSHostsChanged() {
+		if err := m.writeForceHTTPSHosts(); err != nil {
+			m.log.Error("failed to write reconciled force https host list", zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		}
+		changed = true
+	}
+	if m.writeReconciledHostMaps() {
+		changed = true
+	}
+	m.removeTempFiles(m.forceHTTPSHostsFile, forceHTTPSTempFilePrefix)
+	m.removeTempFiles(m.redirectHostsFile, httpsRedirectTempFilePrefix)
+	m.removeTempFiles(m.crtListFile, crtListTempFilePrefix)
+
+	// Undesired files have already been removed by now, so the crt-list is
+	// synced and subscribers notified even if the configuration is invalid;
+	// haproxy must not keep referring to files that no longer exist.
+	switch {
+	case len(batch) > 0:
+		written, err := m.writeBatch(batch)
+		if err != nil {
+			m.log.Error("reconciled configuration is invalid - not writing cert pairs", zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		}
+		changed = changed || written
+	case changed:
+		if err := m.v.Validate(); err != nil {
+			m.log.Error("reconciled configuration is invalid", zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		}
+	}
+
+	// The crt-list is validated as it is written.
+	if m.syncCrtList(ContextReconcile) {
+		changed = true
+	}
+
+	if !changed {
+		m.log.Debug("TLS directory already reconciled")
+		return
+	}
+	m.notifySubscribers()
+}
+
+// A stagedCertPair has been written to a temporary file in the TLS directory,
+// but not yet committed.
+type stagedCertPair struct {
+	certData
+	path string
+}
+
+// writeBatch stages all of the supplied cert pairs and validates them as one.
+// If validation fails the batch is bisected in order to find the invalid cert
+// pairs, which are left for the manager to report when it handles the ingress
+// that references them. All valid cert pairs are then committed. writeBatch
+// returns true if any cert pairs were committed, or an error if the
+// configuration is invalid even without the batch.
+func (m *Manager) writeBatch(batch []certData) (bool, error) {
+	if m.crtListFile != "" {
+		return m.writeListedBatch(batch)
+	}
+
+	staged := m.stageAll(batch)
+	if err := m.v.Validate(); err != nil {
+		m.unstageAll(staged)
+		if err := m.v.Validate(); err != nil {
+			return false, err
+		}
+		m.log.Info("batch of cert pairs is invalid - searching for invalid cert pairs", zap.Int("batch", len(batch)))
+		staged = nil
+		if len(batch) > 1 {
+			mid := len(batch) / 2
+			staged = append(m.bisect(batch[:mid]), m.bisect(batch[mid:])...)
+		}
+	}
+
+	written := 0
+	for _, sp := range staged {
+		path := filepath.Join(m.tlsDir, sp.Filename())
+		if err := m.fs.Rename(sp.path, path); err != nil {
+			m.log.Error("cannot commit cert pair",
+				zap.String(LabelNamespace, sp.Namespace),
+				zap.String(LabelIngressName, sp.IngressName),
+				zap.String(LabelSecretName, sp.SecretName),
+				zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+			m.fs.Remove(sp.path) // nolint:gas,gosec
+			continue
+		}
+		m.committed(sp.certData)
+		written++
+	}
+	m.log.Info("wrote batch of cert pairs", zap.Int("batch", len(batch)), zap.Int("written", written))
+	return written > 0, nil
+}
+
+// writeListedBatch is writeBatch for managers that maintain a crt-list, in
+// which case cert pairs must be committed and listed in order to be validated.
+func (m *Manager) writeListedBatch(batch []certData) (bool, error) {
+	written, err := m.commitBatch(batch)
+	if err != nil {
+		if err := m.v.Validate(); err != nil {
+			return false, err
+		}
+		m.log.Info("batch of cert pairs is invalid - searching for invalid cert pairs", zap.Int("batch", len(batch)))
+		written = 0
+		if len(batch) > 1 {
+			mid := len(batch) / 2
+			written = m.bisectListed(batch[:mid]) + m.bisectListed(batch[mid:])
+		}
+	}
+	m.log.Info("wrote batch of cert pairs", zap.Int("batch", len(batch)), zap.Int("written", written))
+	return written > 0, nil
+}
+
+// bisectListed commits and lists the supplied cert pairs. If the resulting
+// configuration is invalid each half of the batch is bisected in turn. It
+// returns the number of cert pairs committed.
+func (m *Manager) bisectListed(batch []certData) int {
+	written, err := m.commitBatch(batch)
+	if err == nil {
+		return written
+	}
+	if len(batch) == 1 {
+		m.log.Info("invalid cert pair",
+			zap.String(LabelNamespace, batch[0].Namespace),
+			zap.String(LabelIngressName, batch[0].IngressName),
+			zap.String(LabelSecretName, batch[0].SecretName),
+			zap.Error(err))
+		return 0
+	}
+	mid := len(batch) / 2
+	return m.bisectListed(batch[:mid]) + m.bisectListed(batch[mid:])
+}
+
+// commitBatch stages, commits, and lists the supplied cert pairs, returning
+// the number committed.
+func (m *Manager) commitBatch(batch []certData) (int, error) {
+	staged := m.stageAll(batch)
+	if err := m.commitListed(staged); err != nil {
+		return 0, err
+	}
+	for _, sp := range staged {
+		m.committed(sp.certData)
+	}
+	return len(staged), nil
+}
+
+// committed records that the supplied cert pair was written while reconciling.
+func (m *Manager) committed(cd certData) {
+	m.removeOCSPResponse(cd.certPair)
+	m.observe(cd)
+	m.metric.Writes.With(prometheus.Labels{
+		LabelNamespace:   cd.Namespace,
+		LabelIngressName: cd.IngressName,
+		LabelSecretName:  cd.SecretName,
+	}).Inc()
+	m.recorder.NewWrite(cd.Namespace, cd.IngressName, cd.SecretName)
+	m.log.Debug("wrote cert pair",
+		zap.String(LabelNamespace, cd.Namespace),
+		zap.String(LabelIngressName, cd.IngressName),
+		zap.String(LabelSecretName, cd.SecretName))
+}
+
+// bisect stages the supplied cert pairs and validates them. If validation
+// fails the cert pairs are unstaged and each half of the batch is bisected in
+// turn. Only valid cert pairs remain staged.
+func (m *Manager) bisect(batch []certData) []stagedCertPair {
+	staged := m.stageAll(batch)
+	err := m.v.Validate()
+	if err == nil {
+		return staged
+	}
+	m.unstageAll(staged)
+	if len(batch) == 1 {
+		m.log.Info("invalid cert pair",
+			zap.String(LabelNamespace, batch[0].Namespace),
+			zap.String(LabelIngressName, batch[0].IngressName),
+			zap.String(LabelSecretName, batch[0].SecretName),
+			zap.Error(err))
+		return nil
+	}
+	mid := len(batch) / 2
+	return append(m.bisect(batch[:mid]), m.bisect(batch[mid:])...)
+}
+
+func (m *Manager) stageAll(batch []certData) []stagedCertPair {
+	staged := make([]stagedCertPair, 0, len(batch))
+	for _, cd := range batch {
+		path, err := m.stage(cd)
+		if err != nil {
+			m.log.Error("cannot stage cert pair",
+				zap.String(LabelNamespace, cd.Namespace),
+				zap.String(LabelIngressName, cd.IngressName),
+				zap.String(LabelSecretName, cd.SecretName),
+				zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+			continue
+		}
+		staged = append(staged, stagedCertPair{certData: cd, path: path})
+	}
+	return staged
+}
+
+func (m *Manager) unstageAll(staged []stagedCertPair) {
+	for _, sp := range staged {
+		if err := m.fs.Remove(sp.path); err != nil {
+			m.log.Error("cannot unstage cert pair", zap.String("filename", sp.path), zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		}
+	}
+}
+
+// removeUndesired removes all files that are not desired from the TLS
+// directory, returning true if any were removed. The OCSP responses stapled
+// to desired cert pairs are kept, as are any cert pairs that contain an
+// unresolved secret. Stale cert pairs are kept, along with their OCSP
+// responses, if the deletion breaker holds their removal.
+func (m *Manager) removeUndesired(desired map[string]bool, unresolved map[certPair]bool) bool {
+	fi, err := afero.ReadDir(m.fs, m.tlsDir)
+	if err != nil {
+		m.log.Error("cannot list TLS cert pairs - stale files will not be removed", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		return false
+	}
+
+	undesired := make([]string, 0, len(fi))
+	stale := []certPair{}
+	for _, f := range fi {
+		name := strings.TrimSuffix(f.Name(), ocspSuffix)
+		if f.IsDir() || desired[name] {
+			continue
+		}
+		cp, err := newCertPair(name)
+		if err == nil && unresolved[cp.unbundled()] {
+			continue
+		}
+		undesired = append(undesired, f.Name())
+		if err == nil && name == f.Name() {
+			stale = append(stale, cp)
+		}
+	}
+
+	held := map[string]bool{}
+	if m.breaker != nil {
+		held = m.breaker.holdStale(stale)
+	}
+	changed := false
+	for _, filename := range undesired {
+		if held[strings.TrimSuffix(filename, ocspSuffix)] {
+			continue
+		}
+		if m.removeStaleFile(filename) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeStaleCertPair removes a cert pair that was found to be stale while
+// reconciling, and its OCSP response, once the deletion breaker no longer
+// holds its removal. The cert pair is kept if an ingress has since come to
+// reference its secret. It returns true if any files were removed.
+func (m *Manager) removeStaleCertPair(cp certPair) bool {
+	if m.secretRefs.Get(cp.Namespace, cp.SecretName)[cp.IngressName] {
+		m.log.Info("stale cert pair is referenced again - not removing", zap.String("filename", cp.Filename()))
+		return false
+	}
+	changed := false
+	for _, filename := range []string{cp.Filename(), cp.Filename() + ocspSuffix} {
+		if ok, _ := afero.Exists(m.fs, filepath.Join(m.tlsDir, filename)); !ok { // nolint:gas,gosec
+			continue
+		}
+		if m.removeStaleFile(filename) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeStaleFile removes the supplied file from the TLS directory, returning
+// true if it was removed.
+func (m *Manager) removeStaleFile(filename string) bool {
+	log := m.log.With(zap.String("filename", filename), zap.String("tlsDir", m.tlsDir))
+	if err := m.fs.Remove(filepath.Join(m.tlsDir, filename)); err != nil {
+		log.Error("cannot remove stale file", zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		return false
+	}
+	log.Info("removed stale file")
+
+	cp, err := newCertPair(filename)
+	if err != nil {
+		return true
+	}
+	m.forget(cp)
+	m.metric.Deletes.With(prometheus.Labels{
+		LabelNamespace:   cp.Namespace,
+		LabelIngressName: cp.IngressName,
+		LabelSecretName:  cp.SecretName,
+	}).Inc()
+	return true
+}
+
+// forceHTTPSHostsChanged returns true if the force https hosts file or the
+// https redirect hosts file does not reflect the force https table.
+func (m *Manager) forceHTTPSHostsChanged() bool {
+	return m.fileChanged(m.forceHTTPSHostsFile, m.forceHTTPSTable.Bytes()) ||
+		m.fileChanged(m.redirectHostsFile, m.forceHTTPSTable.RedirectBytes())
+}
+
+// fileChanged returns true if the supplied file does not contain the supplied
+// data. Unset files never change.
+func (m *Manager) fileChanged(path string, data []byte) bool {
+	if path == "" {
+		return false
+	}
+	existing, err := afero.ReadFile(m.fs, path)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(existing, data)
+}
+
+// removeTempFiles removes temporary files left behind by a crash while
+// atomically writing the supplied file.
+func (m *Manager) removeTempFiles(path, tempFilePrefix string) {
+	if path == "" {
+		return
+	}
+	dir := filepath.Dir(path)
+	fi, err := afero.ReadDir(m.fs, dir)
+	if err != nil {
+		m.log.Error("cannot list directory - stale temp files will not be removed", zap.String("dir", dir), zap.Error(err))
+		m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+		return
+	}
+	for _, f := range fi {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), tempFilePrefix) {
+			continue
+		}
+		if err := m.fs.Remove(filepath.Join(dir, f.Name())); err != nil {
+			m.log.Error("cannot remove stale temp file", zap.String("filename", f.Name()), zap.Error(err))
+			m.metric.Errors.With(prometheus.Labels{LabelContext: ContextReconcile}).Inc()
+			continue
+		}
+		m.log.Info("removed stale temp file", zap.String("filename", f.Name()))
+	}
+}
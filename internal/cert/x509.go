@@ -0,0 +1,220 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+)
+
+// newCertData returns the cert pair stored in the supplied secret, which is
+// expected to serve the supplied hosts. It returns an error that fulfils
+// IsInvalid if the secret does not contain a cert pair.
+func newCertData(cp certPair, s *v1.Secret, hosts []string) (certData, error) {
+	cert, ok := s.Data[v1.TLSCertKey]
+	if !ok {
+		return certData{}, ErrInvalid(errors.Errorf("secret has no %s key", v1.TLSCertKey))
+	}
+	key, ok := s.Data[v1.TLSPrivateKeyKey]
+	if !ok {
+		return certData{}, ErrInvalid(errors.Errorf("secret has no %s key", v1.TLSPrivateKeyKey))
+	}
+	return certData{certPair: cp, Cert: cert, Key: key, Hosts: hosts}, nil
+}
+
+// parse parses the supplied cert pair's certificate chain, leaf certificate
+// first. It returns an error that fulfils IsInvalid if the chain cannot be
+// parsed, or if the private key is unusable or does not match the leaf.
+func parse(c certData) ([]*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, ErrInvalid(errors.Wrap(err, "cannot load certificate and private key"))
+	}
+	chain := make([]*x509.Certificate, 0, len(pair.Certificate))
+	for n, der := range pair.Certificate {
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, ErrInvalid(errors.Wrapf(err, "cannot parse certificate %d of chain", n))
+		}
+		chain = append(chain, crt)
+	}
+	return chain, nil
+}
+
+// verify checks that the supplied cert pair is usable before it is handed to
+// the (comparatively expensive) validator. It returns an error that fulfils
+// IsInvalid describing why the cert pair is unusable.
+func (m *Manager) verify(c certData) error {
+	chain, err := parse(c)
+	if err != nil {
+		return err
+	}
+	leaf, now := chain[0], m.now()
+	if m.checkValidity && now.Before(leaf.NotBefore) {
+		return ErrInvalid(errors.Errorf("certificate is not valid until %s", leaf.NotBefore.UTC().Format(time.RFC3339)))
+	}
+	if m.checkValidity && now.After(leaf.NotAfter) {
+		return ErrInvalid(errors.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339)))
+	}
+	if u := uncovered(leaf, c.Hosts); m.strictHosts && len(u) > 0 {
+		return ErrInvalid(errors.Errorf("certificate does not cover hosts %s", strings.Join(u, ", ")))
+	}
+	return nil
+}
+
+// uncovered returns the supplied hosts that are not covered by the supplied
+// leaf certificate's subject alternative names, including wildcards.
+func uncovered(leaf *x509.Certificate, hosts []string) []string {
+	u := []string(nil)
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			u = append(u, h)
+		}
+	}
+	return u
+}
+
+// checkHosts reports any hosts the supplied cert pair is expected to serve
+// that are not covered by its leaf certificate. Each distinct set of uncovered
+// hosts is recorded as an event once.
+func (m *Manager) checkHosts(log *zap.Logger, c certData) {
+	chain, err := parse(c)
+	if err != nil {
+		// Unparseable cert pairs are reported by verify.
+		return
+	}
+	u := uncovered(chain[0], c.Hosts)
+	m.metric.UncoveredHosts.With(prometheus.Labels{
+		LabelNamespace:   c.Namespace,
+		LabelIngressName: c.IngressName,
+		LabelSecretName:  c.SecretName,
+	}).Set(float64(len(u)))
+
+	reported := strings.Join(u, ",")
+	if m.uncovered[c.certPair] == reported {
+		return
+	}
+	m.uncovered[c.certPair] = reported
+	if len(u) == 0 {
+		return
+	}
+	log.Warn("certificate does not cover all hosts", zap.Strings("uncoveredHosts", u))
+	m.recorder.NewUncoveredHosts(c.Namespace, c.IngressName, c.SecretName, u)
+}
+
+// observe records that the supplied cert pair is on disk, listing it in the
+// crt-list and exposing metrics describing its leaf certificate. The cert pair
+// is up to date with its secret, so is no longer a last known good cert pair.
+func (m *Manager) observe(c certData) {
+	m.crtList[c.certPair] = m.sniHosts[c.unbundled()]
+	m.forgetLastKnownGood(c.certPair)
+
+	chain, err := parse(c)
+	if err != nil {
+		m.log.Debug("cannot parse cert pair - not exposing certificate metrics",
+			zap.String(LabelNamespace, c.Namespace),
+			zap.String(LabelIngressName, c.IngressName),
+			zap.String(LabelSecretName, c.SecretName),
+			zap.Error(err))
+		m.forgetMetrics(c.certPair)
+		return
+	}
+	leaf := chain[0]
+	labels := prometheus.Labels{
+		LabelNamespace:   c.Namespace,
+		LabelIngressName: c.IngressName,
+		LabelSecretName:  c.SecretName,
+	}
+	m.metric.NotBefore.With(labels).Set(float64(leaf.NotBefore.Unix()))
+	m.metric.NotAfter.With(labels).Set(float64(leaf.NotAfter.Unix()))
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	info := prometheus.Labels{
+		LabelNamespace:   c.Namespace,
+		LabelIngressName: c.IngressName,
+		LabelSecretName:  c.SecretName,
+		LabelSubject:     leaf.Subject.String(),
+		LabelIssuer:      leaf.Issuer.String(),
+		LabelSerial:      leaf.SerialNumber.Text(16),
+		LabelFingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	if existing, ok := m.certInfo[c.certPair]; ok && !equalLabels(existing, info) {
+		m.metric.Info.Delete(existing)
+	}
+	m.metric.Info.With(info).Set(1)
+	m.certInfo[c.certPair] = info
+}
+
+// forget records that the supplied cert pair has been removed from disk.
+func (m *Manager) forget(cp certPair) {
+	delete(m.crtList, cp)
+	m.removeOCSPResponse(cp)
+	m.forgetMetrics(cp)
+	m.forgetLastKnownGood(cp)
+}
+
+// forgetMetrics removes the metrics describing the supplied cert pair. Cert
+// pair metrics are labelled by secret rather than by file, so series that
+// still describe another cert pair written from the same secret are kept; for
+// example when a multi-cert bundle is split into standalone cert pairs.
+func (m *Manager) forgetMetrics(cp certPair) {
+	info, ok := m.certInfo[cp]
+	delete(m.certInfo, cp)
+	delete(m.uncovered, cp)
+	for other, otherInfo := range m.certInfo {
+		if other.unbundled() != cp.unbundled() {
+			continue
+		}
+		if ok && !equalLabels(info, otherInfo) {
+			m.metric.Info.Delete(info)
+		}
+		return
+	}
+
+	labels := prometheus.Labels{
+		LabelNamespace:   cp.Namespace,
+		LabelIngressName: cp.IngressName,
+		LabelSecretName:  cp.SecretName,
+	}
+	m.metric.NotBefore.Delete(labels)
+	m.metric.NotAfter.Delete(labels)
+	m.metric.UncoveredHosts.Delete(labels)
+	if ok {
+		m.metric.Info.Delete(info)
+	}
+}
+
+func equalLabels(a, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
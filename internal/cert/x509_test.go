@@ -0,0 +1,410 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/event"
+	"github.com/planetlabs/hal5d/internal/kubernetes"
+	"github.com/planetlabs/hal5d/internal/metrics"
+
+	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestCertPair returns a PEM encoded self signed certificate and private
+// key, valid between the supplied times.
+func newTestCertPair(notBefore, notAfter time.Time, hosts ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "hal5d test"},
+		DNSNames:     hosts,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	k, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k})
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	expiredCert, expiredKey := newTestCertPair(now.Add(-2*time.Hour), now.Add(-1*time.Hour))
+	futureCert, futureKey := newTestCertPair(now.Add(1*time.Hour), now.Add(2*time.Hour))
+
+	cases := []struct {
+		name          string
+		c             certData
+		checkValidity bool
+		wantReason    string
+	}{
+		{
+			name:          "Valid",
+			c:             certData{Cert: coolCert, Key: coolKey},
+			checkValidity: true,
+		},
+		{
+			name:          "ValidChain",
+			c:             certData{Cert: append(append(coolCert, '\n'), dankCert...), Key: coolKey},
+			checkValidity: true,
+		},
+		{
+			name:          "GarbageCertificate",
+			c:             certData{Cert: []byte("cert"), Key: coolKey},
+			checkValidity: true,
+			wantReason:    "cannot load certificate and private key",
+		},
+		{
+			name:          "GarbageKey",
+			c:             certData{Cert: coolCert, Key: []byte("key")},
+			checkValidity: true,
+			wantReason:    "cannot load certificate and private key",
+		},
+		{
+			name:          "MismatchedKey",
+			c:             certData{Cert: coolCert, Key: dankKey},
+			checkValidity: true,
+			wantReason:    "private key does not match public key",
+		},
+		{
+			name:          "GarbageChain",
+			c:             certData{Cert: append(append(coolCert, '\n'), []byte("-----BEGIN CERTIFICATE-----\nZ2FyYmFnZQ==\n-----END CERTIFICATE-----\n")...), Key: coolKey},
+			checkValidity: true,
+			wantReason:    "cannot parse certificate 1 of chain",
+		},
+		{
+			name:          "Expired",
+			c:             certData{Cert: expiredCert, Key: expiredKey},
+			checkValidity: true,
+			wantReason:    "certificate expired at",
+		},
+		{
+			name:          "NotYetValid",
+			c:             certData{Cert: futureCert, Key: futureKey},
+			checkValidity: true,
+			wantReason:    "certificate is not valid until",
+		},
+		{
+			name: "ExpiredWithoutValidityCheck",
+			c:    certData{Cert: expiredCert, Key: expiredKey},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewManager("/tls", mapSecretStore{}, WithValidityPeriodCheck(tc.checkValidity))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+			err = m.verify(tc.c)
+			if tc.wantReason == "" {
+				if err != nil {
+					t.Errorf("m.verify(...): want no error, got %v", err)
+				}
+				return
+			}
+			if !IsInvalid(err) {
+				t.Fatalf("m.verify(...): want invalid error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.wantReason) {
+				t.Errorf("m.verify(...): want error containing %q, got %q", tc.wantReason, err.Error())
+			}
+		})
+	}
+}
+
+type invalidSecretRecorder struct {
+	event.NopRecorder
+	reasons []string
+}
+
+func (r *invalidSecretRecorder) NewInvalidSecret(namespace, ingressName, secretName, reason string) {
+	r.reasons = append(r.reasons, reason)
+}
+
+func TestVerifyBeforeValidate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+	mismatched := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolSecret"},
+		Data:       map[string][]byte{v1.TLSCertKey: coolCert, v1.TLSPrivateKeyKey: dankKey},
+	}
+
+	v := &contentValidator{fs: fs, dir: dir}
+	r := &invalidSecretRecorder{}
+	m, err := NewManager(dir,
+		mapSecretStore{metadata{Namespace: "ns", Name: "coolSecret"}: mismatched},
+		WithFilesystem(fs),
+		WithValidator(v),
+		WithEventRecorder(r))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	m.OnAdd(coolIngress)
+	if v.validated != 0 {
+		t.Errorf("m.OnAdd(...): want 0 validations, got %v", v.validated)
+	}
+	if len(r.reasons) != 1 || !strings.Contains(r.reasons[0], "private key does not match public key") {
+		t.Errorf("m.OnAdd(...): want one invalid secret event citing mismatched key, got %v", r.reasons)
+	}
+	validate(t, fs, dir, map[string][]byte{})
+}
+
+type mapGauge struct {
+	metrics.NopGauge
+	v *float64
+}
+
+func (g *mapGauge) Set(v float64) {
+	*g.v = v
+}
+
+type mapGaugeVec map[string]*float64
+
+func labelKey(l prometheus.Labels) string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kv := make([]string, 0, len(l))
+	for _, k := range keys {
+		kv = append(kv, k+"="+l[k])
+	}
+	return strings.Join(kv, ",")
+}
+
+func (m mapGaugeVec) With(l prometheus.Labels) prometheus.Gauge {
+	k := labelKey(l)
+	if _, ok := m[k]; !ok {
+		m[k] = new(float64)
+	}
+	return &mapGauge{v: m[k]}
+}
+
+func (m mapGaugeVec) Delete(l prometheus.Labels) bool {
+	k := labelKey(l)
+	_, ok := m[k]
+	delete(m, k)
+	return ok
+}
+
+func TestCertificateMetrics(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := populate(t, fs, nil)
+
+	mx := newNopMetrics()
+	notBefore, notAfter, info := mapGaugeVec{}, mapGaugeVec{}, mapGaugeVec{}
+	mx.NotBefore, mx.NotAfter, mx.Info = notBefore, notAfter, info
+
+	st := mapSecretStore{metadata{Namespace: coolSecret.GetNamespace(), Name: coolSecret.GetName()}: coolSecret}
+	m, err := NewManager(dir, st, WithFilesystem(fs), WithMetrics(mx))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	leaf := func(cert []byte) *x509.Certificate {
+		b, _ := pem.Decode(cert)
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			t.Fatalf("x509.ParseCertificate(...): %v", err)
+		}
+		return c
+	}
+	labels := prometheus.Labels{LabelNamespace: "ns", LabelIngressName: "coolIngress", LabelSecretName: "coolSecret"}
+	check := func(cert []byte) {
+		t.Helper()
+		l := leaf(cert)
+		if got, want := *notBefore[labelKey(labels)], float64(l.NotBefore.Unix()); got != want {
+			t.Errorf("not before: want %v, got %v", want, got)
+		}
+		if got, want := *notAfter[labelKey(labels)], float64(l.NotAfter.Unix()); got != want {
+			t.Errorf("not after: want %v, got %v", want, got)
+		}
+		fingerprint := sha256.Sum256(l.Raw)
+		wantInfo := prometheus.Labels{
+			LabelNamespace:   "ns",
+			LabelIngressName: "coolIngress",
+			LabelSecretName:  "coolSecret",
+			LabelSubject:     "CN=hal5d test",
+			LabelIssuer:      "CN=hal5d test",
+			LabelSerial:      l.SerialNumber.Text(16),
+			LabelFingerprint: hex.EncodeToString(fingerprint[:]),
+		}
+		if len(info) != 1 || info[labelKey(wantInfo)] == nil || *info[labelKey(wantInfo)] != 1 {
+			t.Errorf("info: want only %v, got %v", labelKey(wantInfo), info)
+		}
+	}
+
+	m.OnAdd(coolIngress)
+	check(coolCert)
+
+	updated := &v1.Secret{
+		ObjectMeta: coolSecret.ObjectMeta,
+		Data:       map[string][]byte{v1.TLSCertKey: dankCert, v1.TLSPrivateKeyKey: dankKey},
+	}
+	m.OnUpdate(coolSecret, updated)
+	check(dankCert)
+
+	m.OnDelete(coolIngress)
+	if len(notBefore)+len(notAfter)+len(info) != 0 {
+		t.Errorf("m.OnDelete(...): want no certificate metrics, got %v, %v, %v", notBefore, notAfter, info)
+	}
+}
+
+type uncoveredHostsRecorder struct {
+	event.NopRecorder
+	uncovered [][]string
+	invalid   []string
+}
+
+func (r *uncoveredHostsRecorder) NewUncoveredHosts(namespace, ingressName, secretName string, hosts []string) {
+	r.uncovered = append(r.uncovered, hosts)
+}
+
+func (r *uncoveredHostsRecorder) NewInvalidSecret(namespace, ingressName, secretName, reason string) {
+	r.invalid = append(r.invalid, reason)
+}
+
+func TestHostCoverage(t *testing.T) {
+	now := time.Now()
+	cert, key := newTestCertPair(now.Add(-1*time.Hour), now.Add(1*time.Hour), "foo.example.com", "*.wild.example.com")
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolSecret"},
+		Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+	}
+	ingress := func(rules []string, tlsHosts []string) *kubernetes.Ingress {
+		i := &kubernetes.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "coolIngress"},
+			Spec:       kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{{Hosts: tlsHosts, SecretName: "coolSecret"}}},
+		}
+		for _, h := range rules {
+			i.Spec.Rules = append(i.Spec.Rules, kubernetes.IngressRule{Host: h})
+		}
+		return i
+	}
+
+	cases := []struct {
+		name          string
+		i             *kubernetes.Ingress
+		strict        bool
+		wantUncovered [][]string
+		wantInvalid   bool
+		wantWritten   bool
+	}{
+		{
+			name:        "RuleHostsCovered",
+			i:           ingress([]string{"foo.example.com", "a.wild.example.com"}, nil),
+			wantWritten: true,
+		},
+		{
+			name:          "RuleHostsUncovered",
+			i:             ingress([]string{"foo.example.com", "bar.example.com", "a.b.wild.example.com"}, nil),
+			wantUncovered: [][]string{{"bar.example.com", "a.b.wild.example.com"}},
+			wantWritten:   true,
+		},
+		{
+			name:        "TLSHostsPreferred",
+			i:           ingress([]string{"foo.example.com", "bar.example.com"}, []string{"foo.example.com"}),
+			wantWritten: true,
+		},
+		{
+			name:          "TLSHostsUncovered",
+			i:             ingress(nil, []string{"bar.example.com"}),
+			wantUncovered: [][]string{{"bar.example.com"}},
+			wantWritten:   true,
+		},
+		{
+			name:          "StrictUncovered",
+			i:             ingress(nil, []string{"bar.example.com"}),
+			strict:        true,
+			wantUncovered: [][]string{{"bar.example.com"}},
+			wantInvalid:   true,
+		},
+		{
+			name:        "StrictCovered",
+			i:           ingress(nil, []string{"foo.example.com"}),
+			strict:      true,
+			wantWritten: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dir := populate(t, fs, nil)
+			r := &uncoveredHostsRecorder{}
+			m, err := NewManager(dir,
+				mapSecretStore{metadata{Namespace: "ns", Name: "coolSecret"}: secret},
+				WithFilesystem(fs),
+				WithEventRecorder(r),
+				WithStrictHostCoverage(tc.strict))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+
+			// Uncovered hosts are reported once, no matter how many times the
+			// ingress is handled.
+			m.OnAdd(tc.i)
+			m.OnUpdate(tc.i, tc.i)
+
+			if diff := deep.Equal(tc.wantUncovered, r.uncovered); diff != nil {
+				t.Errorf("m.OnAdd(...): want != got uncovered hosts: %v", diff)
+			}
+			if tc.wantInvalid && len(r.invalid) == 0 {
+				t.Errorf("m.OnAdd(...): want invalid secret event")
+			}
+			if !tc.wantInvalid && len(r.invalid) > 0 {
+				t.Errorf("m.OnAdd(...): got unwanted invalid secret events %v", r.invalid)
+			}
+			want := map[string][]byte{}
+			if tc.wantWritten {
+				want["ns_coolIngress_coolSecret.pem"] = bytes.Join([][]byte{cert, key}, []byte("\n"))
+			}
+			validate(t, fs, dir, want)
+		})
+	}
+}
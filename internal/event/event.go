@@ -17,6 +17,9 @@ and limitations under the License.
 package event
 
 import (
+	"strings"
+	"time"
+
 	"github.com/planetlabs/hal5d/internal/kubernetes"
 	"k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/record"
@@ -26,6 +29,21 @@ const (
 	eventCertPairWritten  = "CertPairWritten"
 	eventCertPairDeleted  = "CertPairDeleted"
 	eventTLSSecretInvalid = "TLSSecretInvalid"
+
+	eventTLSLastKnownGoodKept = "TLSLastKnownGoodKept"
+
+	eventTLSCertificateExpiringSoon = "TLSCertificateExpiringSoon"
+	eventTLSCertificateExpired      = "TLSCertificateExpired"
+
+	eventTLSCertificateHostMismatch = "TLSCertificateHostMismatch"
+
+	eventTLSOCSPStaplingFailed = "TLSOCSPStaplingFailed"
+
+	eventIngressAnnotationInvalid = "IngressAnnotationInvalid"
+
+	eventTLSPassthroughConflict = "TLSPassthroughConflict"
+
+	eventClientCASecretInvalid = "ClientCASecretInvalid"
 )
 
 // A Recorder records events.
@@ -36,8 +54,39 @@ type Recorder interface {
 	// NewDelete records the deletion of a certificate pair.
 	NewDelete(namespace, ingressName, secretName string)
 
-	// NewInvalidSecret records an invalid TLS secret.
-	NewInvalidSecret(namespace, ingressName, secretName string)
+	// NewInvalidSecret records an invalid TLS secret, and the reason it is
+	// invalid.
+	NewInvalidSecret(namespace, ingressName, secretName, reason string)
+
+	// NewKeptLastKnownGood records that a certificate pair continues to be
+	// served while its TLS secret is invalid, and the reason it is invalid.
+	NewKeptLastKnownGood(namespace, ingressName, secretName, reason string)
+
+	// NewExpiringSoon records that a certificate will soon expire.
+	NewExpiringSoon(namespace, ingressName, secretName string, notAfter time.Time)
+
+	// NewExpired records that a certificate has expired.
+	NewExpired(namespace, ingressName, secretName string, notAfter time.Time)
+
+	// NewUncoveredHosts records that a certificate does not cover some of the
+	// hosts it is expected to serve.
+	NewUncoveredHosts(namespace, ingressName, secretName string, hosts []string)
+
+	// NewOCSPFailure records that an OCSP response could not be stapled to a
+	// certificate, and the reason why.
+	NewOCSPFailure(namespace, ingressName, secretName, reason string)
+
+	// NewInvalidAnnotation records an invalid ingress annotation, and the
+	// reason it is invalid.
+	NewInvalidAnnotation(namespace, ingressName, annotation, reason string)
+
+	// NewPassthroughConflict records that some of an ingress' hosts are passed
+	// through by one ingress and terminated by another.
+	NewPassthroughConflict(namespace, ingressName string, hosts []string)
+
+	// NewInvalidClientCA records an invalid client CA secret, and the reason
+	// it is invalid.
+	NewInvalidClientCA(namespace, ingressName, secretName, reason string)
 }
 
 // A NopRecorder does nothing.
@@ -50,7 +99,32 @@ func (r *NopRecorder) NewWrite(namespace, ingressName, secretName string) {}
 func (r *NopRecorder) NewDelete(namespace, ingressName, secretName string) {}
 
 // NewInvalidSecret does nothing.
-func (r *NopRecorder) NewInvalidSecret(namespace, ingressName, secretName string) {}
+func (r *NopRecorder) NewInvalidSecret(namespace, ingressName, secretName, reason string) {}
+
+// NewKeptLastKnownGood does nothing.
+func (r *NopRecorder) NewKeptLastKnownGood(namespace, ingressName, secretName, reason string) {}
+
+// NewExpiringSoon does nothing.
+func (r *NopRecorder) NewExpiringSoon(namespace, ingressName, secretName string, notAfter time.Time) {
+}
+
+// NewExpired does nothing.
+func (r *NopRecorder) NewExpired(namespace, ingressName, secretName string, notAfter time.Time) {}
+
+// NewUncoveredHosts does nothing.
+func (r *NopRecorder) NewUncoveredHosts(namespace, ingressName, secretName string, hosts []string) {}
+
+// NewOCSPFailure does nothing.
+func (r *NopRecorder) NewOCSPFailure(namespace, ingressName, secretName, reason string) {}
+
+// NewInvalidAnnotation does nothing.
+func (r *NopRecorder) NewInvalidAnnotation(namespace, ingressName, annotation, reason string) {}
+
+// NewPassthroughConflict does nothing.
+func (r *NopRecorder) NewPassthroughConflict(namespace, ingressName string, hosts []string) {}
+
+// NewInvalidClientCA does nothing.
+func (r *NopRecorder) NewInvalidClientCA(namespace, ingressName, secretName, reason string) {}
 
 // A KubernetesRecorder records events to Kubernetes.
 type KubernetesRecorder struct {
@@ -70,7 +144,7 @@ func (r *KubernetesRecorder) NewWrite(namespace, ingressName, secretName string)
 	if err != nil {
 		return
 	}
-	r.e.Eventf(i, v1.EventTypeNormal, eventCertPairWritten, "Loaded TLS certificate from secret %s", secretName)
+	r.e.Eventf(i.Reference(), v1.EventTypeNormal, eventCertPairWritten, "Loaded TLS certificate from secret %s", secretName)
 }
 
 // NewDelete records the deletion of a certificate pair as an event on the
@@ -80,14 +154,94 @@ func (r *KubernetesRecorder) NewDelete(namespace, ingressName, secretName string
 	if err != nil {
 		return
 	}
-	r.e.Eventf(i, v1.EventTypeNormal, eventCertPairDeleted, "Unloaded TLS certificate from secret %s", secretName)
+	r.e.Eventf(i.Reference(), v1.EventTypeNormal, eventCertPairDeleted, "Unloaded TLS certificate from secret %s", secretName)
 }
 
 // NewInvalidSecret records an invalid TLS secret as an event on the supplied ingress.
-func (r *KubernetesRecorder) NewInvalidSecret(namespace, ingressName, secretName string) {
+func (r *KubernetesRecorder) NewInvalidSecret(namespace, ingressName, secretName, reason string) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSSecretInvalid, "Could not load TLS certificate from invalid secret %s: %s", secretName, reason)
+}
+
+// NewKeptLastKnownGood records a certificate pair that continues to be served
+// while its TLS secret is invalid as an event on the supplied ingress.
+func (r *KubernetesRecorder) NewKeptLastKnownGood(namespace, ingressName, secretName, reason string) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSLastKnownGoodKept, "Kept last known good TLS certificate from invalid secret %s: %s", secretName, reason)
+}
+
+// NewExpiringSoon records a certificate that will soon expire as an event on
+// the supplied ingress.
+func (r *KubernetesRecorder) NewExpiringSoon(namespace, ingressName, secretName string, notAfter time.Time) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSCertificateExpiringSoon, "TLS certificate from secret %s expires at %s", secretName, notAfter.UTC().Format(time.RFC3339))
+}
+
+// NewExpired records an expired certificate as an event on the supplied
+// ingress.
+func (r *KubernetesRecorder) NewExpired(namespace, ingressName, secretName string, notAfter time.Time) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSCertificateExpired, "TLS certificate from secret %s expired at %s", secretName, notAfter.UTC().Format(time.RFC3339))
+}
+
+// NewUncoveredHosts records a certificate that does not cover some of the
+// hosts it is expected to serve as an event on the supplied ingress.
+func (r *KubernetesRecorder) NewUncoveredHosts(namespace, ingressName, secretName string, hosts []string) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSCertificateHostMismatch, "TLS certificate from secret %s does not cover hosts %s", secretName, strings.Join(hosts, ", "))
+}
+
+// NewOCSPFailure records a failure to staple an OCSP response to a certificate
+// as an event on the supplied ingress.
+func (r *KubernetesRecorder) NewOCSPFailure(namespace, ingressName, secretName, reason string) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSOCSPStaplingFailed, "Could not staple OCSP response to TLS certificate from secret %s: %s", secretName, reason)
+}
+
+// NewInvalidAnnotation records an invalid annotation as an event on the
+// supplied ingress.
+func (r *KubernetesRecorder) NewInvalidAnnotation(namespace, ingressName, annotation, reason string) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventIngressAnnotationInvalid, "Ignored invalid annotation %s: %s", annotation, reason)
+}
+
+// NewPassthroughConflict records hosts that are both passed through and
+// terminated as an event on the supplied ingress.
+func (r *KubernetesRecorder) NewPassthroughConflict(namespace, ingressName string, hosts []string) {
+	i, err := r.i.Get(namespace, ingressName)
+	if err != nil {
+		return
+	}
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventTLSPassthroughConflict, "Hosts %s are passed through by one ingress and terminated by another", strings.Join(hosts, ", "))
+}
+
+// NewInvalidClientCA records an invalid client CA secret as an event on the
+// supplied ingress.
+func (r *KubernetesRecorder) NewInvalidClientCA(namespace, ingressName, secretName, reason string) {
 	i, err := r.i.Get(namespace, ingressName)
 	if err != nil {
 		return
 	}
-	r.e.Eventf(i, v1.EventTypeWarning, eventTLSSecretInvalid, "Could not load TLS certificate from invalid secret %s", secretName)
+	r.e.Eventf(i.Reference(), v1.EventTypeWarning, eventClientCASecretInvalid, "Could not load client CA from invalid secret %s: %s", secretName, reason)
 }
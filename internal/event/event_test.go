@@ -20,12 +20,14 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"k8s.io/api/core/v1"
-	"k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
+
+	"github.com/planetlabs/hal5d/internal/kubernetes"
 )
 
 const (
@@ -34,9 +36,9 @@ const (
 	coolSecretName  = "coolSecret"
 )
 
-var coolIngress = &v1beta1.Ingress{
+var coolIngress = &kubernetes.Ingress{
 	ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: coolIngressName},
-	Spec:       v1beta1.IngressSpec{TLS: []v1beta1.IngressTLS{{SecretName: coolSecretName}}},
+	Spec:       kubernetes.IngressSpec{TLS: []kubernetes.IngressTLS{{SecretName: coolSecretName}}},
 }
 
 type metadata struct {
@@ -44,9 +46,9 @@ type metadata struct {
 	Name      string
 }
 
-type mapIngressStore map[metadata]*v1beta1.Ingress
+type mapIngressStore map[metadata]*kubernetes.Ingress
 
-func (m mapIngressStore) Get(namespace, name string) (*v1beta1.Ingress, error) {
+func (m mapIngressStore) Get(namespace, name string) (*kubernetes.Ingress, error) {
 	md := metadata{Namespace: namespace, Name: name}
 	s, ok := m[md]
 	if !ok {
@@ -68,9 +70,9 @@ type mapRecorder struct {
 }
 
 func (r *mapRecorder) Eventf(o runtime.Object, eventType, reason, format string, args ...interface{}) {
-	i := o.(*v1beta1.Ingress)
+	ref := o.(*v1.ObjectReference)
 	r.e[event{
-		metadata{i.GetNamespace(), i.GetName()},
+		metadata{ref.Namespace, ref.Name},
 		eventType,
 		reason,
 		fmt.Sprintf(format, args...),
@@ -191,6 +193,7 @@ func TestNewInvalidSecret(t *testing.T) {
 		ns          string
 		ingressName string
 		secretName  string
+		reason      string
 		want        map[event]bool
 	}{
 		{
@@ -199,12 +202,458 @@ func TestNewInvalidSecret(t *testing.T) {
 			ns:          namespace,
 			ingressName: coolIngressName,
 			secretName:  coolSecretName,
+			reason:      "certificate expired",
 			want: map[event]bool{
 				{
 					metadata{namespace, coolIngressName},
 					v1.EventTypeWarning,
 					eventTLSSecretInvalid,
-					"Could not load TLS certificate from invalid secret " + coolSecretName,
+					"Could not load TLS certificate from invalid secret " + coolSecretName + ": certificate expired",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			reason:      "certificate expired",
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewInvalidSecret(tc.ns, tc.ingressName, tc.secretName, tc.reason)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewInvalidSecret(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewInvalidSecret(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewKeptLastKnownGood(t *testing.T) {
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		secretName  string
+		reason      string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			reason:      "certificate expired",
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventTLSLastKnownGoodKept,
+					"Kept last known good TLS certificate from invalid secret " + coolSecretName + ": certificate expired",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			reason:      "certificate expired",
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewKeptLastKnownGood(tc.ns, tc.ingressName, tc.secretName, tc.reason)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewKeptLastKnownGood(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewKeptLastKnownGood(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewExpiringSoon(t *testing.T) {
+	notAfter := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		secretName  string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventTLSCertificateExpiringSoon,
+					"TLS certificate from secret " + coolSecretName + " expires at 2018-06-01T00:00:00Z",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewExpiringSoon(tc.ns, tc.ingressName, tc.secretName, notAfter)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewExpiringSoon(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, notAfter, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewExpiringSoon(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, notAfter, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewExpired(t *testing.T) {
+	notAfter := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		secretName  string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventTLSCertificateExpired,
+					"TLS certificate from secret " + coolSecretName + " expired at 2018-06-01T00:00:00Z",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewExpired(tc.ns, tc.ingressName, tc.secretName, notAfter)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewExpired(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, notAfter, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewExpired(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, notAfter, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewUncoveredHosts(t *testing.T) {
+	hosts := []string{"foo.example.com", "bar.example.com"}
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		secretName  string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventTLSCertificateHostMismatch,
+					"TLS certificate from secret " + coolSecretName + " does not cover hosts foo.example.com, bar.example.com",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewUncoveredHosts(tc.ns, tc.ingressName, tc.secretName, hosts)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewUncoveredHosts(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, hosts, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewUncoveredHosts(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, hosts, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewOCSPFailure(t *testing.T) {
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		secretName  string
+		reason      string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			reason:      "certificate is revoked",
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventTLSOCSPStaplingFailed,
+					"Could not staple OCSP response to TLS certificate from secret " + coolSecretName + ": certificate is revoked",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			reason:      "certificate is revoked",
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewOCSPFailure(tc.ns, tc.ingressName, tc.secretName, tc.reason)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewOCSPFailure(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewOCSPFailure(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInvalidAnnotation(t *testing.T) {
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		annotation  string
+		reason      string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			annotation:  "example.org/cool",
+			reason:      "not cool",
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventIngressAnnotationInvalid,
+					"Ignored invalid annotation example.org/cool: not cool",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			annotation:  "example.org/cool",
+			reason:      "not cool",
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewInvalidAnnotation(tc.ns, tc.ingressName, tc.annotation, tc.reason)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewInvalidAnnotation(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.annotation, tc.reason, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewInvalidAnnotation(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.annotation, tc.reason, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPassthroughConflict(t *testing.T) {
+	hosts := []string{"foo.example.com", "bar.example.com"}
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventTLSPassthroughConflict,
+					"Hosts foo.example.com, bar.example.com are passed through by one ingress and terminated by another",
+				}: true,
+			},
+		},
+		{
+			name:        "IngressNotInStore",
+			i:           mapIngressStore{},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			want:        map[event]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &mapRecorder{e: make(map[event]bool)}
+			r := NewKubernetesRecorder(mr, tc.i)
+			r.NewPassthroughConflict(tc.ns, tc.ingressName, hosts)
+
+			for e := range tc.want {
+				if !mr.e[e] {
+					t.Errorf("n.NewPassthroughConflict(%v, %v, %v): want event %#v", tc.ns, tc.ingressName, hosts, e)
+				}
+			}
+			for e := range mr.e {
+				if !tc.want[e] {
+					t.Errorf("n.NewPassthroughConflict(%v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, hosts, e)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInvalidClientCA(t *testing.T) {
+	cases := []struct {
+		name        string
+		i           mapIngressStore
+		ns          string
+		ingressName string
+		secretName  string
+		reason      string
+		want        map[event]bool
+	}{
+		{
+			name:        "Success",
+			i:           mapIngressStore{metadata{coolIngress.GetNamespace(), coolIngress.GetName()}: coolIngress},
+			ns:          namespace,
+			ingressName: coolIngressName,
+			secretName:  coolSecretName,
+			reason:      "secret has no ca.crt key",
+			want: map[event]bool{
+				{
+					metadata{namespace, coolIngressName},
+					v1.EventTypeWarning,
+					eventClientCASecretInvalid,
+					"Could not load client CA from invalid secret " + coolSecretName + ": secret has no ca.crt key",
 				}: true,
 			},
 		},
@@ -214,6 +663,7 @@ func TestNewInvalidSecret(t *testing.T) {
 			ns:          namespace,
 			ingressName: coolIngressName,
 			secretName:  coolSecretName,
+			reason:      "secret has no ca.crt key",
 			want:        map[event]bool{},
 		},
 	}
@@ -222,16 +672,16 @@ func TestNewInvalidSecret(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			mr := &mapRecorder{e: make(map[event]bool)}
 			r := NewKubernetesRecorder(mr, tc.i)
-			r.NewInvalidSecret(tc.ns, tc.ingressName, tc.secretName)
+			r.NewInvalidClientCA(tc.ns, tc.ingressName, tc.secretName, tc.reason)
 
 			for e := range tc.want {
 				if !mr.e[e] {
-					t.Errorf("n.NewInvalidSecret(%v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, e)
+					t.Errorf("n.NewInvalidClientCA(%v, %v, %v, %v): want event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
 				}
 			}
 			for e := range mr.e {
 				if !tc.want[e] {
-					t.Errorf("n.NewInvalidSecret(%v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, e)
+					t.Errorf("n.NewInvalidClientCA(%v, %v, %v, %v): got unwanted event %#v", tc.ns, tc.ingressName, tc.secretName, tc.reason, e)
 				}
 			}
 		})
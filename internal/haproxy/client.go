@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+// Package haproxy updates the TLS certificates of a running haproxy via its
+// runtime API, falling back to a reload when they cannot be updated in place.
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is the default time allowed for each runtime API command.
+const DefaultTimeout = 10 * time.Second
+
+// A Client sends commands to the haproxy runtime API, i.e. its stats socket.
+// The socket must be exposed at the admin level.
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClient creates a new runtime API client that connects to the supplied
+// address, e.g. ("unix", "/var/run/haproxy.sock").
+func NewClient(network, address string, timeout time.Duration) *Client {
+	return &Client{network: network, address: address, timeout: timeout}
+}
+
+// Execute sends the supplied command, with an optional multi-line payload, and
+// returns haproxy's response. Empty lines are removed from the payload, as an
+// empty line terminates it.
+func (c *Client) Execute(command string, payload []byte) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot connect to haproxy runtime API at %v", c.address)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", errors.Wrap(err, "cannot set runtime API deadline")
+	}
+
+	req := command + "\n"
+	if payload != nil {
+		req = command + " <<\n" + strings.Join(payloadLines(payload), "\n") + "\n\n"
+	}
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return "", errors.Wrapf(err, "cannot send runtime API command %q", command)
+	}
+	rsp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot read response to runtime API command %q", command)
+	}
+	return string(rsp), nil
+}
+
+func payloadLines(payload []byte) []string {
+	lines := []string{}
+	for _, l := range bytes.Split(payload, []byte("\n")) {
+		if l := strings.TrimRight(string(l), "\r"); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,481 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package haproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/planetlabs/hal5d/internal/webhook"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+const (
+	certSuffix = ".pem"
+	ocspSuffix = ".ocsp"
+)
+
+// An Executor executes haproxy runtime API commands.
+type Executor interface {
+	// Execute sends the supplied command, with an optional multi-line
+	// payload, and returns haproxy's response.
+	Execute(command string, payload []byte) (string, error)
+}
+
+// A Hook updates the cert pairs of a running haproxy in memory via its runtime
+// API, such that long lived connections survive certificate changes. Changed
+// cert pairs and OCSP responses are replaced in place. New and removed cert
+// pairs are added to and removed from the crt-list, if one is managed. A Hook
+// falls back to triggering a reload webhook when a change cannot be made via
+// the runtime API, including when any of its config files changed. A Hook
+// satisfies webhook.Hook, and is intended to be wrapped by a
+// subscriber.Subscriber.
+type Hook struct {
+	log         *zap.Logger
+	fs          afero.Fs
+	e           Executor
+	tlsDir      string
+	crtListFile string
+	staged      string
+	config      []string
+	reload      webhook.Hook
+	last        *snapshot
+}
+
+// An Option can be used to configure new Hooks.
+type Option func(*Hook) error
+
+// WithLogger configures a Hook's logger.
+func WithLogger(l *zap.Logger) Option {
+	return func(h *Hook) error {
+		h.log = l
+		return nil
+	}
+}
+
+// WithFilesystem configures the filesystem from which a Hook reads cert pairs.
+func WithFilesystem(fs afero.Fs) Option {
+	return func(h *Hook) error {
+		h.fs = fs
+		return nil
+	}
+}
+
+// WithCrtListFile specifies the crt-list from which haproxy loads its cert
+// pairs. Cert pairs can only be added and removed via the runtime API when
+// they are loaded from a crt-list.
+func WithCrtListFile(crtListFile string) Option {
+	return func(h *Hook) error {
+		h.crtListFile = crtListFile
+		return nil
+	}
+}
+
+// WithStagedFilePrefix specifies the prefix of temporary files in which cert
+// pairs are staged in the TLS directory. Staged files are ignored.
+func WithStagedFilePrefix(prefix string) Option {
+	return func(h *Hook) error {
+		h.staged = prefix
+		return nil
+	}
+}
+
+// WithConfigFiles specifies files other than cert pairs and the crt-list that
+// haproxy reads, for example map files. Directories are read non-recursively.
+// haproxy is reloaded whenever any of these files change.
+func WithConfigFiles(paths ...string) Option {
+	return func(h *Hook) error {
+		for _, p := range paths {
+			if p != "" {
+				h.config = append(h.config, p)
+			}
+		}
+		return nil
+	}
+}
+
+// New creates a new Hook that updates the cert pairs in the supplied TLS
+// directory via the supplied executor, or by triggering the supplied reload
+// webhook. The first trigger always reloads haproxy, such that the Hook knows
+// which cert pairs haproxy has loaded.
+func New(e Executor, tlsDir string, reload webhook.Hook, o ...Option) (*Hook, error) {
+	h := &Hook{
+		log:    zap.NewNop(),
+		fs:     afero.NewOsFs(),
+		e:      e,
+		tlsDir: tlsDir,
+		reload: reload,
+	}
+	for _, ho := range o {
+		if err := ho(h); err != nil {
+			return nil, errors.Wrap(err, "cannot apply hook option")
+		}
+	}
+	return h, nil
+}
+
+// A snapshot records the cert pairs (and other files) in the TLS directory, the
+// crt-list entries of each cert pair, and a fingerprint of each config file.
+type snapshot struct {
+	files   map[string][]byte
+	crtList map[string][]string
+	config  map[string][sha256.Size]byte
+}
+
+// Trigger updates haproxy's cert pairs to match those on disk.
+func (h *Hook) Trigger() error {
+	current, err := h.snapshot()
+	if err != nil {
+		return h.fallback(nil, err)
+	}
+	if h.last == nil {
+		return h.fallback(current, errors.New("cert pairs loaded by haproxy are unknown"))
+	}
+	cmds, err := h.plan(h.last, current)
+	if err != nil {
+		return h.fallback(current, err)
+	}
+	if len(cmds) == 0 {
+		return h.fallback(current, errors.New("no cert pairs changed"))
+	}
+	for _, c := range cmds {
+		if err := h.execute(c); err != nil {
+			// An uncommitted transaction would block future updates.
+			if c.abort != "" {
+				h.e.Execute(c.abort, nil) // nolint:gas,gosec
+			}
+			return h.fallback(current, err)
+		}
+	}
+	h.last = current
+	h.log.Info("updated cert pairs via runtime API", zap.Int("commands", len(cmds)))
+	return nil
+}
+
+// fallback reloads haproxy, after which haproxy has loaded the supplied
+// snapshot.
+func (h *Hook) fallback(s *snapshot, reason error) error {
+	h.log.Info("cannot update cert pairs via runtime API - reloading haproxy", zap.Error(reason))
+	h.last = nil
+	if err := h.reload.Trigger(); err != nil {
+		return errors.Wrap(err, "cannot reload haproxy")
+	}
+	h.last = s
+	return nil
+}
+
+func (h *Hook) snapshot() (*snapshot, error) {
+	fi, err := afero.ReadDir(h.fs, h.tlsDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list TLS cert pairs")
+	}
+	s := &snapshot{files: make(map[string][]byte), config: make(map[string][sha256.Size]byte)}
+	for _, f := range fi {
+		// hal5d writes OCSP responses to temporary dotfiles before moving
+		// them into place, and stages cert pairs in temporary files so that
+		// they can be validated before they are committed.
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || (h.staged != "" && strings.HasPrefix(f.Name(), h.staged)) {
+			continue
+		}
+		b, err := afero.ReadFile(h.fs, filepath.Join(h.tlsDir, f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read %v", f.Name())
+		}
+		s.files[f.Name()] = b
+	}
+	for _, path := range h.config {
+		if err := h.fingerprint(s, path); err != nil {
+			return nil, err
+		}
+	}
+	if h.crtListFile == "" {
+		return s, nil
+	}
+	b, err := afero.ReadFile(h.fs, h.crtListFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read crt-list")
+	}
+	s.crtList = make(map[string][]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path := strings.Fields(line)[0]
+		s.crtList[path] = append(s.crtList[path], line)
+	}
+	return s, nil
+}
+
+// fingerprint records a fingerprint of the supplied config file, or of each
+// file in the supplied config directory, in the supplied snapshot. Files that
+// do not exist are omitted.
+func (h *Hook) fingerprint(s *snapshot, path string) error {
+	fi, err := h.fs.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot stat %v", path)
+	}
+	if !fi.IsDir() {
+		b, err := afero.ReadFile(h.fs, path)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read %v", path)
+		}
+		s.config[path] = sha256.Sum256(b)
+		return nil
+	}
+	files, err := afero.ReadDir(h.fs, path)
+	if err != nil {
+		return errors.Wrapf(err, "cannot list %v", path)
+	}
+	for _, f := range files {
+		// Like OCSP responses, hal5d writes client CAs to temporary dotfiles.
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if err := h.fingerprint(s, filepath.Join(path, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A command is a runtime API command, and the response that indicates it
+// succeeded.
+type command struct {
+	line    string
+	payload []byte
+	success string
+
+	// abort is the command that aborts the transaction this command is part
+	// of, if any.
+	abort string
+}
+
+func (h *Hook) execute(c command) error {
+	rsp, err := h.e.Execute(c.line, c.payload)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(rsp, c.success) {
+		return errors.Errorf("runtime API command %q failed: %s", c.line, strings.TrimSpace(rsp))
+	}
+	h.log.Debug("executed runtime API command", zap.String("command", c.line))
+	return nil
+}
+
+// plan returns the runtime API commands that update haproxy from the old
+// snapshot to the new one. It returns an error if haproxy must be reloaded.
+func (h *Hook) plan(old, new *snapshot) ([]command, error) {
+	for path, o := range old.config {
+		if n, ok := new.config[path]; !ok || n != o {
+			return nil, errors.Errorf("%v changed", path)
+		}
+	}
+	for path := range new.config {
+		if _, ok := old.config[path]; !ok {
+			return nil, errors.Errorf("%v was added", path)
+		}
+	}
+
+	names := make(map[string]bool)
+	for f := range old.files {
+		names[f] = true
+	}
+	for f := range new.files {
+		names[f] = true
+	}
+
+	var changed, added, removed []string
+	ocsp := make(map[string]bool)
+	for f := range names {
+		o, inOld := old.files[f]
+		n, inNew := new.files[f]
+		if inOld && inNew && bytes.Equal(o, n) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(f, certSuffix+ocspSuffix):
+			if inNew {
+				ocsp[strings.TrimSuffix(f, ocspSuffix)] = true
+			}
+		case !strings.HasSuffix(f, certSuffix):
+			return nil, errors.Errorf("%v is not a cert pair", f)
+		case !inOld:
+			added = append(added, f)
+		case !inNew:
+			removed = append(removed, f)
+		default:
+			changed = append(changed, f)
+		}
+	}
+
+	// Replacing a cert pair discards its OCSP response, so a response may only
+	// be removed along with the cert pair it was stapled to. Unchanged cert
+	// pairs with a new OCSP response are replaced along with their response.
+	for f := range names {
+		cert := strings.TrimSuffix(f, ocspSuffix)
+		if cert == f || !strings.HasSuffix(cert, certSuffix) {
+			continue
+		}
+		o, inOld := old.files[cert]
+		n, inNew := new.files[cert]
+		if !inOld || !inNew || !bytes.Equal(o, n) {
+			continue
+		}
+		if _, ok := new.files[f]; !ok {
+			return nil, errors.Errorf("OCSP response %v was removed", f)
+		}
+		if ocsp[cert] {
+			changed = append(changed, cert)
+		}
+	}
+	if (len(added) > 0 || len(removed) > 0) && h.crtListFile == "" {
+		return nil, errors.New("cert pairs can only be added or removed via a crt-list")
+	}
+	sort.Strings(changed)
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	cmds := []command{}
+	for _, f := range changed {
+		cmds = append(cmds, h.update(f, new, ocsp[f])...)
+	}
+	for _, f := range added {
+		path := filepath.Join(h.tlsDir, f)
+		if len(new.crtList[path]) == 0 {
+			return nil, errors.Errorf("new cert pair %v is not in the crt-list", f)
+		}
+		cmds = append(cmds, command{line: "new ssl cert " + path, success: "New empty certificate store"})
+		cmds = append(cmds, h.update(f, new, ocsp[f])...)
+		cmds = append(cmds, h.addEntries(path, new.crtList[path])...)
+	}
+
+	// Cert pairs that are in both snapshots may have new crt-list entries,
+	// e.g. because the hosts of their ingress changed.
+	entries, err := h.planCrtList(old, new)
+	if err != nil {
+		return nil, err
+	}
+	cmds = append(cmds, entries...)
+
+	for _, f := range removed {
+		path := filepath.Join(h.tlsDir, f)
+		if len(old.crtList[path]) > 1 {
+			return nil, errors.Errorf("removed cert pair %v has multiple crt-list entries", f)
+		}
+		if len(old.crtList[path]) == 1 {
+			cmds = append(cmds, h.delEntry(path))
+		}
+		cmds = append(cmds, command{line: "del ssl cert " + path, success: "deleted!"})
+	}
+	return cmds, nil
+}
+
+// planCrtList returns the commands that update the crt-list entries of cert
+// pairs that are in both snapshots.
+func (h *Hook) planCrtList(old, new *snapshot) ([]command, error) {
+	paths := make(map[string]bool)
+	for p := range old.crtList {
+		paths[p] = true
+	}
+	for p := range new.crtList {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	cmds := []command{}
+	for _, path := range sorted {
+		o, n := old.crtList[path], new.crtList[path]
+		if equal(o, n) {
+			continue
+		}
+		f, err := filepath.Rel(h.tlsDir, path)
+		if err != nil || filepath.Dir(path) != filepath.Clean(h.tlsDir) {
+			return nil, errors.Errorf("crt-list entry %v is not in the TLS directory", path)
+		}
+		_, inOld := old.files[f]
+		_, inNew := new.files[f]
+		switch {
+		case !inOld && !inNew:
+			// A multi-cert bundle, which cannot be updated at runtime.
+			return nil, errors.Errorf("crt-list entry %v is not a cert pair", path)
+		case !inOld || !inNew:
+			// Added and removed cert pairs are handled by plan.
+			continue
+		case len(o) > 1:
+			return nil, errors.Errorf("cert pair %v has multiple crt-list entries", f)
+		}
+		if len(o) == 1 {
+			cmds = append(cmds, h.delEntry(path))
+		}
+		cmds = append(cmds, h.addEntries(path, n)...)
+	}
+	return cmds, nil
+}
+
+// update returns the commands that replace the supplied cert pair, and
+// optionally its OCSP response, in a single transaction.
+func (h *Hook) update(f string, s *snapshot, ocsp bool) []command {
+	path := filepath.Join(h.tlsDir, f)
+	abort := "abort ssl cert " + path
+	cmds := []command{{line: "set ssl cert " + path, payload: s.files[f], success: "Transaction", abort: abort}}
+	if ocsp {
+		// OCSP responses are DER encoded, and must be base64 encoded to be
+		// sent as a payload.
+		b64 := []byte(base64.StdEncoding.EncodeToString(s.files[f+ocspSuffix]))
+		cmds = append(cmds, command{line: "set ssl cert " + path + ocspSuffix, payload: b64, success: "Transaction", abort: abort})
+	}
+	return append(cmds, command{line: "commit ssl cert " + path, success: "Success!", abort: abort})
+}
+
+func (h *Hook) addEntries(path string, lines []string) []command {
+	cmds := make([]command, 0, len(lines))
+	for _, l := range lines {
+		cmds = append(cmds, command{line: "add ssl crt-list " + h.crtListFile, payload: []byte(l), success: "Success!"})
+	}
+	return cmds
+}
+
+func (h *Hook) delEntry(path string) command {
+	return command{line: "del ssl crt-list " + h.crtListFile + " " + path, success: "deleted in crtlist"}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
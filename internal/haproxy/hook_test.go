@@ -0,0 +1,291 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package haproxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/planetlabs/hal5d/internal/webhook"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+)
+
+type countingHook struct {
+	triggered int
+}
+
+func (h *countingHook) Trigger() error {
+	h.triggered++
+	return nil
+}
+
+type failingHook struct{}
+
+func (h *failingHook) Trigger() error {
+	return errors.New("boom")
+}
+
+func TestHook(t *testing.T) {
+	var _ webhook.Hook = &Hook{}
+
+	s := newStandIn(t)
+	defer s.Close()
+
+	fs := afero.NewMemMapFs()
+	write := func(path, data string) func() {
+		return func() {
+			if err := afero.WriteFile(fs, path, []byte(data), 0600); err != nil {
+				t.Fatalf("cannot write %v: %v", path, err)
+			}
+		}
+	}
+	remove := func(path string) func() {
+		return func() {
+			if err := fs.Remove(path); err != nil {
+				t.Fatalf("cannot remove %v: %v", path, err)
+			}
+		}
+	}
+	if err := fs.MkdirAll("/tls", 0700); err != nil {
+		t.Fatalf("cannot make TLS dir: %v", err)
+	}
+	write("/tls/a.pem", "cool")()
+	write("/shared/crt-list", "/tls/a.pem a.example.com")()
+	write("/shared/hsts.map", "a.example.com max-age=60")()
+	write("/ca/a.ca.pem", "cool")()
+
+	reload := &countingHook{}
+	h, err := New(s.client(), "/tls", reload,
+		WithFilesystem(fs),
+		WithCrtListFile("/shared/crt-list"),
+		WithStagedFilePrefix("staged-"),
+		WithConfigFiles("/shared/hsts.map", "/ca", ""))
+	if err != nil {
+		t.Fatalf("New(...): %v", err)
+	}
+
+	steps := []struct {
+		name         string
+		fn           []func()
+		fail         string
+		want         []string
+		wantReloaded int
+	}{
+		{
+			name:         "InitialTriggerReloads",
+			wantReloaded: 1,
+		},
+		{
+			name: "CertPairChanged",
+			fn:   []func(){write("/tls/a.pem", "dank")},
+			want: []string{
+				"set ssl cert /tls/a.pem",
+				"commit ssl cert /tls/a.pem",
+			},
+			wantReloaded: 1,
+		},
+		{
+			name: "CertPairAdded",
+			fn: []func(){
+				write("/tls/b.pem", "cool"),
+				write("/shared/crt-list", "/tls/a.pem a.example.com\n/tls/b.pem b.example.com"),
+			},
+			want: []string{
+				"new ssl cert /tls/b.pem",
+				"set ssl cert /tls/b.pem",
+				"commit ssl cert /tls/b.pem",
+				"add ssl crt-list /shared/crt-list",
+			},
+			wantReloaded: 1,
+		},
+		{
+			name: "OCSPResponseAdded",
+			fn:   []func(){write("/tls/a.pem.ocsp", "response")},
+			want: []string{
+				"set ssl cert /tls/a.pem",
+				"set ssl cert /tls/a.pem.ocsp",
+				"commit ssl cert /tls/a.pem",
+			},
+			wantReloaded: 1,
+		},
+		{
+			name: "CertPairChangedAndOCSPResponseRemoved",
+			fn:   []func(){write("/tls/a.pem", "cool"), remove("/tls/a.pem.ocsp")},
+			want: []string{
+				"set ssl cert /tls/a.pem",
+				"commit ssl cert /tls/a.pem",
+			},
+			wantReloaded: 1,
+		},
+		{
+			name: "HostsChanged",
+			fn:   []func(){write("/shared/crt-list", "/tls/a.pem a.example.com\n/tls/b.pem c.example.com")},
+			want: []string{
+				"del ssl crt-list /shared/crt-list /tls/b.pem",
+				"add ssl crt-list /shared/crt-list",
+			},
+			wantReloaded: 1,
+		},
+		{
+			name: "CertPairRemoved",
+			fn:   []func(){remove("/tls/b.pem"), write("/shared/crt-list", "/tls/a.pem a.example.com")},
+			want: []string{
+				"del ssl crt-list /shared/crt-list /tls/b.pem",
+				"del ssl cert /tls/b.pem",
+			},
+			wantReloaded: 1,
+		},
+		{
+			name:         "NoCertPairsChanged",
+			wantReloaded: 2,
+		},
+		{
+			name: "CommitFailed",
+			fn:   []func(){write("/tls/a.pem", "dank")},
+			fail: "commit ssl cert",
+			want: []string{
+				"set ssl cert /tls/a.pem",
+				"commit ssl cert /tls/a.pem",
+				"abort ssl cert /tls/a.pem",
+			},
+			wantReloaded: 3,
+		},
+		{
+			name: "OCSPResponseRemoved",
+			fn: []func(){
+				write("/tls/a.pem.ocsp", "response"),
+				func() {
+					if err := h.Trigger(); err != nil {
+						t.Fatalf("h.Trigger(): %v", err)
+					}
+					s.reset()
+				},
+				remove("/tls/a.pem.ocsp"),
+			},
+			wantReloaded: 4,
+		},
+		{
+			name: "MultiCertBundleAdded",
+			fn: []func(){
+				write("/tls/c.pem.rsa", "cool"),
+				write("/tls/c.pem.ecdsa", "dank"),
+				write("/shared/crt-list", "/tls/a.pem a.example.com\n/tls/c.pem c.example.com"),
+			},
+			wantReloaded: 5,
+		},
+		{
+			name: "TempFilesIgnored",
+			fn: []func(){
+				write("/tls/a.pem", "cool"),
+				write("/tls/.a.pem.ocsp123", "dank"),
+				write("/tls/staged-a.pem123", "dank"),
+				write("/ca/.client-ca-tempfile123", "dank"),
+			},
+			want: []string{
+				"set ssl cert /tls/a.pem",
+				"commit ssl cert /tls/a.pem",
+			},
+			wantReloaded: 5,
+		},
+		{
+			name:         "MapFileChangedWithCertPair",
+			fn:           []func(){write("/tls/a.pem", "dank"), write("/shared/hsts.map", "a.example.com max-age=120")},
+			wantReloaded: 6,
+		},
+		{
+			name:         "ClientCAChangedWithCertPair",
+			fn:           []func(){write("/tls/a.pem", "cool"), write("/ca/a.ca.pem", "dank")},
+			wantReloaded: 7,
+		},
+		{
+			name:         "ClientCAAdded",
+			fn:           []func(){write("/tls/a.pem", "dank"), write("/ca/b.ca.pem", "cool")},
+			wantReloaded: 8,
+		},
+		{
+			name:         "ClientCARemoved",
+			fn:           []func(){write("/tls/a.pem", "cool"), remove("/ca/b.ca.pem")},
+			wantReloaded: 9,
+		},
+	}
+
+	for _, st := range steps {
+		s.mu.Lock()
+		s.fail = st.fail
+		s.mu.Unlock()
+		for _, fn := range st.fn {
+			fn()
+		}
+
+		if err := h.Trigger(); err != nil {
+			t.Errorf("%v: h.Trigger(): %v", st.name, err)
+		}
+		if diff := deep.Equal(st.want, s.reset()); diff != nil {
+			t.Errorf("%v: want != got %v", st.name, diff)
+		}
+		if reload.triggered != st.wantReloaded {
+			t.Errorf("%v: want %v reloads, got %v", st.name, st.wantReloaded, reload.triggered)
+		}
+	}
+}
+
+func TestHookWithoutCrtList(t *testing.T) {
+	s := newStandIn(t)
+	defer s.Close()
+
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/tls/a.pem", []byte("cool"), 0600); err != nil {
+		t.Fatalf("cannot write cert pair: %v", err)
+	}
+	reload := &countingHook{}
+	h, err := New(s.client(), "/tls", reload, WithFilesystem(fs))
+	if err != nil {
+		t.Fatalf("New(...): %v", err)
+	}
+	if err := h.Trigger(); err != nil {
+		t.Fatalf("h.Trigger(): %v", err)
+	}
+
+	// Cert pairs can only be added via a crt-list.
+	if err := afero.WriteFile(fs, "/tls/b.pem", []byte("cool"), 0600); err != nil {
+		t.Fatalf("cannot write cert pair: %v", err)
+	}
+	if err := h.Trigger(); err != nil {
+		t.Fatalf("h.Trigger(): %v", err)
+	}
+	if got := s.reset(); len(got) != 0 {
+		t.Errorf("h.Trigger(): want no runtime API commands, got %v", got)
+	}
+	if reload.triggered != 2 {
+		t.Errorf("h.Trigger(): want 2 reloads, got %v", reload.triggered)
+	}
+}
+
+func TestHookReloadFailed(t *testing.T) {
+	s := newStandIn(t)
+	defer s.Close()
+
+	h, err := New(s.client(), "/tls", &failingHook{}, WithFilesystem(afero.NewMemMapFs()))
+	if err != nil {
+		t.Fatalf("New(...): %v", err)
+	}
+	if err := h.Trigger(); err == nil {
+		t.Errorf("h.Trigger(): want error, got nil")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Ingress API group versions, in order of preference.
+const (
+	GroupVersionNetworkingV1      = "networking.k8s.io/v1"
+	GroupVersionNetworkingV1beta1 = "networking.k8s.io/v1beta1"
+	GroupVersionExtensionsV1beta1 = "extensions/v1beta1"
+)
+
+const kindIngress = "Ingress"
+
+// An Ingress is an API version independent representation of the parts of an
+// ingress resource that hal5d cares about.
+type Ingress struct {
+	metav1.ObjectMeta
+
+	// APIVersion is the group version from which this ingress was read.
+	APIVersion string
+
+	Spec IngressSpec
+}
+
+// IngressSpec is the specification of an ingress.
+type IngressSpec struct {
+	// IngressClassName is the name of the IngressClass referenced by the
+	// ingress, if any.
+	IngressClassName string
+
+	Rules []IngressRule
+	TLS   []IngressTLS
+}
+
+// An IngressRule maps a host to the ingress' backends.
+type IngressRule struct {
+	Host string
+}
+
+// IngressTLS describes the TLS secret used for a set of hosts.
+type IngressTLS struct {
+	Hosts      []string
+	SecretName string
+}
+
+// Reference returns a reference to the ingress, suitable for recording
+// events against.
+func (i *Ingress) Reference() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:            kindIngress,
+		APIVersion:      i.APIVersion,
+		Namespace:       i.GetNamespace(),
+		Name:            i.GetName(),
+		UID:             i.GetUID(),
+		ResourceVersion: i.GetResourceVersion(),
+	}
+}
+
+// NewIngress converts the supplied ingress resource of any supported API
+// version into an Ingress. It returns false if the supplied object is not a
+// supported ingress resource.
+func NewIngress(obj interface{}) (*Ingress, bool) {
+	switch i := obj.(type) {
+	case *Ingress:
+		return i, true
+	case *networkingv1.Ingress:
+		return fromNetworkingV1(i), true
+	case *networkingv1beta1.Ingress:
+		return fromNetworkingV1beta1(i), true
+	case *v1beta1.Ingress:
+		return fromExtensionsV1beta1(i), true
+	}
+	return nil, false
+}
+
+func fromNetworkingV1(i *networkingv1.Ingress) *Ingress {
+	in := &Ingress{ObjectMeta: *i.ObjectMeta.DeepCopy(), APIVersion: GroupVersionNetworkingV1}
+	if i.Spec.IngressClassName != nil {
+		in.Spec.IngressClassName = *i.Spec.IngressClassName
+	}
+	for _, r := range i.Spec.Rules {
+		in.Spec.Rules = append(in.Spec.Rules, IngressRule{Host: r.Host})
+	}
+	for _, t := range i.Spec.TLS {
+		in.Spec.TLS = append(in.Spec.TLS, IngressTLS{Hosts: t.Hosts, SecretName: t.SecretName})
+	}
+	return in
+}
+
+func fromNetworkingV1beta1(i *networkingv1beta1.Ingress) *Ingress {
+	in := &Ingress{ObjectMeta: *i.ObjectMeta.DeepCopy(), APIVersion: GroupVersionNetworkingV1beta1}
+	if i.Spec.IngressClassName != nil {
+		in.Spec.IngressClassName = *i.Spec.IngressClassName
+	}
+	for _, r := range i.Spec.Rules {
+		in.Spec.Rules = append(in.Spec.Rules, IngressRule{Host: r.Host})
+	}
+	for _, t := range i.Spec.TLS {
+		in.Spec.TLS = append(in.Spec.TLS, IngressTLS{Hosts: t.Hosts, SecretName: t.SecretName})
+	}
+	return in
+}
+
+func fromExtensionsV1beta1(i *v1beta1.Ingress) *Ingress {
+	in := &Ingress{ObjectMeta: *i.ObjectMeta.DeepCopy(), APIVersion: GroupVersionExtensionsV1beta1}
+	if i.Spec.IngressClassName != nil {
+		in.Spec.IngressClassName = *i.Spec.IngressClassName
+	}
+	for _, r := range i.Spec.Rules {
+		in.Spec.Rules = append(in.Spec.Rules, IngressRule{Host: r.Host})
+	}
+	for _, t := range i.Spec.TLS {
+		in.Spec.TLS = append(in.Spec.TLS, IngressTLS{Hosts: t.Hosts, SecretName: t.SecretName})
+	}
+	return in
+}
+
+// An IngressClass is an API version independent representation of the parts
+// of an IngressClass resource that hal5d cares about.
+type IngressClass struct {
+	metav1.ObjectMeta
+
+	// Controller is the name of the controller that should handle ingresses
+	// of this class.
+	Controller string
+}
+
+// NewIngressClass converts the supplied IngressClass resource of any supported
+// API version into an IngressClass. It returns false if the supplied object is
+// not a supported IngressClass resource.
+func NewIngressClass(obj interface{}) (*IngressClass, bool) {
+	switch c := obj.(type) {
+	case *IngressClass:
+		return c, true
+	case *networkingv1.IngressClass:
+		return &IngressClass{ObjectMeta: *c.ObjectMeta.DeepCopy(), Controller: c.Spec.Controller}, true
+	case *networkingv1beta1.IngressClass:
+		return &IngressClass{ObjectMeta: *c.ObjectMeta.DeepCopy(), Controller: c.Spec.Controller}, true
+	}
+	return nil, false
+}
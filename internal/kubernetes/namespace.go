@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+const fieldNamespace = "metadata.namespace"
+
+const resyncPeriod = 30 * time.Minute
+
+// A Scope determines the namespaces in which resources are watched.
+type Scope struct {
+	// Namespaces to watch. One informer is run per namespace, allowing hal5d
+	// to run with namespaced RBAC roles. All namespaces are watched by a
+	// single informer if no namespaces are specified.
+	Namespaces []string
+
+	// ExcludeNamespaces are never watched.
+	ExcludeNamespaces []string
+}
+
+// AllNamespaces watches resources in all namespaces.
+var AllNamespaces = Scope{}
+
+func (s Scope) excluded(namespace string) bool {
+	for _, ns := range s.ExcludeNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// selectors returns a field selector for each namespace that should be
+// watched, keyed by namespace.
+func (s Scope) selectors() map[string]fields.Selector {
+	sel := make(map[string]fields.Selector)
+	if len(s.Namespaces) == 0 {
+		ex := make([]fields.Selector, 0, len(s.ExcludeNamespaces))
+		for _, ns := range s.ExcludeNamespaces {
+			ex = append(ex, fields.OneTermNotEqualSelector(fieldNamespace, ns))
+		}
+		sel[v1.NamespaceAll] = fields.AndSelectors(ex...)
+		return sel
+	}
+	for _, ns := range s.Namespaces {
+		if s.excluded(ns) {
+			continue
+		}
+		sel[ns] = fields.Everything()
+	}
+	return sel
+}
+
+// A namespacedInformer is a set of informers keyed by the namespace they
+// watch. A single informer keyed by v1.NamespaceAll watches all namespaces.
+type namespacedInformer map[string]cache.SharedInformer
+
+func newNamespacedInformer(g cache.Getter, resource string, obj runtime.Object, s Scope) namespacedInformer {
+	n := make(namespacedInformer)
+	for ns, sel := range s.selectors() {
+		lw := cache.NewListWatchFromClient(g, resource, ns, sel)
+		n[ns] = cache.NewSharedInformer(lw, obj, resyncPeriod)
+	}
+	return n
+}
+
+// AddEventHandler adds the supplied handler to every informer.
+func (n namespacedInformer) AddEventHandler(h cache.ResourceEventHandler) {
+	for _, i := range n {
+		i.AddEventHandler(h)
+	}
+}
+
+// Run every informer until the provided stop channel is closed.
+func (n namespacedInformer) Run(stop <-chan struct{}) {
+	wg := &sync.WaitGroup{}
+	for _, i := range n {
+		wg.Add(1)
+		go func(i cache.SharedInformer) {
+			defer wg.Done()
+			i.Run(stop)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// HasSynced returns true if every informer has synced.
+func (n namespacedInformer) HasSynced() bool {
+	for _, i := range n {
+		if !i.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// list returns the resources cached by every informer.
+func (n namespacedInformer) list() []interface{} {
+	l := []interface{}{}
+	for _, i := range n {
+		l = append(l, i.GetStore().List()...)
+	}
+	return l
+}
+
+// getByKey gets a resource from the informer watching the supplied namespace.
+func (n namespacedInformer) getByKey(namespace, name string) (interface{}, bool, error) {
+	i, ok := n[namespace]
+	if !ok {
+		i, ok = n[v1.NamespaceAll]
+	}
+	if !ok {
+		return nil, false, errors.Errorf("namespace %v is not watched", namespace)
+	}
+	return i.GetStore().GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"k8s.io/api/core/v1"
+)
+
+func TestScopeSelectors(t *testing.T) {
+	cases := []struct {
+		name  string
+		scope Scope
+		want  map[string]string
+	}{
+		{
+			name:  "AllNamespaces",
+			scope: AllNamespaces,
+			want:  map[string]string{v1.NamespaceAll: ""},
+		},
+		{
+			name:  "ExcludeNamespaces",
+			scope: Scope{ExcludeNamespaces: []string{"kube-system", "secret-stuff"}},
+			want:  map[string]string{v1.NamespaceAll: "metadata.namespace!=kube-system,metadata.namespace!=secret-stuff"},
+		},
+		{
+			name:  "Namespaces",
+			scope: Scope{Namespaces: []string{"team-a", "team-b"}},
+			want:  map[string]string{"team-a": "", "team-b": ""},
+		},
+		{
+			name:  "NamespacesWithExclusions",
+			scope: Scope{Namespaces: []string{"team-a", "team-b"}, ExcludeNamespaces: []string{"team-b"}},
+			want:  map[string]string{"team-a": ""},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make(map[string]string)
+			for ns, sel := range tc.scope.selectors() {
+				got[ns] = sel.String()
+			}
+			if diff := deep.Equal(tc.want, got); diff != nil {
+				t.Errorf("s.selectors(): want != got %v", diff)
+			}
+		})
+	}
+}
+
+func TestNamespacedInformerRouting(t *testing.T) {
+	byNamespace := func(namespace string) getByKeyFunc {
+		return func(k string) (interface{}, bool, error) {
+			return &v1.Secret{}, k == namespace+"/"+name, nil
+		}
+	}
+	n := namespacedInformer{
+		"team-a": &predictableInformer{fn: byNamespace("team-a")},
+		"team-b": &predictableInformer{fn: byNamespace("team-b")},
+	}
+	w := &SecretWatch{n}
+
+	for _, namespace := range []string{"team-a", "team-b"} {
+		if _, err := w.Get(namespace, name); err != nil {
+			t.Errorf("w.Get(%v, %v): %v", namespace, name, err)
+		}
+	}
+	if _, err := w.Get("team-c", name); err == nil {
+		t.Errorf("w.Get(%v, %v): want error for unwatched namespace", "team-c", name)
+	}
+}
@@ -36,11 +36,11 @@ type update struct {
 
 func (e update) ResourceEvent() {}
 
-type delete struct {
+type del struct {
 	obj interface{}
 }
 
-func (e delete) ResourceEvent() {}
+func (e del) ResourceEvent() {}
 
 // A SynchronousResourceEventHandler forwards all events
 type SynchronousResourceEventHandler struct {
@@ -74,7 +74,7 @@ func (b *SynchronousResourceEventHandler) forward(e resourceEventer) {
 		b.h.OnAdd(e.obj)
 	case *update:
 		b.h.OnUpdate(e.oldObj, e.newObj)
-	case *delete:
+	case *del:
 		b.h.OnDelete(e.obj)
 	}
 }
@@ -91,5 +91,5 @@ func (b *SynchronousResourceEventHandler) OnUpdate(oldObj, newObj interface{}) {
 
 // OnDelete forwards notifications of deleted resources.
 func (b *SynchronousResourceEventHandler) OnDelete(obj interface{}) {
-	b.event <- &delete{obj}
+	b.event <- &del{obj}
 }
@@ -0,0 +1,258 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/metrics"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// LabelKind labels tombstone metrics with the kind of resource tombstoned.
+const LabelKind = "kind"
+
+const (
+	tombstoneIngress = "ingress"
+	tombstoneSecret  = "secret"
+)
+
+type tombstoneKey struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+type tombstone struct {
+	obj   interface{}
+	timer *time.Timer
+}
+
+// A TombstoningResourceEventHandler delays notifications of deleted ingresses
+// and secrets for a grace period, during which the deleted resource is
+// tombstoned. The deletion is forwarded to the registered handlers once the
+// grace period elapses, unless the resource reappears first. This avoids
+// removing and then rewriting the cert pairs of resources that are deleted and
+// recreated. A TombstoningResourceEventHandler is also a SecretStore that
+// returns tombstoned secrets, such that they remain in use for the grace
+// period.
+type TombstoningResourceEventHandler struct {
+	log     *zap.Logger
+	pending metrics.GaugeVec
+	s       SecretStore
+	grace   time.Duration
+
+	// fwd serialises notifications forwarded to the registered handlers,
+	// which may look up secrets while a notification is being forwarded. mu
+	// guards the tombstones, and is never held while forwarding.
+	fwd        sync.Mutex
+	h          []cache.ResourceEventHandler
+	mu         sync.Mutex
+	tombstones map[tombstoneKey]*tombstone
+}
+
+// A TombstoneOption can be used to configure new
+// TombstoningResourceEventHandlers.
+type TombstoneOption func(*TombstoningResourceEventHandler) error
+
+// WithTombstoneLogger configures a TombstoningResourceEventHandler's logger.
+func WithTombstoneLogger(l *zap.Logger) TombstoneOption {
+	return func(h *TombstoningResourceEventHandler) error {
+		h.log = l
+		return nil
+	}
+}
+
+// WithPendingTombstones configures a gauge exposing the number of pending
+// tombstones of each kind of resource, labelled with LabelKind.
+func WithPendingTombstones(g metrics.GaugeVec) TombstoneOption {
+	return func(h *TombstoningResourceEventHandler) error {
+		h.pending = g
+		return nil
+	}
+}
+
+// NewTombstoningResourceEventHandler returns a new ResourceEventHandler that
+// delays notifications of deleted resources for the supplied grace period.
+// Secrets are looked up in the supplied store, falling back to tombstoned
+// secrets.
+func NewTombstoningResourceEventHandler(s SecretStore, grace time.Duration, o ...TombstoneOption) (*TombstoningResourceEventHandler, error) {
+	if grace <= 0 {
+		return nil, errors.Errorf("deletion grace period %v must be positive", grace)
+	}
+	h := &TombstoningResourceEventHandler{
+		log:        zap.NewNop(),
+		pending:    &metrics.NopGaugeVec{},
+		s:          s,
+		grace:      grace,
+		tombstones: make(map[tombstoneKey]*tombstone),
+	}
+	for _, to := range o {
+		if err := to(h); err != nil {
+			return nil, errors.Wrap(err, "cannot apply tombstone option")
+		}
+	}
+	return h, nil
+}
+
+// AddEventHandler registers a handler to be notified of resources that are
+// added or updated, and of resources that remain deleted once their grace
+// period elapses.
+func (h *TombstoningResourceEventHandler) AddEventHandler(r cache.ResourceEventHandler) {
+	h.fwd.Lock()
+	defer h.fwd.Unlock()
+	h.h = append(h.h, r)
+}
+
+// OnAdd forwards notifications of new resources, cancelling any pending
+// deletion of the resource.
+func (h *TombstoningResourceEventHandler) OnAdd(obj interface{}) {
+	h.fwd.Lock()
+	defer h.fwd.Unlock()
+	h.resurrect(obj)
+	for _, r := range h.h {
+		r.OnAdd(obj)
+	}
+}
+
+// OnUpdate forwards notifications of updated resources, cancelling any pending
+// deletion of the resource.
+func (h *TombstoningResourceEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.fwd.Lock()
+	defer h.fwd.Unlock()
+	h.resurrect(newObj)
+	for _, r := range h.h {
+		r.OnUpdate(oldObj, newObj)
+	}
+}
+
+// OnDelete tombstones deleted resources. Notifications of resources other than
+// ingresses and secrets are forwarded immediately.
+func (h *TombstoningResourceEventHandler) OnDelete(obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	k, ok := key(obj)
+	if !ok {
+		h.fwd.Lock()
+		defer h.fwd.Unlock()
+		for _, r := range h.h {
+			r.OnDelete(obj)
+		}
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.tombstones[k]; ok {
+		t.timer.Stop()
+	}
+	t := &tombstone{obj: obj}
+	t.timer = time.AfterFunc(h.grace, func() { h.expire(k, t) })
+	h.tombstones[k] = t
+	h.log.Info("deferring deletion until grace period elapses",
+		zap.String("kind", k.Kind),
+		zap.String("namespace", k.Namespace),
+		zap.String("name", k.Name),
+		zap.Duration("gracePeriod", h.grace))
+	h.observe(k.Kind)
+}
+
+// Get a secret by namespace and name, falling back to tombstoned secrets.
+// Returns an error if the secret does not exist and is not tombstoned.
+func (h *TombstoningResourceEventHandler) Get(namespace, name string) (*v1.Secret, error) {
+	s, err := h.s.Get(namespace, name)
+	if err == nil {
+		return s, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.tombstones[tombstoneKey{Kind: tombstoneSecret, Namespace: namespace, Name: name}]; ok {
+		return t.obj.(*v1.Secret), nil
+	}
+	return nil, err
+}
+
+// resurrect cancels the pending deletion of the supplied resource, if any.
+func (h *TombstoningResourceEventHandler) resurrect(obj interface{}) {
+	k, ok := key(obj)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tombstones[k]
+	if !ok {
+		return
+	}
+	t.timer.Stop()
+	delete(h.tombstones, k)
+	h.log.Info("deleted resource reappeared during grace period - cancelled deletion",
+		zap.String("kind", k.Kind),
+		zap.String("namespace", k.Namespace),
+		zap.String("name", k.Name))
+	h.observe(k.Kind)
+}
+
+// expire forwards the deletion of the supplied tombstoned resource, unless it
+// has since reappeared or been tombstoned again.
+func (h *TombstoningResourceEventHandler) expire(k tombstoneKey, t *tombstone) {
+	h.fwd.Lock()
+	defer h.fwd.Unlock()
+	h.mu.Lock()
+	if h.tombstones[k] != t {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.tombstones, k)
+	h.log.Info("grace period elapsed - applying deletion",
+		zap.String("kind", k.Kind),
+		zap.String("namespace", k.Namespace),
+		zap.String("name", k.Name))
+	h.observe(k.Kind)
+	h.mu.Unlock()
+	for _, r := range h.h {
+		r.OnDelete(t.obj)
+	}
+}
+
+// observe updates the number of pending tombstones of the supplied kind. The
+// caller must hold h.mu.
+func (h *TombstoningResourceEventHandler) observe(kind string) {
+	n := 0
+	for k := range h.tombstones {
+		if k.Kind == kind {
+			n++
+		}
+	}
+	h.pending.With(prometheus.Labels{LabelKind: kind}).Set(float64(n))
+}
+
+func key(obj interface{}) (tombstoneKey, bool) {
+	switch o := obj.(type) {
+	case *Ingress:
+		return tombstoneKey{Kind: tombstoneIngress, Namespace: o.GetNamespace(), Name: o.GetName()}, true
+	case *v1.Secret:
+		return tombstoneKey{Kind: tombstoneSecret, Namespace: o.GetNamespace(), Name: o.GetName()}, true
+	}
+	return tombstoneKey{}, false
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/metrics"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testGrace = 20 * time.Millisecond
+
+type recordingHandler struct {
+	mu     sync.Mutex
+	events []string
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (h *recordingHandler) record(e string, obj interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if k, ok := key(obj); ok {
+		e += " " + k.Kind + " " + k.Namespace + "/" + k.Name
+	}
+	h.events = append(h.events, e)
+	h.once.Do(func() { close(h.done) })
+}
+
+func (h *recordingHandler) OnAdd(obj interface{})               { h.record("add", obj) }
+func (h *recordingHandler) OnUpdate(oldObj, newObj interface{}) { h.record("update", newObj) }
+func (h *recordingHandler) OnDelete(obj interface{})            { h.record("delete", obj) }
+
+func (h *recordingHandler) Events() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+type noSecrets struct{}
+
+func (s noSecrets) Get(namespace, name string) (*v1.Secret, error) {
+	return nil, errors.New("secret does not exist")
+}
+
+type countGaugeVec struct {
+	metrics.NopGaugeVec
+	mu sync.Mutex
+	v  map[string]float64
+}
+
+type countGauge struct {
+	metrics.NopGauge
+	set func(float64)
+}
+
+func (g *countGauge) Set(v float64) { g.set(v) }
+
+func (c *countGaugeVec) With(l prometheus.Labels) prometheus.Gauge {
+	return &countGauge{set: func(v float64) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.v[l[LabelKind]] = v
+	}}
+}
+
+func (c *countGaugeVec) Get(kind string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v[kind]
+}
+
+func TestTombstoningResourceEventHandler(t *testing.T) {
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+	ingress := &Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+
+	cases := []struct {
+		name        string
+		fn          func(h *TombstoningResourceEventHandler)
+		wantPending map[string]float64
+		want        []string
+	}{
+		{
+			name:        "SecretDeleted",
+			fn:          func(h *TombstoningResourceEventHandler) { h.OnDelete(secret) },
+			wantPending: map[string]float64{tombstoneSecret: 1},
+			want:        []string{"delete secret namespace/name"},
+		},
+		{
+			name:        "IngressDeleted",
+			fn:          func(h *TombstoningResourceEventHandler) { h.OnDelete(ingress) },
+			wantPending: map[string]float64{tombstoneIngress: 1},
+			want:        []string{"delete ingress namespace/name"},
+		},
+		{
+			name: "SecretRecreated",
+			fn: func(h *TombstoningResourceEventHandler) {
+				h.OnDelete(secret)
+				h.OnAdd(secret)
+			},
+			wantPending: map[string]float64{tombstoneSecret: 0},
+			want:        []string{"add secret namespace/name"},
+		},
+		{
+			name: "IngressRecreated",
+			fn: func(h *TombstoningResourceEventHandler) {
+				h.OnDelete(ingress)
+				h.OnUpdate(nil, ingress)
+			},
+			wantPending: map[string]float64{tombstoneIngress: 0},
+			want:        []string{"update ingress namespace/name"},
+		},
+		{
+			name:        "OtherResourceDeleted",
+			fn:          func(h *TombstoningResourceEventHandler) { h.OnDelete("other") },
+			wantPending: map[string]float64{},
+			want:        []string{"delete"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pending := &countGaugeVec{v: make(map[string]float64)}
+			r := &recordingHandler{done: make(chan struct{})}
+			h, err := NewTombstoningResourceEventHandler(noSecrets{}, testGrace, WithPendingTombstones(pending))
+			if err != nil {
+				t.Fatalf("NewTombstoningResourceEventHandler(...): %v", err)
+			}
+			h.AddEventHandler(r)
+
+			tc.fn(h)
+			for kind, want := range tc.wantPending {
+				if got := pending.Get(kind); got != want {
+					t.Errorf("want %v pending %v tombstones, got %v", want, kind, got)
+				}
+			}
+
+			// Wait for the grace period of any tombstones to elapse.
+			time.Sleep(3 * testGrace)
+			if diff := deep.Equal(tc.want, r.Events()); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+			for kind := range tc.wantPending {
+				if got := pending.Get(kind); got != 0 {
+					t.Errorf("want no pending %v tombstones after grace period, got %v", kind, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTombstonedSecretStore(t *testing.T) {
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+	r := &recordingHandler{done: make(chan struct{})}
+	h, err := NewTombstoningResourceEventHandler(noSecrets{}, testGrace)
+	if err != nil {
+		t.Fatalf("NewTombstoningResourceEventHandler(...): %v", err)
+	}
+	h.AddEventHandler(r)
+
+	if _, err := h.Get(ns, name); err == nil {
+		t.Errorf("h.Get(%v, %v): want error for secret that does not exist", ns, name)
+	}
+	h.OnDelete(secret)
+	if got, err := h.Get(ns, name); err != nil || got != secret {
+		t.Errorf("h.Get(%v, %v): want tombstoned secret, got %v, %v", ns, name, got, err)
+	}
+	select {
+	case <-r.done:
+	case <-time.After(10 * testGrace):
+		t.Fatalf("deletion was not forwarded after grace period")
+	}
+	if _, err := h.Get(ns, name); err == nil {
+		t.Errorf("h.Get(%v, %v): want error for secret whose grace period elapsed", ns, name)
+	}
+}
+
+func TestTombstoningResourceEventHandlerGrace(t *testing.T) {
+	if _, err := NewTombstoningResourceEventHandler(noSecrets{}, 0); err == nil {
+		t.Errorf("NewTombstoningResourceEventHandler(...): want error for zero grace period")
+	}
+}
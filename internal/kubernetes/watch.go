@@ -17,58 +17,242 @@ and limitations under the License.
 package kubernetes
 
 import (
-	"fmt"
-	"time"
-
 	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	resourceIngress = "ingresses"
-	resourceSecret  = "secrets"
+	resourceIngress      = "ingresses"
+	resourceIngressClass = "ingressclasses"
+	resourceSecret       = "secrets"
 )
 
 // An IngressStore is a cache of ingress resources.
 type IngressStore interface {
 	// Get an ingress by namespace and name. Returns an error if the ingress
 	// does not exist.
-	Get(namespace, name string) (*v1beta1.Ingress, error)
+	Get(namespace, name string) (*Ingress, error)
+}
+
+var errNotServed = errors.New("API server does not serve any supported API version")
+
+// IsNotServed determines whether an error indicates the API server does not
+// serve any supported version of a resource.
+func IsNotServed(err error) bool {
+	return errors.Cause(err) == errNotServed
+}
+
+// An apiVersion describes how to list and watch a resource of a particular
+// API group version.
+type apiVersion struct {
+	groupVersion string
+	getter       func(kubernetes.Interface) cache.Getter
+	obj          runtime.Object
+}
+
+// ingressVersions are the supported ingress API group versions, in order of
+// preference.
+var ingressVersions = []apiVersion{
+	{
+		groupVersion: GroupVersionNetworkingV1,
+		getter:       func(c kubernetes.Interface) cache.Getter { return c.NetworkingV1().RESTClient() },
+		obj:          &networkingv1.Ingress{},
+	},
+	{
+		groupVersion: GroupVersionNetworkingV1beta1,
+		getter:       func(c kubernetes.Interface) cache.Getter { return c.NetworkingV1beta1().RESTClient() },
+		obj:          &networkingv1beta1.Ingress{},
+	},
+	{
+		groupVersion: GroupVersionExtensionsV1beta1,
+		getter:       func(c kubernetes.Interface) cache.Getter { return c.ExtensionsV1beta1().RESTClient() },
+		obj:          &v1beta1.Ingress{},
+	},
+}
+
+// ingressClassVersions are the supported IngressClass API group versions, in
+// order of preference.
+var ingressClassVersions = []apiVersion{
+	{
+		groupVersion: GroupVersionNetworkingV1,
+		getter:       func(c kubernetes.Interface) cache.Getter { return c.NetworkingV1().RESTClient() },
+		obj:          &networkingv1.IngressClass{},
+	},
+	{
+		groupVersion: GroupVersionNetworkingV1beta1,
+		getter:       func(c kubernetes.Interface) cache.Getter { return c.NetworkingV1beta1().RESTClient() },
+		obj:          &networkingv1beta1.IngressClass{},
+	},
+}
+
+// discover returns the most preferred of the supplied API versions that serves
+// the supplied resource.
+func discover(d discovery.ServerResourcesInterface, resource string, vs []apiVersion) (apiVersion, error) {
+	for _, v := range vs {
+		rs, err := d.ServerResourcesForGroupVersion(v.groupVersion)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return apiVersion{}, errors.Wrapf(err, "cannot discover resources for %v", v.groupVersion)
+		}
+		if rs == nil {
+			continue
+		}
+		for _, r := range rs.APIResources {
+			if r.Name == resource {
+				return v, nil
+			}
+		}
+	}
+	return apiVersion{}, errors.Wrap(errNotServed, resource)
+}
+
+// DiscoverIngressVersion returns the most preferred ingress API group version
+// served by the API server.
+func DiscoverIngressVersion(d discovery.ServerResourcesInterface) (string, error) {
+	v, err := discover(d, resourceIngress, ingressVersions)
+	return v.groupVersion, err
 }
 
 // An IngressWatch is a cache of ingress resources that notifies registered
-// handlers when its contents change.
+// handlers when its contents change. Ingresses are converted to an Ingress
+// regardless of the API version from which they were read.
 type IngressWatch struct {
-	cache.SharedInformer
+	namespacedInformer
 }
 
-// NewIngressWatch creates a watch on ingress resources. Ingresses are cached
-// and the provided ResourceEventHandlers are called when the cache changes.
-func NewIngressWatch(client kubernetes.Interface, rs ...cache.ResourceEventHandler) *IngressWatch {
-	lw := cache.NewListWatchFromClient(client.ExtensionsV1beta1().RESTClient(), resourceIngress, v1.NamespaceAll, fields.Everything())
-	i := cache.NewSharedInformer(lw, &v1beta1.Ingress{}, 30*time.Minute)
+// NewIngressWatch creates a watch on ingress resources in the supplied scope.
+// The most preferred ingress API version served by the API server is
+// discovered and watched. Ingresses are cached and the provided
+// ResourceEventHandlers are called when the cache changes.
+func NewIngressWatch(client kubernetes.Interface, s Scope, rs ...cache.ResourceEventHandler) (*IngressWatch, error) {
+	v, err := discover(client.Discovery(), resourceIngress, ingressVersions)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot discover ingress API version")
+	}
+	w := &IngressWatch{newNamespacedInformer(v.getter(client), resourceIngress, v.obj, s)}
 	for _, r := range rs {
-		i.AddEventHandler(r)
+		w.AddEventHandler(r)
 	}
-	return &IngressWatch{i}
+	return w, nil
+}
+
+// AddEventHandler adds a handler to the watch. Ingresses are converted to an
+// Ingress before they are passed to the handler.
+func (w *IngressWatch) AddEventHandler(h cache.ResourceEventHandler) {
+	w.namespacedInformer.AddEventHandler(&ingressHandler{h})
 }
 
 // Get an ingress by namespace and name. Returns an error if the ingress does
 // not exist.
-func (w *IngressWatch) Get(namespace, name string) (*v1beta1.Ingress, error) {
-	key := fmt.Sprintf("%s/%s", namespace, name)
-	o, exists, err := w.GetStore().GetByKey(key)
+func (w *IngressWatch) Get(namespace, name string) (*Ingress, error) {
+	o, exists, err := w.getByKey(namespace, name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot get ingress %v", key)
+		return nil, errors.Wrapf(err, "cannot get ingress %s/%s", namespace, name)
 	}
 	if !exists {
 		return nil, errors.New("ingress does not exist")
 	}
-	return o.(*v1beta1.Ingress), nil
+	i, ok := NewIngress(o)
+	if !ok {
+		return nil, errors.Errorf("cannot convert %T to an ingress", o)
+	}
+	return i, nil
+}
+
+// List all cached ingresses.
+func (w *IngressWatch) List() []*Ingress {
+	l := []*Ingress{}
+	for _, o := range w.list() {
+		if i, ok := NewIngress(o); ok {
+			l = append(l, i)
+		}
+	}
+	return l
+}
+
+// An ingressHandler converts ingress resources to an Ingress before passing
+// them to the wrapped handler.
+type ingressHandler struct {
+	h cache.ResourceEventHandler
+}
+
+func (h *ingressHandler) OnAdd(obj interface{}) {
+	if i, ok := NewIngress(obj); ok {
+		h.h.OnAdd(i)
+	}
+}
+
+func (h *ingressHandler) OnUpdate(oldObj, newObj interface{}) {
+	o, _ := NewIngress(oldObj)
+	if n, ok := NewIngress(newObj); ok {
+		h.h.OnUpdate(o, n)
+	}
+}
+
+func (h *ingressHandler) OnDelete(obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	if i, ok := NewIngress(obj); ok {
+		h.h.OnDelete(i)
+	}
+}
+
+// An IngressClassStore is a cache of IngressClass resources.
+type IngressClassStore interface {
+	// Get an IngressClass by name. Returns an error if the IngressClass does
+	// not exist.
+	Get(name string) (*IngressClass, error)
+}
+
+// An IngressClassWatch is a cache of IngressClass resources.
+type IngressClassWatch struct {
+	cache.SharedInformer
+}
+
+// NewIngressClassWatch creates a watch on IngressClass resources. The most
+// preferred IngressClass API version served by the API server is discovered
+// and watched. Returns an error that satisfies IsNotServed if the API server
+// does not serve IngressClasses.
+func NewIngressClassWatch(client kubernetes.Interface, rs ...cache.ResourceEventHandler) (*IngressClassWatch, error) {
+	v, err := discover(client.Discovery(), resourceIngressClass, ingressClassVersions)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot discover IngressClass API version")
+	}
+	lw := cache.NewListWatchFromClient(v.getter(client), resourceIngressClass, v1.NamespaceAll, fields.Everything())
+	i := cache.NewSharedInformer(lw, v.obj, resyncPeriod)
+	for _, r := range rs {
+		i.AddEventHandler(r)
+	}
+	return &IngressClassWatch{i}, nil
+}
+
+// Get an IngressClass by name. Returns an error if the IngressClass does not
+// exist.
+func (w *IngressClassWatch) Get(name string) (*IngressClass, error) {
+	o, exists, err := w.GetStore().GetByKey(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get IngressClass %v", name)
+	}
+	if !exists {
+		return nil, errors.New("IngressClass does not exist")
+	}
+	c, ok := NewIngressClass(o)
+	if !ok {
+		return nil, errors.Errorf("cannot convert %T to an IngressClass", o)
+	}
+	return c, nil
 }
 
 // A SecretStore is a cache of secret resources.
@@ -81,27 +265,26 @@ type SecretStore interface {
 // A SecretWatch is a cache of ingress resources that notifies registered
 // handlers when its contents change.
 type SecretWatch struct {
-	cache.SharedInformer
+	namespacedInformer
 }
 
-// NewSecretWatch creates a watch on secret resources. Secrets are cached
-// and the provided ResourceEventHandlers are called when the cache changes.
-func NewSecretWatch(client kubernetes.Interface, rs ...cache.ResourceEventHandler) *SecretWatch {
-	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), resourceSecret, v1.NamespaceAll, fields.Everything())
-	i := cache.NewSharedInformer(lw, &v1.Secret{}, 30*time.Minute)
+// NewSecretWatch creates a watch on secret resources in the supplied scope.
+// Secrets are cached and the provided ResourceEventHandlers are called when
+// the cache changes.
+func NewSecretWatch(client kubernetes.Interface, s Scope, rs ...cache.ResourceEventHandler) *SecretWatch {
+	w := &SecretWatch{newNamespacedInformer(client.CoreV1().RESTClient(), resourceSecret, &v1.Secret{}, s)}
 	for _, r := range rs {
-		i.AddEventHandler(r)
+		w.AddEventHandler(r)
 	}
-	return &SecretWatch{i}
+	return w
 }
 
 // Get an secret by namespace and name. Returns an error if the secret does
 // not exist.
 func (w *SecretWatch) Get(namespace, name string) (*v1.Secret, error) {
-	key := fmt.Sprintf("%s/%s", namespace, name)
-	o, exists, err := w.GetStore().GetByKey(key)
+	o, exists, err := w.getByKey(namespace, name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot get secret %v", key)
+		return nil, errors.Wrapf(err, "cannot get secret %s/%s", namespace, name)
 	}
 	if !exists {
 		return nil, errors.New("secret does not exist")
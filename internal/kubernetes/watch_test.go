@@ -24,6 +24,11 @@ import (
 	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -47,7 +52,7 @@ func TestIngressWatcher(t *testing.T) {
 	cases := []struct {
 		name    string
 		fn      getByKeyFunc
-		want    *v1beta1.Ingress
+		want    *Ingress
 		wantErr bool
 	}{
 		{
@@ -55,7 +60,34 @@ func TestIngressWatcher(t *testing.T) {
 			fn: func(k string) (interface{}, bool, error) {
 				return &v1beta1.Ingress{}, true, nil
 			},
-			want: &v1beta1.Ingress{},
+			want: &Ingress{APIVersion: GroupVersionExtensionsV1beta1},
+		},
+		{
+			name: "NetworkingV1IngressExists",
+			fn: func(k string) (interface{}, bool, error) {
+				return &networkingv1.Ingress{
+					ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+					Spec: networkingv1.IngressSpec{
+						Rules: []networkingv1.IngressRule{{Host: "example.com"}},
+						TLS:   []networkingv1.IngressTLS{{Hosts: []string{"example.com"}, SecretName: "secret"}},
+					},
+				}, true, nil
+			},
+			want: &Ingress{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+				APIVersion: GroupVersionNetworkingV1,
+				Spec: IngressSpec{
+					Rules: []IngressRule{{Host: "example.com"}},
+					TLS:   []IngressTLS{{Hosts: []string{"example.com"}, SecretName: "secret"}},
+				},
+			},
+		},
+		{
+			name: "NotAnIngress",
+			fn: func(k string) (interface{}, bool, error) {
+				return &v1.Secret{}, true, nil
+			},
+			wantErr: true,
 		},
 		{
 			name: "IngressDoesNotExist",
@@ -76,7 +108,7 @@ func TestIngressWatcher(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			i := &predictableInformer{fn: tc.fn}
-			w := &IngressWatch{i}
+			w := &IngressWatch{namespacedInformer{v1.NamespaceAll: i}}
 			got, err := w.Get(ns, name)
 			if err != nil {
 				if tc.wantErr {
@@ -91,6 +123,131 @@ func TestIngressWatcher(t *testing.T) {
 		})
 	}
 }
+
+type mapDiscovery struct {
+	discovery.ServerResourcesInterface
+	rs map[string]*metav1.APIResourceList
+}
+
+func (d *mapDiscovery) ServerResourcesForGroupVersion(gv string) (*metav1.APIResourceList, error) {
+	rs, ok := d.rs[gv]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{}, gv)
+	}
+	return rs, nil
+}
+
+func ingresses(gv string) *metav1.APIResourceList {
+	return &metav1.APIResourceList{GroupVersion: gv, APIResources: []metav1.APIResource{{Name: resourceIngress}}}
+}
+
+func TestDiscoverIngressVersion(t *testing.T) {
+	cases := []struct {
+		name    string
+		d       map[string]*metav1.APIResourceList
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "AllVersionsServed",
+			d: map[string]*metav1.APIResourceList{
+				GroupVersionNetworkingV1:      ingresses(GroupVersionNetworkingV1),
+				GroupVersionNetworkingV1beta1: ingresses(GroupVersionNetworkingV1beta1),
+				GroupVersionExtensionsV1beta1: ingresses(GroupVersionExtensionsV1beta1),
+			},
+			want: GroupVersionNetworkingV1,
+		},
+		{
+			name: "OnlyNetworkingV1beta1Served",
+			d: map[string]*metav1.APIResourceList{
+				GroupVersionNetworkingV1:      &metav1.APIResourceList{GroupVersion: GroupVersionNetworkingV1},
+				GroupVersionNetworkingV1beta1: ingresses(GroupVersionNetworkingV1beta1),
+				GroupVersionExtensionsV1beta1: ingresses(GroupVersionExtensionsV1beta1),
+			},
+			want: GroupVersionNetworkingV1beta1,
+		},
+		{
+			name: "OnlyExtensionsV1beta1Served",
+			d: map[string]*metav1.APIResourceList{
+				GroupVersionExtensionsV1beta1: ingresses(GroupVersionExtensionsV1beta1),
+			},
+			want: GroupVersionExtensionsV1beta1,
+		},
+		{
+			name:    "NoVersionsServed",
+			d:       map[string]*metav1.APIResourceList{},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DiscoverIngressVersion(&mapDiscovery{rs: tc.d})
+			if err != nil {
+				if tc.wantErr && IsNotServed(err) {
+					return
+				}
+				t.Errorf("DiscoverIngressVersion(): %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("DiscoverIngressVersion(): want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestIngressClassWatcher(t *testing.T) {
+	cases := []struct {
+		name    string
+		fn      getByKeyFunc
+		want    *IngressClass
+		wantErr bool
+	}{
+		{
+			name: "IngressClassExists",
+			fn: func(k string) (interface{}, bool, error) {
+				return &networkingv1.IngressClass{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec:       networkingv1.IngressClassSpec{Controller: "example.org/hal5d"},
+				}, true, nil
+			},
+			want: &IngressClass{ObjectMeta: metav1.ObjectMeta{Name: name}, Controller: "example.org/hal5d"},
+		},
+		{
+			name: "IngressClassDoesNotExist",
+			fn: func(k string) (interface{}, bool, error) {
+				return nil, false, nil
+			},
+			wantErr: true,
+		},
+		{
+			name: "ErrorGettingIngressClass",
+			fn: func(k string) (interface{}, bool, error) {
+				return nil, false, errors.New("boom")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &predictableInformer{fn: tc.fn}
+			w := &IngressClassWatch{i}
+			got, err := w.Get(name)
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Errorf("w.Get(%v): %v", name, err)
+			}
+
+			if diff := deep.Equal(tc.want, got); diff != nil {
+				t.Errorf("w.Get(%v): want != got %v", name, diff)
+			}
+		})
+	}
+}
+
 func TestSecretWatcher(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -124,7 +281,7 @@ func TestSecretWatcher(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			i := &predictableInformer{fn: tc.fn}
-			w := &SecretWatch{i}
+			w := &SecretWatch{namespacedInformer{v1.NamespaceAll: i}}
 			got, err := w.Get(ns, name)
 			if err != nil {
 				if tc.wantErr != "" && err.Error() == tc.wantErr {
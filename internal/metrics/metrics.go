@@ -50,3 +50,58 @@ type NopCounterVec struct {
 func (v *NopCounterVec) With(_ prometheus.Labels) prometheus.Counter {
 	return &NopCounter{}
 }
+
+// GaugeVec is a a subset of the functionality of a prometheus.GaugeVec.
+type GaugeVec interface {
+	// With returns a gauge with the supplied labels.
+	With(prometheus.Labels) prometheus.Gauge
+
+	// Delete deletes the gauge with the supplied labels, returning true if
+	// it existed.
+	Delete(prometheus.Labels) bool
+}
+
+// A NopGauge is a no-op implementation of a Prometheus gauge.
+type NopGauge struct {
+	prometheus.Gauge
+}
+
+// Set does nothing.
+func (g *NopGauge) Set(_ float64) {
+	return
+}
+
+// Inc does nothing.
+func (g *NopGauge) Inc() {
+	return
+}
+
+// Dec does nothing.
+func (g *NopGauge) Dec() {
+	return
+}
+
+// Add does nothing.
+func (g *NopGauge) Add(_ float64) {
+	return
+}
+
+// Sub does nothing.
+func (g *NopGauge) Sub(_ float64) {
+	return
+}
+
+// A NopGaugeVec is a no-op implementation of GaugeVec.
+type NopGaugeVec struct {
+	GaugeVec
+}
+
+// With returns a no-op gauge.
+func (v *NopGaugeVec) With(_ prometheus.Labels) prometheus.Gauge {
+	return &NopGauge{}
+}
+
+// Delete does nothing.
+func (v *NopGaugeVec) Delete(_ prometheus.Labels) bool {
+	return false
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+// Package ocsp requests OCSP responses from OCSP servers.
+package ocsp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const contentTypeOCSPRequest = "application/ocsp-request"
+
+// A Client requests OCSP responses from OCSP servers over HTTP.
+type Client struct {
+	c *http.Client
+}
+
+// New creates a new Client. Requests time out after the supplied duration.
+func New(timeout time.Duration) *Client {
+	return &Client{c: &http.Client{Timeout: timeout}}
+}
+
+// Respond sends an HTTP POST containing the supplied DER encoded OCSP request
+// to the supplied OCSP server URL, and returns the DER encoded response.
+// Respond returns an error when it encounters any HTTP status code that is not
+// a 200 OK.
+func (c *Client) Respond(server string, request []byte) ([]byte, error) {
+	rsp, err := c.c.Post(server, contentTypeOCSPRequest, bytes.NewReader(request))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot request OCSP response from %v", server)
+	}
+	defer rsp.Body.Close()
+
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read OCSP response")
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("OCSP request failed: %d %v: %s", rsp.StatusCode, rsp.Status, b)
+	}
+	return b, nil
+}
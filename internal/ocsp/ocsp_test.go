@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package ocsp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/hal5d/internal/cert"
+)
+
+func TestRespond(t *testing.T) {
+
+	var _ cert.OCSPResponder = &Client{}
+
+	request := []byte("request")
+	response := []byte("response")
+
+	cases := []struct {
+		name    string
+		fn      http.HandlerFunc
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "Success",
+			fn: func(w http.ResponseWriter, r *http.Request) {
+				defer r.Body.Close()
+				b, _ := ioutil.ReadAll(r.Body)
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != contentTypeOCSPRequest || !bytes.Equal(b, request) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(response)
+			},
+			want: response,
+		},
+		{
+			name: "Error",
+			fn: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Boom!"))
+				r.Body.Close()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewServer(tc.fn)
+			defer s.Close()
+
+			got, err := New(5*time.Second).Respond(s.URL, request)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("New().Respond(%v): want error, got nil", s.URL)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("New().Respond(%v): want no error, got %v", s.URL, err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("New().Respond(%v): want %s, got %s", s.URL, tc.want, got)
+			}
+		})
+	}
+}
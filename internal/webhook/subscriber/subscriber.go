@@ -17,16 +17,28 @@ and limitations under the License.
 package subscriber
 
 import (
+	"time"
+
 	"github.com/planetlabs/hal5d/internal/webhook"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-// A Subscriber wraps a webhook to satisfy cert.Subscriber.
+// Defaults used by new Subscribers.
+const (
+	DefaultDebounce    = 1 * time.Second
+	DefaultMinInterval = 5 * time.Second
+)
+
+// A Subscriber wraps a webhook to satisfy cert.Subscriber. Changes are
+// coalesced such that bursts of changes trigger the webhook once.
 type Subscriber struct {
-	log *zap.Logger
-	h   webhook.Hook
+	log         *zap.Logger
+	h           webhook.Hook
+	debounce    time.Duration
+	minInterval time.Duration
+	changed     chan struct{}
 }
 
 // An Option can be used to configure new Subscribers.
@@ -40,9 +52,41 @@ func WithLogger(l *zap.Logger) Option {
 	}
 }
 
-// New creates a new Subscriber.
+// WithDebounce configures how long a Subscriber waits after it is notified of
+// a change before triggering its webhook. All changes that arrive during this
+// window are coalesced into a single trigger.
+func WithDebounce(d time.Duration) Option {
+	return func(s *Subscriber) error {
+		if d < 0 {
+			return errors.Errorf("debounce window %v must not be negative", d)
+		}
+		s.debounce = d
+		return nil
+	}
+}
+
+// WithMinInterval configures the minimum time between the start of two
+// successive webhook triggers, thus limiting the maximum trigger rate.
+func WithMinInterval(d time.Duration) Option {
+	return func(s *Subscriber) error {
+		if d < 0 {
+			return errors.Errorf("minimum interval %v must not be negative", d)
+		}
+		s.minInterval = d
+		return nil
+	}
+}
+
+// New creates a new Subscriber. The Subscriber does not trigger its webhook
+// until it is Run.
 func New(h webhook.Hook, o ...Option) (*Subscriber, error) {
-	s := &Subscriber{log: zap.NewNop(), h: h}
+	s := &Subscriber{
+		log:         zap.NewNop(),
+		h:           h,
+		debounce:    DefaultDebounce,
+		minInterval: DefaultMinInterval,
+		changed:     make(chan struct{}, 1),
+	}
 	for _, so := range o {
 		if err := so(s); err != nil {
 			return nil, errors.Wrap(err, "cannot apply subscriber option")
@@ -51,11 +95,61 @@ func New(h webhook.Hook, o ...Option) (*Subscriber, error) {
 	return s, nil
 }
 
-// Changed triggers the wrapped webhook asynchronously.
+// Changed notes that a change has occurred. It never blocks. Changes that
+// arrive while the webhook is being triggered result in a trailing trigger.
 func (s *Subscriber) Changed() {
-	go func() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// A trigger is already pending.
+	}
+}
+
+// Run triggers the wrapped webhook when changes occur until the provided stop
+// channel is closed. At most one trigger is in flight at any time.
+func (s *Subscriber) Run(stop <-chan struct{}) {
+	var last time.Time
+	for {
+		select {
+		case <-s.changed:
+		case <-stop:
+			return
+		}
+
+		wait := s.debounce
+		if next := time.Until(last.Add(s.minInterval)); next > wait {
+			wait = next
+		}
+		if !sleep(stop, wait) {
+			return
+		}
+
+		// Any changes that arrived while we waited are handled by this
+		// trigger, not a subsequent one.
+		select {
+		case <-s.changed:
+		default:
+		}
+
+		last = time.Now()
 		if err := s.h.Trigger(); err != nil {
 			s.log.Error("subscriber webhook failed", zap.Error(err))
 		}
-	}()
+	}
+}
+
+// sleep for the supplied duration, returning false if the provided stop
+// channel was closed before it elapsed.
+func sleep(stop <-chan struct{}, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
 }
@@ -17,11 +17,140 @@ and limitations under the License.
 package subscriber
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/planetlabs/hal5d/internal/cert"
 )
 
+const timeout = 5 * time.Second
+
+// A blockingHook records when it was triggered, and blocks each trigger until
+// it is released.
+type blockingHook struct {
+	triggered chan time.Time
+	release   chan error
+}
+
+func newBlockingHook() *blockingHook {
+	return &blockingHook{triggered: make(chan time.Time, 100), release: make(chan error, 100)}
+}
+
+func (h *blockingHook) Trigger() error {
+	h.triggered <- time.Now()
+	return <-h.release
+}
+
+func (h *blockingHook) wait(t *testing.T) time.Time {
+	t.Helper()
+	select {
+	case at := <-h.triggered:
+		return at
+	case <-time.After(timeout):
+		t.Fatal("webhook was not triggered")
+	}
+	return time.Time{}
+}
+
+func (h *blockingHook) never(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case <-h.triggered:
+		t.Fatal("webhook was unexpectedly triggered")
+	case <-time.After(d):
+	}
+}
+
+func run(t *testing.T, h *blockingHook, o ...Option) (*Subscriber, func()) {
+	t.Helper()
+	s, err := New(h, o...)
+	if err != nil {
+		t.Fatalf("New(...): %v", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+	return s, func() {
+		close(stop)
+		close(h.release)
+		<-done
+	}
+}
+
 func TestSubscriber(t *testing.T) {
 	var _ cert.Subscriber = &Subscriber{}
 }
+
+func TestChangesAreCoalesced(t *testing.T) {
+	h := newBlockingHook()
+	s, stop := run(t, h, WithDebounce(50*time.Millisecond), WithMinInterval(0))
+	defer stop()
+
+	for i := 0; i < 300; i++ {
+		s.Changed()
+	}
+	h.wait(t)
+	h.release <- nil
+	h.never(t, 200*time.Millisecond)
+}
+
+func TestTrailingTrigger(t *testing.T) {
+	h := newBlockingHook()
+	s, stop := run(t, h, WithDebounce(0), WithMinInterval(0))
+	defer stop()
+
+	s.Changed()
+	h.wait(t)
+
+	// Changes that arrive while a trigger is in flight must not start another
+	// trigger until the first completes.
+	s.Changed()
+	s.Changed()
+	h.never(t, 100*time.Millisecond)
+
+	h.release <- errors.New("boom")
+	h.wait(t)
+	h.release <- nil
+	h.never(t, 100*time.Millisecond)
+}
+
+func TestMinInterval(t *testing.T) {
+	interval := 200 * time.Millisecond
+	h := newBlockingHook()
+	s, stop := run(t, h, WithDebounce(0), WithMinInterval(interval))
+	defer stop()
+
+	s.Changed()
+	first := h.wait(t)
+	h.release <- nil
+
+	s.Changed()
+	second := h.wait(t)
+	h.release <- nil
+
+	if got := second.Sub(first); got < interval {
+		t.Errorf("webhook triggered %v apart, want at least %v", got, interval)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		o    Option
+	}{
+		{name: "NegativeDebounce", o: WithDebounce(-1 * time.Second)},
+		{name: "NegativeMinInterval", o: WithMinInterval(-1 * time.Second)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(newBlockingHook(), tc.o); err == nil {
+				t.Errorf("New(...): want error, got nil")
+			}
+		})
+	}
+}